@@ -0,0 +1,100 @@
+// serveur d'annuaire à lancer sur un réseau privé, à la place de jch.irif.fr
+//
+//	go run ./cmd/directory -http :8443 -udp :8443 -public 192.168.1.10:8443
+package main
+
+import (
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"project/pkg/directory"
+	"project/pkg/identity"
+	"project/pkg/p2p"
+)
+
+func main() {
+
+	httpAddr := flag.String("http", ":8443", "adresse d'écoute HTTP (API /peers/...)")
+	udpAddr := flag.String("udp", ":8443", "adresse d'écoute UDP (Hello, NAT traversal)")
+	name := flag.String("name", "server", "nom du serveur (dans ses Hello)")
+	keyFile := flag.String("key", "directory.pem", "fichier de la clef privée du serveur (créé s'il n'existe pas)")
+	public := flag.String("public", "", "adresses UDP publiques du serveur, séparées par des virgules (publiées sous son nom)")
+	ttl := flag.Duration("ttl", directory.DefaultAddressTTL, "durée de vie d'une adresse sans nouveau Hello")
+	tlsCert := flag.String("tls-cert", "", "certificat TLS (HTTPS si -tls-cert et -tls-key sont donnés)")
+	tlsKey := flag.String("tls-key", "", "clef du certificat TLS")
+	verbose := flag.Bool("b", false, "activer le mode bavard")
+	flag.Parse()
+
+	p2p.Verbose = *verbose
+
+	// la clef du serveur : on la garde d'un lancement à l'autre pour que les pairs la retrouvent
+	priv, err := load__or__create__key(*keyFile)
+	if err != nil {
+		log.Fatalf("clef du serveur : %v", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *udpAddr)
+	if err != nil {
+		log.Fatalf("adresse UDP invalide : %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalf("ouverture du port UDP : %v", err)
+	}
+
+	var publicAddrs []string
+	for _, a := range strings.Split(*public, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			publicAddrs = append(publicAddrs, a)
+		}
+	}
+
+	server, err := directory.New(*name, priv, conn, publicAddrs)
+	if err != nil {
+		log.Fatalf("création du serveur : %v", err)
+	}
+	server.AddressTTL = *ttl
+
+	go server.Serve__UDP()
+	fmt.Printf("annuaire '%s' : UDP sur %s\n", *name, conn.LocalAddr())
+
+	httpServer := &http.Server{
+		Addr:              *httpAddr,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if *tlsCert != "" && *tlsKey != "" {
+		fmt.Printf("annuaire '%s' : HTTPS sur %s\n", *name, *httpAddr)
+		err = httpServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		fmt.Printf("annuaire '%s' : HTTP sur %s\n", *name, *httpAddr)
+		err = httpServer.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+// charge la clef privée du serveur, ou en crée une nouvelle
+func load__or__create__key(path string) (*ecdsa.PrivateKey, error) {
+
+	priv, err := identity.Load_Identity__from(path)
+	if err == nil {
+		return priv, nil
+	}
+
+	priv, err = identity.KeyGen()
+	if err != nil {
+		return nil, err
+	}
+	if err := identity.Save__Identity__to(path, priv); err != nil {
+		return nil, err
+	}
+	fmt.Printf("nouvelle clef du serveur enregistrée dans %s\n", path)
+	return priv, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"project/pkg/p2p"
+)
+
+// fichier de configuration lu par défaut (s'il existe)
+const defaultConfigFile = "peer.conf"
+
+// la configuration du pair. Chaque valeur vient, par ordre de priorité, des options de la ligne de commande,
+// des variables d'environnement (P2P_...), du fichier de configuration, ou de la valeur par défaut
+//
+// le fichier contient une valeur par ligne (les lignes commençant par '#' sont ignorées) :
+//
+//	name = alice
+//	port = 8082
+//	share = mon_dossier
+//	rekey = 15m
+//	encryption = require
+//	keychange = block
+//	server = https://jch.irif.fr:8443
+//	server = http://192.168.1.10:8443 name=server udp=192.168.1.10:8443
+type Config struct {
+	// nom du pair ("" : on le demande à l'user)
+	Name string
+	// port UDP (0 : on le demande à l'user)
+	Port int
+	// dossier à partager au lancement ("" : on le demande à l'user)
+	Share string
+	// serveurs d'annuaire, le principal en premier
+	Servers []ServerConfig
+	// durée de vie des clés de session (0 : p2p.DefaultRekeyAfter)
+	Rekey time.Duration
+	// politique de chiffrement globale (require, prefer ou off)
+	Encryption p2p.EncryptionPolicy
+	// que faire si l'annuaire donne une autre clef que celle retenue pour un pair (block ou warn)
+	KeyChange p2p.KeyChangePolicy
+}
+
+// un serveur d'annuaire : "URL [name=nom] [udp=ip:port]"
+// sans udp=, l'adresse UDP est demandée au serveur lui-même (publiée sous son nom, par défaut le nom d'hôte de l'URL)
+type ServerConfig struct {
+	URL  string
+	Name string
+	UDP  string
+}
+
+// les options de la ligne de commande qui concernent la configuration
+type configFlags struct {
+	file       *string
+	name       *string
+	port       *int
+	share      *string
+	rekey      *time.Duration
+	encryption *string
+	keychange  *string
+	servers    serverList
+}
+
+// option -server, qu'on peut répéter
+type serverList []string
+
+func (l *serverList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *serverList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// déclare les options (avant flag.Parse)
+func config__flags() *configFlags {
+
+	flags := &configFlags{
+		file:       flag.String("config", "", "fichier de configuration (default: "+defaultConfigFile+" s'il existe, ou $P2P_CONFIG)"),
+		name:       flag.String("name", "", "nom du pair (ou $P2P_NAME)"),
+		port:       flag.Int("port", 0, "port UDP (ou $P2P_PORT)"),
+		share:      flag.String("share", "", "dossier à partager au lancement (ou $P2P_SHARE)"),
+		encryption: flag.String("encryption", "", "politique de chiffrement : require, prefer ou off (ou $P2P_ENCRYPTION, défaut prefer)"),
+		keychange:  flag.String("keychange", "", "si la clef d'un pair connu change : block ou warn (ou $P2P_KEYCHANGE, défaut block)"),
+		rekey:      flag.Duration("rekey", 0, "changement des clés de session après cette durée, ex: 10m (ou $P2P_REKEY, défaut "+p2p.DefaultRekeyAfter.String()+")"),
+	}
+	flag.Var(&flags.servers, "server", "serveur d'annuaire \"URL [name=nom] [udp=ip:port]\", répétable (ou $P2P_SERVERS, séparés par ';')")
+	return flags
+}
+
+// construit la configuration (après flag.Parse)
+func load__config(flags *configFlags) (*Config, error) {
+
+	cfg := &Config{}
+
+	// 1. le fichier
+	path := os.Getenv("P2P_CONFIG")
+	if *flags.file != "" {
+		path = *flags.file
+	}
+	if path != "" {
+		if err := cfg.read__file(path); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(defaultConfigFile); err == nil {
+		if err := cfg.read__file(defaultConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. l'environnement
+	if err := cfg.set("name", os.Getenv("P2P_NAME")); err != nil {
+		return nil, fmt.Errorf("P2P_NAME : %v", err)
+	}
+	if err := cfg.set("port", os.Getenv("P2P_PORT")); err != nil {
+		return nil, fmt.Errorf("P2P_PORT : %v", err)
+	}
+	if err := cfg.set("share", os.Getenv("P2P_SHARE")); err != nil {
+		return nil, fmt.Errorf("P2P_SHARE : %v", err)
+	}
+	if err := cfg.set("rekey", os.Getenv("P2P_REKEY")); err != nil {
+		return nil, fmt.Errorf("P2P_REKEY : %v", err)
+	}
+	if err := cfg.set("encryption", os.Getenv("P2P_ENCRYPTION")); err != nil {
+		return nil, fmt.Errorf("P2P_ENCRYPTION : %v", err)
+	}
+	if err := cfg.set("keychange", os.Getenv("P2P_KEYCHANGE")); err != nil {
+		return nil, fmt.Errorf("P2P_KEYCHANGE : %v", err)
+	}
+	if env := os.Getenv("P2P_SERVERS"); env != "" {
+		servers, err := parse__servers(strings.Split(env, ";"))
+		if err != nil {
+			return nil, fmt.Errorf("P2P_SERVERS : %v", err)
+		}
+		cfg.Servers = servers
+	}
+
+	// 3. la ligne de commande
+	cfg.set("name", *flags.name)
+	cfg.set("share", *flags.share)
+	if *flags.port != 0 {
+		cfg.Port = *flags.port
+	}
+	if *flags.rekey != 0 {
+		cfg.Rekey = *flags.rekey
+	}
+	if err := cfg.set("encryption", *flags.encryption); err != nil {
+		return nil, fmt.Errorf("-encryption : %v", err)
+	}
+	if err := cfg.set("keychange", *flags.keychange); err != nil {
+		return nil, fmt.Errorf("-keychange : %v", err)
+	}
+	if len(flags.servers) > 0 {
+		servers, err := parse__servers(flags.servers)
+		if err != nil {
+			return nil, fmt.Errorf("-server : %v", err)
+		}
+		cfg.Servers = servers
+	}
+
+	// par défaut : le serveur du sujet
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []ServerConfig{{URL: p2p.DefaultServerURL}}
+	}
+
+	return cfg, nil
+}
+
+// lit un fichier de configuration. Les serveurs du fichier remplacent les précédents
+func (cfg *Config) read__file(path string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("fichier de configuration : %v", err)
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("%s:%d : 'clef = valeur' attendu", path, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if key == "server" {
+			servers = append(servers, value)
+			continue
+		}
+		if err := cfg.set(key, value); err != nil {
+			return fmt.Errorf("%s:%d : %v", path, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("fichier de configuration : %v", err)
+	}
+
+	if len(servers) > 0 {
+		parsed, err := parse__servers(servers)
+		if err != nil {
+			return fmt.Errorf("%s : %v", path, err)
+		}
+		cfg.Servers = parsed
+	}
+	return nil
+}
+
+// change une valeur (sauf les serveurs). Une valeur vide ne change rien
+func (cfg *Config) set(key string, value string) error {
+
+	if value == "" {
+		return nil
+	}
+
+	switch key {
+	case "name":
+		cfg.Name = value
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("port invalide : %s", value)
+		}
+		cfg.Port = port
+	case "share":
+		cfg.Share = value
+	case "rekey":
+		rekey, err := time.ParseDuration(value)
+		if err != nil || rekey <= 0 {
+			return fmt.Errorf("durée invalide : %s (ex: 15m)", value)
+		}
+		cfg.Rekey = rekey
+	case "encryption":
+		policy, err := p2p.Parse__encryption__policy(value)
+		if err != nil {
+			return err
+		}
+		cfg.Encryption = policy
+	case "keychange":
+		policy, err := p2p.Parse__key__change__policy(value)
+		if err != nil {
+			return err
+		}
+		cfg.KeyChange = policy
+	default:
+		return fmt.Errorf("option inconnue : %s", key)
+	}
+	return nil
+}
+
+// lit des serveurs "URL [name=nom] [udp=ip:port]" (les entrées vides sont ignorées)
+func parse__servers(specs []string) ([]ServerConfig, error) {
+
+	var servers []ServerConfig
+	for _, spec := range specs {
+
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+
+		server := ServerConfig{URL: fields[0]}
+		// un serveur sans API HTTP : "udp=ip:port" seul
+		if strings.HasPrefix(fields[0], "udp=") || strings.HasPrefix(fields[0], "name=") {
+			server.URL = ""
+			fields = append([]string{""}, fields...)
+		}
+
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "name":
+				server.Name = value
+			case "udp":
+				server.UDP = value
+			default:
+				return nil, fmt.Errorf("serveur '%s' : option inconnue '%s'", spec, field)
+			}
+		}
+
+		if server.URL == "" && server.UDP == "" {
+			return nil, fmt.Errorf("serveur '%s' : il faut une URL ou une adresse udp=", spec)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,10 +23,18 @@ import (
 	"project/pkg/p2p"
 )
 
+// temps laissé à l'annuaire pour répondre à une commande (nouvelles tentatives comprises)
+const directoryTimeout = 30 * time.Second
+
+// dossier où on garde les squelettes des pairs (un fichier par pair)
+const skeletonDir = "skeletons"
+
 func main() {
 
 	// gestion du mode bavard
 	verbosePtr := flag.Bool("b", false, "activer le mode bavard")
+	// les options de configuration (nom, port, serveurs...), voir config.go
+	flags := config__flags()
 	flag.Parse()
 
 	// on active le mode bavard si demandé par -b
@@ -34,55 +47,69 @@ func main() {
 	// USER INFO
 	/////////////
 
-	// URL du serveur
-	serverURL := "https://jch.irif.fr:8443"
+	// la configuration (options, variables d'environnement, fichier peer.conf)
+	cfg, err := load__config(flags)
+	if err != nil {
+		log.Fatalf("erreur de configuration : %v", err)
+	}
 
 	// on crée un scnanner qui va lire tout ce que l'user tape dans le terminal
 	scanner := bufio.NewScanner(os.Stdin)
 
-	// on demande le nom
-	fmt.Print("\n entrez votre nom (default: 'bob') : ")
+	// on ne demande que ce qui n'est pas déjà configuré
+	my_name := cfg.Name
+	if my_name == "" {
+		// on demande le nom
+		fmt.Print("\n entrez votre nom (default: 'bob') : ")
 
-	// on attend que la touche entree soit pressée
-	scanner.Scan()
+		// on attend que la touche entree soit pressée
+		scanner.Scan()
 
-	// on récupère juste le nom (on enlève les espaces)
-	my_name := strings.TrimSpace(scanner.Text())
+		// on récupère juste le nom (on enlève les espaces)
+		my_name = strings.TrimSpace(scanner.Text())
 
-	// gestion de la valeur par défautl
-	if my_name == "" {
-		my_name = "bob"
+		// gestion de la valeur par défautl
+		if my_name == "" {
+			my_name = "bob"
+		}
 	}
 
-	// on demande le port UDP que veut utiliser l'user
-	fmt.Print(" entrez votre port UDP (default: 8082) : ")
-	scanner.Scan()
+	my_UDP_port := cfg.Port
+	if my_UDP_port == 0 {
+		// on demande le port UDP que veut utiliser l'user
+		fmt.Print(" entrez votre port UDP (default: 8082) : ")
+		scanner.Scan()
 
-	// on enleve les espaces
-	portStr := strings.TrimSpace(scanner.Text())
+		// on enleve les espaces
+		portStr := strings.TrimSpace(scanner.Text())
 
-	// par defaut 8082
-	my_UDP_port := 8082
+		// par defaut 8082
+		my_UDP_port = 8082
 
-	// on lit ce que l'user a écrit
-	// si non vide
-	if portStr != "" {
+		// on lit ce que l'user a écrit
+		// si non vide
+		if portStr != "" {
 
-		// conversion en int
-		portInt, err := strconv.Atoi(portStr)
+			// conversion en int
+			portInt, err := strconv.Atoi(portStr)
 
-		// si ca marche on utilise cet entier comme port
-		if err == nil {
-			my_UDP_port = portInt
-		} else {
-			fmt.Println("port invalide. usage du port par dedfaut (8082)")
+			// si ca marche on utilise cet entier comme port
+			if err == nil {
+				my_UDP_port = portInt
+			} else {
+				fmt.Println("port invalide. usage du port par dedfaut (8082)")
+			}
 		}
 	}
 
-	// on demande si l'user veut partager un dossier (il peut le faire plus tard aussi)
-	fmt.Print(" entrez le nom du dossier à partager (default : rien): ")
-	scanner.Scan()
-	sharePath := strings.TrimSpace(scanner.Text())
+	// le partage est facultatif : si le nom est déjà configuré, on ne pose pas la question
+	sharePath := cfg.Share
+	if sharePath == "" && cfg.Name == "" {
+		// on demande si l'user veut partager un dossier (il peut le faire plus tard aussi)
+		fmt.Print(" entrez le nom du dossier à partager (default : rien): ")
+		scanner.Scan()
+		sharePath = strings.TrimSpace(scanner.Text())
+	}
 
 	/////////////
 	// IDENTITE
@@ -90,7 +117,6 @@ func main() {
 
 	// on prépare une variable pour notre clef privée
 	var my_privKey *ecdsa.PrivateKey
-	var err error
 
 	// on essaie de charger une clef depuis le fichier identity.pem
 	my_privKey, err = identity.Load_Identity()
@@ -114,12 +140,33 @@ func main() {
 	pubKeyBytes := identity.PublicKey__to__bytes(pubKey)
 
 	// On commence une nouvelle communication
-	me, err := p2p.New__communication(my_UDP_port, my_privKey, my_name, serverURL)
+	me, err := p2p.New__communication(my_UDP_port, my_privKey, my_name, "")
 	if err != nil {
 		// si on échoue on arrête tout
 		log.Fatalf("erreur à l'ouverture de la communication UDP (est-ce que le numéro de port est utilisable ?): %v", err)
 	}
 
+	// nos serveurs d'annuaire (leur adresse UDP est demandée au serveur lui-même si elle n'est pas configurée)
+	for _, server := range cfg.Servers {
+		me.Add__server(p2p.New__directory__server(server.URL, server.Name, server.UDP))
+	}
+
+	// durée de vie des clés de session (0 : valeur par défaut)
+	me.RekeyAfter = cfg.Rekey
+	// chiffrement exigé, préféré ou désactivé (voir la commande policy)
+	me.Set__default__encryption(cfg.Encryption)
+
+	// les clefs des pairs retenues au premier contact (fichier known_peers, voir les commandes known, trust et forget)
+	knownPeers, err := identity.Load__known__peers()
+	if err != nil {
+		log.Fatalf("erreur lecture des pairs connus : %v", err)
+	}
+	me.KnownPeers = knownPeers
+	me.KeyChange = cfg.KeyChange
+
+	// les squelettes téléchargés sont gardés d'une exécution à l'autre (voir les commandes skeleton, print -o, ls et diff)
+	me.SkeletonDir = skeletonDir
+
 	// on charge le dossier voulu
 	if sharePath != "" {
 
@@ -144,9 +191,12 @@ func main() {
 	////////////////////////////////////////////////////////////////
 
 	fmt.Println("\nPour commencer, il faut se register auprès du serveur.")
-	fmt.Println("Pour être reconnu par le serveur comme un pair, il faut envoyer un 'Hello' à son peer.")
+	fmt.Println("Pour être reconnu par le serveur comme un pair, il faut envoyer un 'Hello' à son peer ('servers' pour les lister).")
 	fmt.Println("Pour connaître la liste des commandes disponibles, taper 'help'.")
 
+	// permet d'interrompre un 'print' lancé en arrière plan (commande 'stop')
+	var cancelPrint context.CancelFunc
+
 	// boucle infinie
 	for {
 		// UI
@@ -185,7 +235,7 @@ func main() {
 		case "info":
 			fmt.Printf("MES INFOS: \n")
 			fmt.Printf("Nom : %s\n", my_name)
-			myAddr, err := find__addr__from__name(my_name, serverURL)
+			myAddr, err := find__addr__from__name(my_name, me)
 			if err != nil {
 				fmt.Printf("Erreur : %v\n", err)
 				continue
@@ -199,12 +249,29 @@ func main() {
 			continue
 
 		case "register":
-			err = client.Register(serverURL, my_name, pubKeyBytes)
-			if err != nil {
-				p2p.LogMsg("erreur Register (%v)\n", err)
-			} else {
-				p2p.LogMsg("enregistrement (HTTP) auprès du serveur réussi")
+			// on s'enregistre auprès de chaque serveur
+			ctx, cancel := directory__context()
+			for _, server := range me.Servers() {
+				if server.Client == nil {
+					continue
+				}
+				err = server.Client.Register(ctx, my_name, pubKeyBytes)
+				var serverErr *client.ServerError
+				if errors.As(err, &serverErr) && serverErr.Code == http.StatusConflict {
+					p2p.LogMsg("erreur Register sur %s : le nom %s est déjà enregistré avec une autre clef\n", server.Name, my_name)
+				} else if err != nil {
+					p2p.LogMsg("erreur Register sur %s (%v)\n", server.Name, err)
+				} else {
+					p2p.LogMsg("enregistrement (HTTP) auprès de %s réussi\n", server.Name)
+				}
 			}
+			cancel()
+			// notre clef a pu changer : on oublie ce qu'on gardait sur nous
+			me.Directory.Invalidate(my_name)
+			continue
+
+		case "servers":
+			print__servers(me)
 			continue
 
 		case "active":
@@ -222,33 +289,117 @@ func main() {
 			}
 			continue
 
-		case "peers":
-			// appel au serveur pour demander la liste de pair qu'il a
-			list, err := client.Get__peer__list(serverURL)
-			if err != nil {
-				p2p.LogMsg("Erreur get__peer_list :", err)
-			} else {
-				p2p.LogMsg("peers dans l'annuaire du serveur: \n")
-				for i := 0; i < len(list); i++ {
-					p := list[i]
-					fmt.Printf("- %s\n", p)
+		case "policy":
+			// policy : affiche ; policy <require|prefer|off> : globale ; policy <nom ou clef> <require|prefer|off|default>
+			switch len(args) {
+			case 0:
+			case 1:
+				policy, err := p2p.Parse__encryption__policy(args[0])
+				if err != nil {
+					fmt.Printf("Erreur : %v\n", err)
+					continue
+				}
+				me.Set__default__encryption(policy)
+			default:
+				if args[1] == "default" {
+					me.Clear__encryption__policy(args[0])
+					break
 				}
+				policy, err := p2p.Parse__encryption__policy(args[1])
+				if err != nil {
+					fmt.Printf("Erreur : %v\n", err)
+					continue
+				}
+				me.Set__encryption__policy(args[0], policy)
 			}
+			print__policies(me)
 			continue
 
-		case "key":
+		case "known":
+			// les clefs retenues
+			known := me.KnownPeers.List()
+			if len(known) == 0 {
+				fmt.Println("aucun pair connu")
+			}
+			for _, peer := range known {
+				fmt.Printf("- %-20s %s (depuis le %s)\n", peer.Name, peer.Fingerprint, peer.FirstSeen.Format("02/01/2006 15:04"))
+			}
+			continue
+
+		case "trust":
 			if len(args) < 1 {
-				fmt.Println("usage: key <nom_du_peer>")
+				fmt.Println("usage: trust <nom_du_peer>")
 				continue
 			}
 			peerName := args[0]
 
-			// appel au serveur pour obtenir la clef publique d'un pair
-			key, err := client.Get__publicKey(serverURL, peerName)
+			// on retient la clef que donne l'annuaire maintenant (à vérifier avec le pair par un autre moyen)
+			me.Directory.Invalidate(peerName)
+			key, err := find__key__from__name(peerName, me)
 			if err != nil {
 				p2p.LogMsg(" erreur get_pubKey: %v\n", err)
+				continue
+			}
+			if err := me.KnownPeers.Trust(peerName, key); err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+			p2p.LogMsg("clef de %s retenue (empreinte %s)\n", peerName, identity.Fingerprint(key))
+			continue
+
+		case "forget":
+			if len(args) < 1 {
+				fmt.Println("usage: forget <nom_du_peer>")
+				continue
+			}
+			forgotten, err := me.KnownPeers.Forget(args[0])
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+			} else if !forgotten {
+				fmt.Printf("%s n'est pas un pair connu\n", args[0])
 			} else {
-				p2p.LogMsg("clef publique de %s :\n%x\n", peerName, key)
+				fmt.Printf("clef de %s oubliée (elle sera retenue au prochain contact)\n", args[0])
+			}
+			continue
+
+		case "peers":
+			// appel à chaque serveur pour demander la liste de pair qu'il a
+			ctx, cancel := directory__context()
+			for _, server := range me.Servers() {
+				if server.Client == nil {
+					continue
+				}
+				list, err := server.Client.Get__peer__list(ctx)
+				if err != nil {
+					p2p.LogMsg("Erreur get__peer_list sur %s : %v\n", server.Name, err)
+				} else {
+					p2p.LogMsg("peers dans l'annuaire de %s: \n", server.Name)
+					for i := 0; i < len(list); i++ {
+						p := list[i]
+						fmt.Printf("- %s\n", p)
+					}
+				}
+			}
+			cancel()
+			continue
+
+		case "key":
+			if len(args) < 1 {
+				fmt.Println("usage: key <nom_du_peer> [autres noms...]")
+				continue
+			}
+
+			// appel aux serveurs pour obtenir la clef publique des pairs (en parallèle s'il y en a plusieurs)
+			ctx, cancel := directory__context()
+			keys := me.Lookup__keys(ctx, args)
+			cancel()
+			for _, peerName := range args {
+				result := keys[peerName]
+				if result.Err != nil {
+					p2p.LogMsg(" erreur get_pubKey (%s): %v\n", peerName, result.Err)
+				} else {
+					p2p.LogMsg("clef publique de %s :\n%x\n", peerName, result.Key)
+				}
 			}
 			continue
 
@@ -259,8 +410,8 @@ func main() {
 			}
 			peerName := args[0]
 
-			// appel au serveur poir obtenir les adresses d'un pair
-			addrs, err := client.Get__peer__adresses(serverURL, peerName)
+			// appel aux serveurs poir obtenir les adresses d'un pair
+			addrs, err := find__addrs__from__name(peerName, me)
 			if err != nil {
 				p2p.LogMsg(" erreur get__peer__adresses : %v\n", err)
 			} else {
@@ -279,7 +430,7 @@ func main() {
 				continue
 			}
 
-			destAddr, err := find__addr__from__name(args[0], serverURL)
+			destAddr, err := find__addr__from__name(args[0], me)
 			if err != nil {
 				fmt.Printf("Erreur : %v\n", err)
 				continue
@@ -296,7 +447,7 @@ func main() {
 				continue
 			}
 
-			destAddr, err := find__addr__from__name(args[0], serverURL)
+			destAddr, err := find__addr__from__name(args[0], me)
 			if err != nil {
 				fmt.Printf("Erreur : %v\n", err)
 				continue
@@ -330,66 +481,168 @@ func main() {
 
 		case "download":
 			if len(args) < 1 {
-				fmt.Println("usage: download <nom ou addr> [path_file]")
+				fmt.Println("usage: download <nom ou addr> [-y] [-s] [-o] [-p prioritaire] [chemin ou motif ...]")
 				continue
 			}
 
-			destAddr, err := find__addr__from__name(args[0], serverURL)
+			destAddr, err := find__addr__from__name(args[0], me)
 			if err != nil {
 				fmt.Printf("Erreur : %v\n", err)
 				continue
 			}
 
-			targetPath := ""
-			if len(args) > 1 {
-				targetPath = args[1]
+			// -y : pas de confirmation avant de télécharger une sélection
+			// -p <chemin ou motif> : à récupérer avant le reste (sans restreindre le téléchargement)
+			// -s : écriture des fichiers pendant le téléchargement (sans tout garder en mémoire)
+			// -o : la racine et les motifs viennent du squelette gardé (pas de RootRequest ni de parcours chez le pair)
+			skipConfirm := false
+			streaming := false
+			fromSkeleton := false
+			var patterns []string
+			var priority []string
+			for i := 1; i < len(args); i++ {
+				switch {
+				case args[i] == "-y":
+					skipConfirm = true
+				case args[i] == "-s":
+					streaming = true
+				case args[i] == "-o":
+					fromSkeleton = true
+				case args[i] == "-p" && i+1 < len(args):
+					priority = append(priority, args[i+1])
+					i++
+				default:
+					patterns = append(patterns, args[i])
+				}
 			}
 
-			rootBytes, err := me.Send__RootRequest(destAddr)
-			if err != nil {
-				fmt.Printf("Impossible de récupérer la racine de %s : %v\n", destAddr, err)
-				continue
-			}
+			// CTRL+C annule le téléchargement en cours (et pas tout le programme)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 
 			var rootHash [32]byte
-			copy(rootHash[:], rootBytes)
-			var targetHash [32]byte
-
-			if targetPath == "" {
-				targetHash = rootHash
+			resolveAddr := destAddr
+			if fromSkeleton {
+				rootHash, err = me.Skeleton__root(skeleton__name(args[0], destAddr, me))
+				if err != nil {
+					stop()
+					fmt.Printf("Erreur : %v\n", err)
+					continue
+				}
+				// les motifs sont cherchés seulement dans le squelette
+				resolveAddr = ""
 			} else {
-				foundHash, err := me.Get__hash__from__path(destAddr, rootHash, targetPath)
+				rootBytes, err := me.Send__RootRequest__ctx(ctx, destAddr)
+				if err != nil {
+					stop()
+					fmt.Printf("Impossible de récupérer la racine de %s : %v\n", destAddr, err)
+					continue
+				}
+				copy(rootHash[:], rootBytes)
+			}
+
+			// par défaut, on télécharge tout l'arbre
+			selection := []p2p.RemoteEntry{{Path: "", Hash: rootHash, IsDir: true}}
+			outDir := filepath.Join("downloads", fmt.Sprintf("root_%x", rootHash[:4]))
+
+			// un seul chemin exact : on garde l'ancien comportement (downloads/<nom>)
+			singlePath := len(patterns) == 1 && !p2p.Is__glob(patterns[0])
+
+			if len(patterns) > 0 {
+				selection, err = me.Resolve__patterns(ctx, resolveAddr, rootHash, patterns)
 				if err != nil {
+					stop()
 					fmt.Printf("Erreur : %v\n", err)
 					continue
 				}
-				targetHash = foundHash
+
+				if len(selection) == 0 {
+					stop()
+					fmt.Println("aucun fichier ne correspond")
+					continue
+				}
+
+				// on montre d'abord ce qu'on a trouvé
+				fmt.Printf("%d correspondance(s) :\n", len(selection))
+				for _, entry := range selection {
+					if entry.IsDir {
+						fmt.Printf(" - %s/\n", entry.Path)
+					} else {
+						fmt.Printf(" - %s\n", entry.Path)
+					}
+				}
+
+				// confirmation (seulement pour les motifs, un chemin exact est sans surprise)
+				if !skipConfirm && !singlePath {
+					fmt.Print("télécharger cette sélection ? (o/N) : ")
+					if !scanner.Scan() {
+						stop()
+						break
+					}
+					answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+					if answer != "o" && answer != "oui" && answer != "y" && answer != "yes" {
+						stop()
+						fmt.Println("téléchargement annulé")
+						continue
+					}
+				}
+
+				// un seul chemin exact : on l'écrit directement dans downloads/<nom>
+				if singlePath {
+					outDir = "downloads"
+					selection[0].Path = filepath.Base(selection[0].Path)
+				}
 			}
 
-			// on lance un chrono
-			start := time.Now()
+			opts := p2p.DownloadOptions{RetryFailed: true, Priority: priority}
+			if streaming {
+				opts.StreamTo = outDir
+			}
 
-			// on appelle notre fonction de téléchargement
-			me.Download_tree(destAddr, targetHash)
+			// on appelle notre fonction de téléchargement (avec un second passage sur les échecs)
+			result := me.Download_selection__ctx(ctx, destAddr, selection, opts)
 
-			var outName string
-			if targetPath != "" {
-				outName = filepath.Base(targetPath)
-			} else {
-				outName = fmt.Sprintf("root_%x", targetHash[:4])
+			// on sort du mode "CTRL+C annule le téléchargement"
+			cancelled := ctx.Err() != nil
+			stop()
+
+			print__download__result(result)
+
+			if cancelled {
+				p2p.LogMsg("téléchargement annulé après %v.\n", result.Elapsed)
+				continue
 			}
 
-			// on écrit le dossier téléchargé en local
-			outDir := filepath.Join("downloads", outName)
+			// les fichiers ont déjà été écrits pendant le téléchargement
+			if streaming {
+				p2p.LogMsg("%d fichier(s) écrit(s) dans %s\n", result.FilesWritten, outDir)
+				for _, incomplete := range result.IncompleteFiles {
+					fmt.Printf(" - incomplet : %s\n", incomplete)
+				}
+				continue
+			}
 
-			// on reconstruit ce qui est dans la RAM actuellement
-			err = me.Rebuild__file__system(targetHash, outDir)
-			if err != nil {
-				fmt.Printf("erreur téléchargement, erreur %v:\n", err)
+			// inutile de reconstruire un arbre incomplet
+			if !result.Complete() {
+				fmt.Println("téléchargement incomplet, rien n'a été écrit sur le disque (relancer la commande pour réessayer)")
 				continue
 			}
 
-			p2p.LogMsg("téléchargement terminé en %v.\n", time.Since(start))
+			// on reconstruit ce qui est dans la RAM actuellement, en gardant l'arborescence relative
+			for _, entry := range selection {
+				entryDir := filepath.Join(outDir, filepath.FromSlash(entry.Path))
+
+				if err := os.MkdirAll(filepath.Dir(entryDir), 0755); err != nil {
+					fmt.Printf("erreur création dossier %s : %v\n", filepath.Dir(entryDir), err)
+					continue
+				}
+
+				err = me.Rebuild__file__system(entry.Hash, entryDir)
+				if err != nil {
+					fmt.Printf("erreur téléchargement, erreur %v:\n", err)
+				}
+			}
+
+			p2p.LogMsg("téléchargement terminé en %v (dans %s).\n", result.Elapsed, outDir)
 			continue
 
 		case "nattraversal":
@@ -398,22 +651,25 @@ func main() {
 				continue
 			}
 
-			targetAddr, err := find__addr__from__name(args[0], serverURL)
+			targetAddr, err := find__addr__from__name(args[0], me)
 			if err != nil {
 				fmt.Printf("Erreur : %v\n", err)
 				continue
 			}
 
-			// par defaut, l'intermediaire est le serveur
-			relayAddr := me.ServerUDPAddr
-
-			// on utilise celui fourni par l'user (s'il en fourni un)
+			// par defaut, l'intermediaire est le serveur principal
+			// sinon on utilise celui fourni par l'user (s'il en fourni un)
+			var relayAddr string
 			if len(args) >= 2 {
-				relayAddr, err = find__addr__from__name(args[1], serverURL)
-				if err != nil {
-					fmt.Printf("Erreur : %v\n", err)
-					continue
-				}
+				relayAddr, err = find__addr__from__name(args[1], me)
+			} else if server := me.Primary__server(); server != nil {
+				relayAddr, err = server.UDP__addr()
+			} else {
+				err = fmt.Errorf("aucun serveur configuré")
+			}
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
 			}
 
 			// appel à notre fonction
@@ -423,18 +679,152 @@ func main() {
 			}
 			continue
 
+		case "skeleton":
+			if len(args) < 1 {
+				fmt.Println("usage: skeleton <nom ou addr> [-big]")
+				continue
+			}
+
+			destAddr, err := find__addr__from__name(args[0], me)
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+
+			// -big : on garde aussi le premier niveau des gros fichiers
+			includeBig := len(args) > 1 && args[1] == "-big"
+
+			// CTRL+C annule le téléchargement en cours (et pas tout le programme)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+
+			rootBytes, err := me.Send__RootRequest__ctx(ctx, destAddr)
+			if err != nil {
+				stop()
+				fmt.Printf("Impossible de récupérer la racine de %s : %v\n", destAddr, err)
+				continue
+			}
+
+			var rootHash [32]byte
+			copy(rootHash[:], rootBytes)
+
+			peerName := skeleton__name(args[0], destAddr, me)
+			result, err := me.Download_skeleton__ctx(ctx, destAddr, peerName, rootHash, includeBig)
+			stop()
+
+			print__download__result(result)
+			if err != nil {
+				fmt.Printf("erreur écriture du squelette : %v\n", err)
+			}
+			p2p.LogMsg("squelette de %s récupéré, 'print -o %s' pour l'afficher hors ligne\n", peerName, peerName)
+			continue
+
+		case "ls":
+			if len(args) < 1 {
+				fmt.Println("usage: ls <nom> [chemin ou motif ...]")
+				continue
+			}
+
+			// hors ligne : on cherche dans le squelette gardé
+			rootHash, err := me.Skeleton__root(args[0])
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+
+			// par défaut, le contenu de la racine
+			patterns := args[1:]
+			if len(patterns) == 0 {
+				patterns = []string{"*"}
+			}
+
+			entries, err := me.Resolve__patterns(context.Background(), "", rootHash, patterns)
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+			if len(entries) == 0 {
+				fmt.Println("aucun fichier ne correspond")
+			}
+			for _, entry := range entries {
+				if entry.IsDir {
+					fmt.Printf(" - %s/\n", entry.Path)
+				} else {
+					fmt.Printf(" - %s\n", entry.Path)
+				}
+			}
+			continue
+
+		case "diff":
+			if len(args) < 1 {
+				fmt.Println("usage: diff <nom> [autre nom]")
+				continue
+			}
+
+			// hors ligne : 'diff <nom>' compare notre arbre au squelette du pair, 'diff <a> <b>' le squelette de a à celui de b
+			oldRoot := me.RootHash
+			if len(args) > 1 {
+				oldRoot, err = me.Skeleton__root(args[0])
+			} else if oldRoot == [32]byte{} {
+				err = fmt.Errorf("aucun dossier chargé, utiliser 'load' ou comparer deux pairs")
+			}
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+
+			newRoot, err := me.Skeleton__root(args[len(args)-1])
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+
+			changes, err := me.Diff__trees(context.Background(), oldRoot, newRoot)
+			if err != nil {
+				fmt.Printf("Erreur : %v\n", err)
+				continue
+			}
+			p2p.Print__tree__changes(changes)
+			continue
+
 		case "print":
 			destAddr := ""
 
+			// -o : on affiche le squelette gardé, sans rien demander au pair (ni à l'annuaire)
+			if len(args) > 0 && args[0] == "-o" {
+				if len(args) < 2 {
+					fmt.Println("usage: print -o <nom>")
+					continue
+				}
+				me.Print__Skeleton__ctx(context.Background(), args[1])
+				continue
+			}
+
 			if len(args) > 0 {
-				destAddr, err = find__addr__from__name(args[0], serverURL)
+				destAddr, err = find__addr__from__name(args[0], me)
 				if err != nil {
 					fmt.Printf("Erreur : %v\n", err)
 					continue
 				}
 			}
 
-			go me.Print__Tree(destAddr)
+			// on annule un éventuel print précédent encore en cours
+			if cancelPrint != nil {
+				cancelPrint()
+			}
+
+			var ctx context.Context
+			ctx, cancelPrint = context.WithCancel(context.Background())
+
+			go me.Print__Tree__ctx(ctx, destAddr)
+			continue
+
+		case "stop":
+			if cancelPrint == nil {
+				fmt.Println("aucun affichage en cours")
+				continue
+			}
+			cancelPrint()
+			cancelPrint = nil
 			continue
 
 		case "exit":
@@ -452,22 +842,65 @@ func main() {
 func printHelp() {
 	fmt.Println("\nCOMMANDES DISPONIBLES:")
 	fmt.Println(" info                  						: mes informations")
-	fmt.Println(" register              						: enregistrement (HTTP) auprès du serveur")
-	fmt.Println(" active                						: lister les pairs actifs")
-	fmt.Println(" peers                 						: liste les pairs reconnus par le serveur")
-	fmt.Println(" key <nom ou addr>             				: obtenir la clef d'un peer")
+	fmt.Println(" register              						: enregistrement (HTTP) auprès des serveurs")
+	fmt.Println(" servers               						: liste les serveurs d'annuaire (adresse UDP, session)")
+	fmt.Println(" active                						: lister les pairs actifs (et l'état de leur chiffrement)")
+	fmt.Println(" policy [nom ou clef] [require|prefer|off|default]	: politique de chiffrement (globale, ou pour un pair)")
+	fmt.Println(" peers                 						: liste les pairs reconnus par les serveurs")
+	fmt.Println(" key <nom> [autres noms...]    				: obtenir la clef d'un ou plusieurs peers")
 	fmt.Println(" addr <nom ou addr>            				: obtenir les adresses IP d'un peer")
+	fmt.Println(" known                 						: liste les clefs retenues au premier contact avec chaque pair")
+	fmt.Println(" trust <nom>                   				: retient la clef actuelle d'un pair (après un changement de clef)")
+	fmt.Println(" forget <nom>                  				: oublie la clef retenue d'un pair")
 	fmt.Println(" load <path>           						: charge un fichier local dans le peer (pour le proposer aux autres peers)")
 	fmt.Println(" hello <nom ou addr>          					: envoyer un hello")
 	fmt.Println(" ping <nom ou addr>           					: envoyer un ping")
-	fmt.Println(" download <nom ou addr> [file]					: télécharger les données d'un peer (default = whole tree)")
-	fmt.Println(" print [nom ou addr] 							: affiche l'arbre d'un pair (default: local)")
+	fmt.Println(" download <nom ou addr> [-y] [-p path] [path ...]	: télécharger les données d'un peer (default = whole tree, CTRL+C pour annuler)")
+	fmt.Println("                       						  les chemins acceptent des motifs (ex: photos/**/*.jpg), -y évite la confirmation")
+	fmt.Println("                       						  -p récupère d'abord ce chemin (ou motif)")
+	fmt.Println("                       						  -s écrit les fichiers pendant le téléchargement (pour les gros téléchargements)")
+	fmt.Println("                       						  -o cherche les motifs dans le squelette gardé (sans RootRequest)")
+	fmt.Println(" skeleton <nom ou addr> [-big]					: télécharge seulement les dossiers d'un pair (gardés pour l'explorer hors ligne)")
+	fmt.Println("                       						  coût : chaque fichier est reçu une fois pour connaître son type (un petit fichier")
+	fmt.Println("                       						  en entier, le haut d'un gros), jusqu'à 1 Ko par fichier ; seul le type est gardé")
+	fmt.Println(" print [-o] [nom ou addr] 						: affiche l'arbre d'un pair (default: local, -o: squelette hors ligne)")
+	fmt.Println(" ls <nom> [chemin ou motif ...]				: liste hors ligne le squelette d'un pair (default: sa racine)")
+	fmt.Println(" diff <nom> [autre nom]						: compare hors ligne le squelette d'un pair à notre arbre (ou à un autre squelette)")
+	fmt.Println(" stop                  						: interrompt le print en cours")
 	fmt.Println(" nattraversal <nom ou addr> [intermediaire]  	: demander à un intermediaire d'aider (default = server)")
 	fmt.Println(" exit                  						: quitter")
 }
 
+// affiche le bilan d'un téléchargement (et la liste des noeuds manquants s'il y en a)
+func print__download__result(result *p2p.DownloadResult) {
+
+	p2p.LogMsg("%d noeud(s) reçu(s) (%d octets), %d déjà présent(s), en %v\n",
+		result.Fetched, result.Bytes, result.Cached, result.Elapsed.Round(time.Millisecond))
+
+	if result.Complete() {
+		return
+	}
+
+	fmt.Printf("%d noeud(s) manquant(s) :\n", len(result.Missing))
+
+	// on n'affiche pas tout si la liste est trop longue
+	maxShown := 20
+	for i, missing := range result.Missing {
+		if i == maxShown {
+			fmt.Printf(" ... et %d autre(s)\n", len(result.Missing)-maxShown)
+			break
+		}
+
+		path := missing.Path
+		if path == "" {
+			path = "/"
+		}
+		fmt.Printf(" - %s (%x) : %v\n", path, missing.Hash[:4], missing.Reason)
+	}
+}
+
 // fonction qui transforme un nom en adresse (ou adresse en adresse)
-func find__addr__from__name(input string, serverURL string) (string, error) {
+func find__addr__from__name(input string, me *p2p.Me) (string, error) {
 
 	// si l'entree contient ":" c'est une adresse (on le suppose)
 	if strings.Contains(input, ":") {
@@ -475,21 +908,126 @@ func find__addr__from__name(input string, serverURL string) (string, error) {
 	}
 
 	// on suppose alors que c'est un nom
-	addrs, err := client.Get__peer__adresses(serverURL, input)
+	addrs, err := find__addrs__from__name(input, me)
 	if err != nil {
 		return "", fmt.Errorf("impossible de trouver lee peer '%s' : %v", input, err)
 	}
-	if len(addrs) == 0 {
-		return "", fmt.Errorf("aucune adresse trouvée pour le peer '%s'", input)
+
+	// on préfère une ipv4, sinon on renvoie ce qu'on trouve (càd une ipv6)
+	return p2p.Preferred__address(addrs), nil
+}
+
+// nom sous lequel on range le squelette d'un pair : le nom tapé, ou pour une adresse le nom annoncé dans son Hello
+func skeleton__name(input string, destAddr string, me *p2p.Me) string {
+	if strings.Contains(input, ":") {
+		if name := me.Session__name(destAddr); name != "" {
+			return name
+		}
 	}
+	return input
+}
+
+// demande les adresses d'un pair à chaque serveur, dans l'ordre, jusqu'à en trouver
+// (les réponses sont gardées un moment dans me.Directory)
+func find__addrs__from__name(name string, me *p2p.Me) ([]string, error) {
 
-	for _, addr := range addrs {
-		// lees addr ipv4 n'ont qu'1 seeul ':'
-		if strings.Count(addr, ":") == 1 {
-			return addr, nil
+	ctx, cancel := directory__context()
+	defer cancel()
+
+	err := fmt.Errorf("aucun serveur configuré")
+	for _, server := range me.Servers() {
+		if server.Client == nil {
+			continue
 		}
+		var addrs []string
+		addrs, err = me.Directory.Get__peer__adresses(ctx, server.Client, name)
+		if err == nil && len(addrs) > 0 {
+			return addrs, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("aucune adresse trouvée pour le peer '%s'", name)
+		}
+	}
+	return nil, err
+}
+
+// demande la clef publique d'un pair à chaque serveur, dans l'ordre
+// (les réponses sont gardées un moment dans me.Directory)
+func find__key__from__name(name string, me *p2p.Me) ([]byte, error) {
+
+	ctx, cancel := directory__context()
+	defer cancel()
+
+	err := fmt.Errorf("aucun serveur configuré")
+	for _, server := range me.Servers() {
+		if server.Client == nil {
+			continue
+		}
+		var key []byte
+		key, err = me.Directory.Get__publicKey(ctx, server.Client, name)
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// le contexte d'une commande qui interroge l'annuaire : abandonnée après directoryTimeout, ou par Ctrl-C
+func directory__context() (context.Context, context.CancelFunc) {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := context.WithTimeout(ctx, directoryTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// affiche nos serveurs d'annuaire : URL, adresse UDP et session
+func print__servers(me *p2p.Me) {
+
+	servers := me.Servers()
+	if len(servers) == 0 {
+		fmt.Println("aucun serveur configuré")
+		return
+	}
+
+	for i, server := range servers {
+		primary := ""
+		if i == 0 {
+			primary = " (principal)"
+		}
+		fmt.Printf("- %s%s\n", server.Name, primary)
+		if server.URL != "" {
+			fmt.Printf("    URL : %s\n", server.URL)
+		}
+
+		udpAddr, err := server.UDP__addr()
+		if err != nil {
+			fmt.Printf("    UDP : %v\n", err)
+			continue
+		}
+		status := "pas de session (faire 'hello " + udpAddr + "')"
+		if me.Has__session(udpAddr) {
+			status = "session active"
+		}
+		fmt.Printf("    UDP : %s, %s\n", udpAddr, status)
+	}
+}
+
+// affiche la politique de chiffrement globale et celles propres à un pair
+func print__policies(me *p2p.Me) {
+
+	fmt.Printf("politique de chiffrement : %s\n", me.Default__encryption())
+
+	policies := me.Encryption__policies()
+	peers := make([]string, 0, len(policies))
+	for peer := range policies {
+		peers = append(peers, peer)
 	}
+	sort.Strings(peers)
 
-	// sinon on renvoie ce qu'on trouve (càd une ipv6)
-	return addrs[0], nil
+	for _, peer := range peers {
+		fmt.Printf("- %s : %s\n", peer, policies[peer])
+	}
 }
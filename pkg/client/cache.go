@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ANNUAIRE AVEC CACHE
+//
+// Chaque Hello reçu demande la clef de l'émetteur à l'annuaire, et chaque commande qui prend un nom demande ses
+// adresses : sans cache, ce sont autant de requêtes HTTPS. Le Cache garde les réponses :
+//   - les clefs pendant KeyTTL, les adresses (qui changent plus souvent) pendant AddressTTL
+//   - un pair inconnu de l'annuaire (404) pendant NegativeTTL seulement : il peut s'enregistrer entre temps
+//   - les autres erreurs (réseau, serveur) ne sont pas gardées
+//
+// Deux demandes simultanées pour le même pair partagent la même requête HTTP. Elle ne dépend d'aucun des appelants
+// (sharedFetchTimeout au plus) : chacun n'abandonne que si son propre contexte l'est.
+// Quand une signature ne se vérifie pas avec la clef gardée (le pair en a peut-être changé), on l'oublie avec Invalidate
+
+// durées de vie par défaut des réponses gardées
+const (
+	DefaultKeyTTL      = 10 * time.Minute
+	DefaultAddressTTL  = time.Minute
+	DefaultNegativeTTL = 10 * time.Second
+)
+
+// nombre maximum de requêtes simultanées pour Lookup__keys
+const maxConcurrentLookups = 8
+
+// temps laissé à une requête partagée (nouvelles tentatives comprises), quels que soient ses appelants
+const sharedFetchTimeout = 30 * time.Second
+
+// une réponse de l'annuaire, par (serveur, pair)
+type cache__key struct {
+	server string
+	name   string
+}
+
+// une réponse gardée, ou en cours (done est fermé quand elle arrive)
+type cache__entry struct {
+	done    chan struct{}
+	value   []string
+	err     error
+	expires time.Time
+}
+
+// le résultat de la recherche de la clef d'un pair (voir Lookup__keys)
+type KeyResult struct {
+	Key []byte
+	Err error
+}
+
+// les réponses de l'annuaire gardées (clefs et adresses des pairs)
+type Cache struct {
+	// durées de vie des clefs, des adresses et des réponses 404 (à régler avant le premier appel)
+	KeyTTL      time.Duration
+	AddressTTL  time.Duration
+	NegativeTTL time.Duration
+
+	keys      map[cache__key]*cache__entry
+	addresses map[cache__key]*cache__entry
+	lock      sync.Mutex
+}
+
+// crée un cache vide, avec les durées de vie par défaut
+func New__cache() *Cache {
+	return &Cache{
+		KeyTTL:      DefaultKeyTTL,
+		AddressTTL:  DefaultAddressTTL,
+		NegativeTTL: DefaultNegativeTTL,
+		keys:        make(map[cache__key]*cache__entry),
+		addresses:   make(map[cache__key]*cache__entry),
+	}
+}
+
+// comme Client.Get__publicKey, mais en gardant la réponse
+func (c *Cache) Get__publicKey(ctx context.Context, server *Client, peerName string) ([]byte, error) {
+
+	value, err := c.get(ctx, c.keys, c.KeyTTL, server.BaseURL, peerName, func(fetchCtx context.Context) ([]string, error) {
+		key, err := server.Get__publicKey(fetchCtx, peerName)
+		return []string{string(key)}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value[0]), nil
+}
+
+// comme Client.Get__peer__adresses, mais en gardant la réponse
+func (c *Cache) Get__peer__adresses(ctx context.Context, server *Client, peerName string) ([]string, error) {
+	return c.get(ctx, c.addresses, c.AddressTTL, server.BaseURL, peerName, func(fetchCtx context.Context) ([]string, error) {
+		return server.Get__peer__adresses(fetchCtx, peerName)
+	})
+}
+
+// cherche les clefs de plusieurs pairs en parallèle (au plus maxConcurrentLookups requêtes à la fois)
+func (c *Cache) Lookup__keys(ctx context.Context, server *Client, names []string) map[string]KeyResult {
+
+	results := make(map[string]KeyResult, len(names))
+	var resultsLock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentLookups)
+
+	// un nom en double n'est cherché qu'une fois
+	unique := make(map[string]bool, len(names))
+	for _, name := range names {
+		if unique[name] {
+			continue
+		}
+		unique[name] = true
+
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			key, err := c.Get__publicKey(ctx, server, name)
+
+			resultsLock.Lock()
+			results[name] = KeyResult{Key: key, Err: err}
+			resultsLock.Unlock()
+		}(name)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// oublie tout ce qu'on sait d'un pair (clef et adresses, sur tous les serveurs)
+func (c *Cache) Invalidate(peerName string) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, entries := range []map[cache__key]*cache__entry{c.keys, c.addresses} {
+		for key := range entries {
+			if key.name == peerName {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// renvoie la réponse gardée, ou la demande à l'annuaire avec fetch (une seule fois pour des appels simultanés)
+func (c *Cache) get(ctx context.Context, entries map[cache__key]*cache__entry, ttl time.Duration, serverURL string, peerName string, fetch func(context.Context) ([]string, error)) ([]string, error) {
+
+	key := cache__key{server: serverURL, name: peerName}
+
+	c.lock.Lock()
+	entry, exists := entries[key]
+	if exists {
+		select {
+		case <-entry.done:
+			// réponse arrivée : encore valide ? (sinon on la redemande)
+			if time.Now().Before(entry.expires) {
+				c.lock.Unlock()
+				return copy__value(entry.value), entry.err
+			}
+			exists = false
+		default:
+			// requête en cours : on se joint à elle
+		}
+	}
+	if !exists {
+		entry = &cache__entry{done: make(chan struct{})}
+		entries[key] = entry
+		go c.fetch(ctx, entries, key, entry, ttl, fetch)
+	}
+	c.lock.Unlock()
+
+	// on attend la réponse, ou que notre appelant abandonne (la requête continue pour les autres)
+	select {
+	case <-entry.done:
+		return copy__value(entry.value), entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fait la requête partagée et range sa réponse. Elle garde les valeurs du contexte de l'appelant qui l'a lancée,
+// mais pas son annulation : les autres appelants attendent peut-être encore
+func (c *Cache) fetch(ctx context.Context, entries map[cache__key]*cache__entry, key cache__key, entry *cache__entry, ttl time.Duration, fetch func(context.Context) ([]string, error)) {
+
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedFetchTimeout)
+	defer cancel()
+
+	value, err := fetch(fetchCtx)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry.value, entry.err = value, err
+	switch {
+	case err == nil:
+		entry.expires = time.Now().Add(ttl)
+	case errors.Is(err, ErrNotFound):
+		entry.expires = time.Now().Add(c.NegativeTTL)
+	default:
+		// erreur réseau ou serveur : la prochaine demande réessaiera
+		if entries[key] == entry {
+			delete(entries, key)
+		}
+	}
+	close(entry.done)
+}
+
+// les appelants peuvent modifier ce qu'on leur renvoie : on garde notre copie
+func copy__value(value []string) []string {
+	if value == nil {
+		return nil
+	}
+	return append([]string(nil), value...)
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// un annuaire de test : alice et bob existent, ghost non, broken répond 500 ; slow attend release
+type test__directory struct {
+	client  *Client
+	release chan struct{}
+
+	lock     sync.Mutex
+	requests map[string]int
+}
+
+func new__test__directory(t *testing.T) *test__directory {
+	t.Helper()
+
+	d := &test__directory{release: make(chan struct{}), requests: make(map[string]int)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.lock.Lock()
+		d.requests[r.URL.Path]++
+		d.lock.Unlock()
+
+		name := strings.Split(strings.TrimPrefix(r.URL.Path, "/peers/"), "/")[0]
+		switch name {
+		case "ghost":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "slow":
+			<-d.release
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/addresses") {
+			w.Write([]byte("10.0.0.1:8000\n10.0.0.2:8000"))
+			return
+		}
+		w.Write(bytes.Repeat([]byte{name[0]}, 64))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-d.release:
+		default:
+			close(d.release)
+		}
+	})
+
+	d.client = New__client(server.URL)
+	d.client.HTTP = server.Client()
+	d.client.Retries = 0
+	return d
+}
+
+// nombre de requêtes reçues pour ce chemin
+func (d *test__directory) count(path string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.requests[path]
+}
+
+func TestCacheTTL(t *testing.T) {
+	d := new__test__directory(t)
+	cache := New__cache()
+	cache.KeyTTL = 50 * time.Millisecond
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		key, err := cache.Get__publicKey(ctx, d.client, "alice")
+		if err != nil || len(key) != 64 || key[0] != 'a' {
+			t.Fatalf("clef %x, %v", key, err)
+		}
+	}
+	if n := d.count("/peers/alice/key"); n != 1 {
+		t.Fatalf("%d requêtes avant expiration, attendu 1", n)
+	}
+
+	// expirée : on la redemande
+	time.Sleep(60 * time.Millisecond)
+	if _, err := cache.Get__publicKey(ctx, d.client, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.count("/peers/alice/key"); n != 2 {
+		t.Fatalf("%d requêtes après expiration, attendu 2", n)
+	}
+
+	// les adresses ont leur propre durée de vie et leur propre entrée
+	for i := 0; i < 2; i++ {
+		addresses, err := cache.Get__peer__adresses(ctx, d.client, "alice")
+		if err != nil || len(addresses) != 2 {
+			t.Fatalf("adresses %v, %v", addresses, err)
+		}
+		// on peut modifier ce qu'on reçoit sans toucher au cache
+		addresses[0] = "modifiée"
+	}
+	if addresses, _ := cache.Get__peer__adresses(ctx, d.client, "alice"); addresses[0] != "10.0.0.1:8000" {
+		t.Fatalf("adresse gardée modifiée par un appelant : %v", addresses)
+	}
+	if n := d.count("/peers/alice/addresses"); n != 1 {
+		t.Fatalf("%d requêtes d'adresses, attendu 1", n)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	d := new__test__directory(t)
+	cache := New__cache()
+	cache.NegativeTTL = 50 * time.Millisecond
+	ctx := context.Background()
+
+	// un pair inconnu est gardé NegativeTTL (pas KeyTTL)
+	for i := 0; i < 3; i++ {
+		if _, err := cache.Get__publicKey(ctx, d.client, "ghost"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("erreur %v, attendu ErrNotFound", err)
+		}
+	}
+	if n := d.count("/peers/ghost/key"); n != 1 {
+		t.Fatalf("%d requêtes pour un pair inconnu, attendu 1", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	cache.Get__publicKey(ctx, d.client, "ghost")
+	if n := d.count("/peers/ghost/key"); n != 2 {
+		t.Fatalf("%d requêtes après NegativeTTL, attendu 2", n)
+	}
+
+	// une erreur du serveur n'est pas gardée
+	for i := 0; i < 3; i++ {
+		var serverErr *ServerError
+		if _, err := cache.Get__publicKey(ctx, d.client, "broken"); !errors.As(err, &serverErr) {
+			t.Fatalf("erreur %v, attendu *ServerError", err)
+		}
+	}
+	if n := d.count("/peers/broken/key"); n != 3 {
+		t.Fatalf("%d requêtes pour un serveur en erreur, attendu 3", n)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	d := new__test__directory(t)
+	cache := New__cache()
+	ctx := context.Background()
+
+	for _, name := range []string{"alice", "bob"} {
+		cache.Get__publicKey(ctx, d.client, name)
+		cache.Get__peer__adresses(ctx, d.client, name)
+	}
+
+	// on oublie tout d'alice (clef et adresses), rien de bob
+	cache.Invalidate("alice")
+
+	for _, name := range []string{"alice", "bob"} {
+		cache.Get__publicKey(ctx, d.client, name)
+		cache.Get__peer__adresses(ctx, d.client, name)
+	}
+
+	expected := map[string]int{
+		"/peers/alice/key":       2,
+		"/peers/alice/addresses": 2,
+		"/peers/bob/key":         1,
+		"/peers/bob/addresses":   1,
+	}
+	for path, n := range expected {
+		if got := d.count(path); got != n {
+			t.Errorf("%s : %d requêtes, attendu %d", path, got, n)
+		}
+	}
+}
+
+func TestCacheSharedFetch(t *testing.T) {
+	d := new__test__directory(t)
+	cache := New__cache()
+
+	// le premier appelant lance la requête puis abandonne
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := cache.Get__publicKey(firstCtx, d.client, "slow")
+		firstDone <- err
+	}()
+
+	// on attend que la requête soit partie
+	deadline := time.Now().Add(5 * time.Second)
+	for d.count("/peers/slow/key") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("requête jamais reçue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// d'autres appelants se joignent à elle
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if key, err := cache.Get__publicKey(context.Background(), d.client, "slow"); err != nil || len(key) != 64 {
+				failures.Add(1)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// l'abandon du premier ne touche que lui
+	cancelFirst()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("premier appelant : %v, attendu context.Canceled", err)
+	}
+
+	close(d.release)
+	wg.Wait()
+
+	if n := failures.Load(); n != 0 {
+		t.Fatalf("%d appelant(s) en échec après l'abandon du premier", n)
+	}
+	if n := d.count("/peers/slow/key"); n != 1 {
+		t.Fatalf("%d requêtes, attendu 1 (partagée)", n)
+	}
+}
+
+func TestLookupKeys(t *testing.T) {
+	d := new__test__directory(t)
+	cache := New__cache()
+
+	results := cache.Lookup__keys(context.Background(), d.client, []string{"alice", "bob", "ghost", "alice"})
+
+	if len(results) != 3 {
+		t.Fatalf("%d résultats, attendu 3", len(results))
+	}
+	if r := results["alice"]; r.Err != nil || r.Key[0] != 'a' {
+		t.Errorf("alice : %x, %v", r.Key, r.Err)
+	}
+	if r := results["bob"]; r.Err != nil || r.Key[0] != 'b' {
+		t.Errorf("bob : %x, %v", r.Key, r.Err)
+	}
+	if r := results["ghost"]; !errors.Is(r.Err, ErrNotFound) {
+		t.Errorf("ghost : %v, attendu ErrNotFound", r.Err)
+	}
+	if n := d.count("/peers/alice/key"); n != 1 {
+		t.Errorf("alice demandée %d fois, attendu 1", n)
+	}
+}
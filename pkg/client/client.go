@@ -2,126 +2,256 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 )
 
-// fonction pour s'enregistrer auprès du serveur
-func Register(serverURL string, name string, key []byte) error {
+// CLIENT HTTP DE L'ANNUAIRE
+//
+// Un serveur qui ne répond pas ne doit bloquer ni le terminal ni la réception des messages (Handle__hellos demande
+// des clefs à l'annuaire) : chaque requête a un délai (celui du http.Client et/ou le contexte de l'appel), et on
+// réessaie quelques fois, en attendant de plus en plus, quand le serveur est injoignable ou répond une erreur 5xx.
+// Les erreurs se testent avec errors.Is / errors.As : ErrNotFound (404), *ServerError (autre code), ErrMalformedKey
 
-	// on construit l'URL à laquelle on enverra la requête
-	url := fmt.Sprintf("%s/peers/%s/key", serverURL, name)
+// réglages par défaut
+const (
+	// délai maximum d'une requête HTTP (connexion, envoi et lecture de la réponse)
+	DefaultTimeout = 10 * time.Second
+	// nombre de nouvelles tentatives après un premier échec
+	DefaultRetries = 2
+	// attente avant la première nouvelle tentative (doublée à chaque fois)
+	DefaultBackoff = 200 * time.Millisecond
+)
 
-	// on prépare la requête PUT
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(key))
-	if err != nil {
-		return err
-	}
+// taille maximum d'une réponse du serveur
+const maxResponseSize = 1 << 20
 
-	// on crée un client http (connexion TCP), on va surement continuer à communiquer avec le serveur donc mieux vaut n'avoir qu'une connexion
-	client := &http.Client{}
+// en-tête d'un PUT qui remplace une clef déjà enregistrée : signature, par l'ancienne clef, de Key__change__data
+// (sans elle, l'annuaire refuse le changement : 409)
+const KeyChangeSignatureHeader = "X-Key-Change-Signature"
 
-	// on execute la requête
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// le serveur ne connaît pas ce pair (réponse 404), testable avec errors.Is
+var ErrNotFound = errors.New("pair inconnu de l'annuaire")
 
-	// on vérifie que la reponse est bien 204 : StatusNoContent (et pourquoi pas 200 : StatusOK)
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("impossible de s'enregister, erreur serveur: code %d", resp.StatusCode)
-	}
+// le serveur a renvoyé une clef qui n'en est pas une (pas 64 octets)
+var ErrMalformedKey = errors.New("clef reçue non valide")
 
-	return nil
+// le serveur a répondu un code inattendu (autre que 404)
+type ServerError struct {
+	Code int
 }
 
-// fonction pour obtenir une liste de 200 peers auprès du serveur
-func Get__peer__list(serverURL string) ([]string, error) {
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("erreur serveur: code %d", e.Code)
+}
 
-	// on construit l'URL à laquelle on enverra la requête
-	url := fmt.Sprintf("%s/peers/", serverURL)
+// faut-il réessayer ? (erreur du serveur lui-même, ou trop de requêtes)
+func (e *ServerError) temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
 
-	// on execute la requête
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
+// un client pour l'API HTTP d'un serveur d'annuaire
+type Client struct {
+	// URL de l'API (ex: https://jch.irif.fr:8443)
+	BaseURL string
+	// le client HTTP utilisé (une seule connexion TCP réutilisée, délai maximum par requête)
+	HTTP *http.Client
+	// nombre de nouvelles tentatives, et attente avant la première (doublée à chaque fois)
+	Retries int
+	Backoff time.Duration
+}
+
+// partagé par tous les clients créés par New__client : on garde les connexions ouvertes d'un appel à l'autre
+var defaultHTTPClient = &http.Client{Timeout: DefaultTimeout}
+
+// crée un client pour un serveur, avec les réglages par défaut
+func New__client(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    defaultHTTPClient,
+		Retries: DefaultRetries,
+		Backoff: DefaultBackoff,
 	}
-	defer resp.Body.Close()
+}
 
-	// on lit toute la réponse
-	body, err := io.ReadAll(resp.Body)
+// fonction pour s'enregistrer auprès du serveur
+func (c *Client) Register(ctx context.Context, name string, key []byte) error {
+
+	// on vérifie que la reponse est bien 204 : StatusNoContent
+	_, err := c.do(ctx, http.MethodPut, "/peers/"+name+"/key", key, nil, http.StatusNoContent)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("impossible de s'enregister : %w", err)
 	}
+	return nil
+}
 
-	// le serveur renvoie une liste de peers avec 1 peer par ligne, on découpe donc le body à chaque "\n" et on met le tout dans une liste
-	list := strings.Split(string(body), "\n")
+// remplace notre clef enregistrée par newKey ; signature est la signature de Key__change__data(name, newKey)
+// par l'ancienne clef (preuve que c'est bien nous)
+func (c *Client) Change__key(ctx context.Context, name string, newKey []byte, signature []byte) error {
 
-	// on envoie la dite liste
-	return list, nil
+	header := http.Header{}
+	header.Set(KeyChangeSignatureHeader, hex.EncodeToString(signature))
+
+	_, err := c.do(ctx, http.MethodPut, "/peers/"+name+"/key", newKey, header, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("impossible de changer de clef : %w", err)
+	}
+	return nil
 }
 
-// focntion pour obtenir la clef privée d'un certain peer (paramètre peerName)
-func Get__publicKey(serverURL string, peerName string) ([]byte, error) {
+// ce que l'ancienne clef signe pour autoriser un changement de clef : le nom, puis la nouvelle clef
+func Key__change__data(name string, newKey []byte) []byte {
+	return append([]byte(name+"\n"), newKey...)
+}
 
-	// on construit l'URL
-	url := fmt.Sprintf("%s/peers/%s/key", serverURL, peerName)
+// fonction pour obtenir une liste de 200 peers auprès du serveur
+func (c *Client) Get__peer__list(ctx context.Context) ([]string, error) {
 
-	// on execute la requête
-	resp, err := http.Get(url)
+	body, err := c.do(ctx, http.MethodGet, "/peers/", nil, nil, http.StatusOK)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// on vérifie que la réponse du serveur est 200 : StatusOK
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("impossible de trouver la clef de %s : code %d", peerName, resp.StatusCode)
-	}
+	// le serveur renvoie une liste de peers avec 1 peer par ligne, on découpe donc le body à chaque "\n" et on met le tout dans une liste
+	return strings.Split(string(body), "\n"), nil
+}
 
-	// le body de cette réponse contient la clef publique voulue
-	key, err := io.ReadAll(resp.Body)
+// fonction pour obtenir la clef publique d'un certain peer (paramètre peerName)
+func (c *Client) Get__publicKey(ctx context.Context, peerName string) ([]byte, error) {
+
+	// le body de la réponse contient la clef publique voulue
+	key, err := c.do(ctx, http.MethodGet, "/peers/"+peerName+"/key", nil, nil, http.StatusOK)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("impossible de trouver la clef de %s : %w", peerName, err)
 	}
 
 	// on vérifie la taille
 	if len(key) != 64 {
-		return nil, fmt.Errorf("clef reçue non valide")
+		return nil, fmt.Errorf("clef de %s (%d octets) : %w", peerName, len(key), ErrMalformedKey)
 	}
 
 	return key, nil
 }
 
 // fonction pour obtenir les adresses UDP d'un peer
-func Get__peer__adresses(serverURL string, peerName string) ([]string, error) {
+func (c *Client) Get__peer__adresses(ctx context.Context, peerName string) ([]string, error) {
+
+	// il y a 1 adresse par ligne
+	body, err := c.do(ctx, http.MethodGet, "/peers/"+peerName+"/addresses", nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("impossible de trouver les adresses pour %s : %w", peerName, err)
+	}
+
+	//on découpe le body à chaque "\n" et on met le tout dans une liste
+	return strings.Split(string(body), "\n"), nil
+}
 
-	// on construit l'URL
-	url := fmt.Sprintf("%s/peers/%s/addresses", serverURL, peerName)
+// exécute une requête (en réessayant si besoin) et renvoie le body de la réponse, si son code est celui attendu
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, header http.Header, expected int) ([]byte, error) {
 
-	// on execute la requête
-	resp, err := http.Get(url)
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+
+		response, err := c.do__once(ctx, method, path, body, header, expected)
+		if err == nil || attempt >= c.Retries || !retryable(ctx, err) {
+			return response, err
+		}
+
+		// on attend un peu avant de réessayer (sauf si l'appelant abandonne)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// une seule tentative
+func (c *Client) do__once(ctx context.Context, method string, path string, body []byte, header http.Header, expected int) ([]byte, error) {
+
+	// on prépare la requête (le body est relu à chaque tentative)
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	for name, values := range header {
+		req.Header[name] = values
+	}
 
-	// on vérifie que la réponse est 200: StatusOK
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("impossible de trouver les adresses pour %s", peerName)
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
 	}
 
-	// on lit tout le body, il y a 1 adresse par ligne
-	body, err := io.ReadAll(resp.Body)
+	// on execute la requête
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	//on découpe le body à chaque "\n" et on met le tout dans une liste
-	addresses := strings.Split(string(body), "\n")
+	// on lit toute la réponse
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// (un 404 sur un PUT n'est pas un pair inconnu)
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != expected {
+		return nil, &ServerError{Code: resp.StatusCode}
+	}
 
-	return addresses, nil
+	return response, nil
+}
+
+// réessaie-t-on après cette erreur ? (serveur injoignable ou en erreur, mais pas si l'appelant a abandonné)
+func retryable(ctx context.Context, err error) bool {
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.temporary()
+	}
+
+	// 404 : le pair n'existe pas, inutile de redemander
+	return !errors.Is(err, ErrNotFound)
+}
+
+// FONCTIONS DU PAQUET (un client par défaut pour serverURL, sans contexte)
+
+// fonction pour s'enregistrer auprès du serveur
+func Register(serverURL string, name string, key []byte) error {
+	return New__client(serverURL).Register(context.Background(), name, key)
+}
+
+// fonction pour obtenir une liste de 200 peers auprès du serveur
+func Get__peer__list(serverURL string) ([]string, error) {
+	return New__client(serverURL).Get__peer__list(context.Background())
+}
+
+// focntion pour obtenir la clef publique d'un certain peer (paramètre peerName)
+func Get__publicKey(serverURL string, peerName string) ([]byte, error) {
+	return New__client(serverURL).Get__publicKey(context.Background(), peerName)
+}
+
+// fonction pour obtenir les adresses UDP d'un peer
+func Get__peer__adresses(serverURL string, peerName string) ([]string, error) {
+	return New__client(serverURL).Get__peer__adresses(context.Background(), peerName)
 }
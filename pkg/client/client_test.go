@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// un annuaire qui répond les codes de statuses dans l'ordre (le dernier ensuite), et compte les requêtes
+func status__server(t *testing.T, statuses ...int) (*Client, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+
+		if status == http.StatusOK {
+			w.Write(bytes.Repeat([]byte{1}, 64))
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	c := New__client(server.URL)
+	c.HTTP = server.Client()
+	c.Backoff = time.Millisecond
+	return c, &requests
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		put      bool
+		statuses []int
+		// nombre de requêtes reçues par le serveur
+		requests int32
+		// code de la *ServerError attendue (0 : pas d'erreur, -1 : ErrNotFound)
+		code int
+	}{
+		{name: "succès", statuses: []int{200}, requests: 1},
+		{name: "5xx puis succès", statuses: []int{500, 503, 200}, requests: 3},
+		{name: "429 puis succès", statuses: []int{429, 200}, requests: 2},
+		{name: "5xx jusqu'au bout", statuses: []int{502}, requests: DefaultRetries + 1, code: 502},
+		{name: "404 : pair inconnu, pas de nouvel essai", statuses: []int{404, 200}, requests: 1, code: -1},
+		{name: "4xx : pas de nouvel essai", statuses: []int{400, 200}, requests: 1, code: 400},
+		{name: "403 : pas de nouvel essai", statuses: []int{403, 200}, requests: 1, code: 403},
+		{name: "PUT, 5xx puis succès", put: true, statuses: []int{500, 204}, requests: 2},
+		// un 404 sur un PUT n'est pas un pair inconnu
+		{name: "PUT, 404", put: true, statuses: []int{404, 204}, requests: 1, code: 404},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, requests := status__server(t, test.statuses...)
+
+			var err error
+			if test.put {
+				err = c.Register(context.Background(), "alice", bytes.Repeat([]byte{1}, 64))
+			} else {
+				_, err = c.Get__publicKey(context.Background(), "alice")
+			}
+
+			if n := requests.Load(); n != test.requests {
+				t.Errorf("%d requête(s), attendu %d", n, test.requests)
+			}
+
+			var serverErr *ServerError
+			switch {
+			case test.code == 0 && err != nil:
+				t.Errorf("erreur %v, attendu aucune", err)
+			case test.code == -1 && !errors.Is(err, ErrNotFound):
+				t.Errorf("erreur %v, attendu ErrNotFound", err)
+			case test.code > 0 && (!errors.As(err, &serverErr) || serverErr.Code != test.code):
+				t.Errorf("erreur %v, attendu le code %d", err, test.code)
+			case test.code > 0 && errors.Is(err, ErrNotFound):
+				t.Errorf("erreur %v : ErrNotFound seulement pour un GET", err)
+			}
+		})
+	}
+}
+
+func TestBackoffStopsOnCancel(t *testing.T) {
+	c, requests := status__server(t, 500)
+	// sans annulation, on attendrait une heure avant de réessayer
+	c.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.Get__publicKey(ctx, "alice")
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("erreur %v, attendu context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("abandon après %v", elapsed)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("%d requête(s), attendu 1", n)
+	}
+}
+
+func TestNoRetryAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if retryable(ctx, &ServerError{Code: 500}) {
+		t.Fatal("nouvel essai alors que l'appelant a abandonné")
+	}
+	if !retryable(context.Background(), errors.New("connexion refusée")) {
+		t.Fatal("pas de nouvel essai pour un serveur injoignable")
+	}
+}
+
+func TestMalformedKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("trop court"))
+	}))
+	defer server.Close()
+
+	if _, err := New__client(server.URL).Get__publicKey(context.Background(), "alice"); !errors.Is(err, ErrMalformedKey) {
+		t.Fatalf("erreur %v, attendu ErrMalformedKey", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package directory est un serveur d'annuaire qui remplace https://jch.irif.fr:8443 sur un réseau privé
+// (LAN, intégration continue).
+//
+// Côté HTTP il implémente la même API que le serveur du sujet (celle qu'utilise pkg/client) :
+//
+//	GET /peers/                 -> les pairs vus récemment, un nom par ligne
+//	PUT /peers/<nom>/key        -> enregistre la clef publique (64 octets), 204
+//	                               409 si le nom a déjà une autre clef, sauf si l'en-tête X-Key-Change-Signature
+//	                               contient la signature du changement par l'ancienne clef (voir client.Change__key)
+//	GET /peers/<nom>/key        -> la clef publique, 404 si inconnue
+//	GET /peers/<nom>/addresses  -> les adresses UDP observées, une par ligne, 404 si pair inconnu
+//
+// Côté UDP c'est un pair comme les autres (p2p.Me) : il répond aux Hello, note l'adresse d'où vient
+// chaque Hello, et relaie les NatTraversalRequest grâce aux handlers habituels.
+package directory
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"project/pkg/client"
+	"project/pkg/identity"
+	"project/pkg/p2p"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durée pendant laquelle une adresse reste valable sans nouveau Hello (comme l'expiration des sessions)
+const DefaultAddressTTL = 5 * time.Minute
+
+// le nom est déjà enregistré avec une autre clef, et le changement n'est pas signé par celle-ci
+var ErrKeyTaken = errors.New("nom déjà enregistré avec une autre clef")
+
+// un pair connu de l'annuaire
+type entry struct {
+	// clef publique (64 octets)
+	key []byte
+	// adresses observées, et la dernière fois qu'un Hello en est venu
+	addresses map[string]time.Time
+}
+
+// le serveur d'annuaire
+type Server struct {
+	// notre nom (celui de nos Hello, et sous lequel notre clef est publiée)
+	Name string
+	// le pair UDP
+	Me *p2p.Me
+	// durée de vie d'une adresse sans nouveau Hello
+	AddressTTL time.Duration
+
+	lock  sync.Mutex
+	peers map[string]*entry
+}
+
+// crée le serveur sur le transport tr (socket UDP ou réseau en mémoire)
+// publicAddrs sont nos adresses UDP telles que les pairs doivent les voir (publiées sous notre nom)
+func New(name string, priv *ecdsa.PrivateKey, tr p2p.Transport, publicAddrs []string) (*Server, error) {
+
+	pub, err := identity.Extract__PubKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Name:       name,
+		AddressTTL: DefaultAddressTTL,
+		peers:      make(map[string]*entry),
+	}
+
+	// on est notre propre serveur UDP, et on lit les clefs directement dans l'annuaire (pas de requête HTTP)
+	s.Me = p2p.New__communication__on(tr, priv, name, "", tr.LocalAddr().String())
+	s.Me.PublicKeyLookup = s.Key
+	s.Me.OnHello = s.hello__received
+
+	// nos propres informations, sans expiration
+	s.peers[name] = &entry{key: identity.PublicKey__to__bytes(pub), addresses: make(map[string]time.Time)}
+	for _, addr := range publicAddrs {
+		s.peers[name].addresses[addr] = time.Time{}
+	}
+
+	return s, nil
+}
+
+// lance la partie UDP (bloquant, jusqu'à Close)
+func (s *Server) Serve__UDP() {
+	s.Me.Listen__loop()
+}
+
+// arrête la partie UDP
+func (s *Server) Close() error {
+	return s.Me.Close()
+}
+
+// enregistre la clef publique d'un pair. Pour remplacer une autre clef déjà enregistrée, il faut la signature
+// de client.Key__change__data(name, key) par l'ancienne clef (sinon n'importe qui prendrait ce nom : ErrKeyTaken)
+func (s *Server) Register(name string, key []byte, signature []byte) error {
+
+	if len(key) != 64 {
+		return fmt.Errorf("clef de %s invalide (%d octets au lieu de 64)", name, len(key))
+	}
+	if name == s.Name {
+		return fmt.Errorf("le nom %s est réservé", name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e := s.get__or__create(name)
+
+	// changement de clef : seul le détenteur de l'ancienne peut l'autoriser
+	if e.key != nil && !bytes.Equal(e.key, key) {
+		oldKey, err := identity.Bytes__to__PublicKey(e.key)
+		if err != nil || len(signature) == 0 || !identity.Verify__signature(oldKey, client.Key__change__data(name, key), signature) {
+			return fmt.Errorf("%s : %w", name, ErrKeyTaken)
+		}
+	}
+
+	e.key = append([]byte(nil), key...)
+	return nil
+}
+
+// renvoie la clef publique d'un pair
+func (s *Server) Key(name string) ([]byte, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, exists := s.peers[name]
+	if !exists || e.key == nil {
+		return nil, fmt.Errorf("impossible de trouver la clef de %s", name)
+	}
+	return e.key, nil
+}
+
+// note une adresse pour un pair (comme si un Hello en était venu)
+func (s *Server) Record__address(name string, addr string) {
+	s.lock.Lock()
+	s.get__or__create(name).addresses[addr] = time.Now()
+	s.lock.Unlock()
+}
+
+// renvoie les adresses encore valables d'un pair (false si pair inconnu)
+func (s *Server) Addresses(name string) ([]string, bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, exists := s.peers[name]
+	if !exists {
+		return nil, false
+	}
+
+	s.expire(e)
+	addresses := make([]string, 0, len(e.addresses))
+	for addr := range e.addresses {
+		addresses = append(addresses, addr)
+	}
+	sort.Strings(addresses)
+	return addresses, true
+}
+
+// renvoie les pairs qui ont au moins une adresse valable
+func (s *Server) Peers() []string {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var names []string
+	for name, e := range s.peers {
+		s.expire(e)
+		if len(e.addresses) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// appelée par le pair UDP à chaque Hello valide : on note l'adresse observée
+func (s *Server) hello__received(name string, addr *net.UDPAddr) {
+	p2p.Verbose_log("annuaire : %s vu à %s", name, addr)
+	s.Record__address(name, addr.String())
+}
+
+// retire les adresses trop vieilles. Le verrou doit être pris
+func (s *Server) expire(e *entry) {
+	for addr, seen := range e.addresses {
+		// les adresses sans date (les nôtres) n'expirent pas
+		if !seen.IsZero() && time.Since(seen) > s.AddressTTL {
+			delete(e.addresses, addr)
+		}
+	}
+}
+
+// renvoie l'entrée d'un pair, en la créant si besoin. Le verrou doit être pris
+func (s *Server) get__or__create(name string) *entry {
+	e, exists := s.peers[name]
+	if !exists {
+		e = &entry{addresses: make(map[string]time.Time)}
+		s.peers[name] = e
+	}
+	return e
+}
+
+// le handler HTTP de l'API /peers/...
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serve__http)
+}
+
+func (s *Server) serve__http(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 0 || parts[0] != "peers" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	// la liste des pairs
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		io.WriteString(w, strings.Join(s.Peers(), "\n"))
+
+	case len(parts) == 3 && parts[2] == "key" && r.Method == http.MethodPut:
+		key, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var signature []byte
+		if header := r.Header.Get(client.KeyChangeSignatureHeader); header != "" {
+			if signature, err = hex.DecodeString(header); err != nil {
+				http.Error(w, "signature invalide", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := s.Register(parts[1], key, signature); err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrKeyTaken) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 3 && parts[2] == "key" && r.Method == http.MethodGet:
+		key, err := s.Key(parts[1])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(key)
+
+	case len(parts) == 3 && parts[2] == "addresses" && r.Method == http.MethodGet:
+		addresses, exists := s.Addresses(parts[1])
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, strings.Join(addresses, "\n"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -1,11 +1,13 @@
 package identity
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
@@ -119,8 +121,8 @@ func Generate_Ephemeral_Key() (*ecdh.PrivateKey, []byte, error) {
 }
 
 // CALCUL DU SECRET PARTAGÉ
-// Prend ma clé privée et la clé publique reçue (en bytes) pour sortir la clé AES (hashée)
-func Compute_Shared_Secret(myPrivKey *ecdh.PrivateKey, receivedPubBytes []byte) ([]byte, error) {
+// Prend ma clé privée et la clé publique reçue (en bytes) pour sortir le secret ECDH (brut, à dériver)
+func ECDH__secret(myPrivKey *ecdh.PrivateKey, receivedPubBytes []byte) ([]byte, error) {
 	// On utilise la courbe X25519 recommandée pour la sécurité par le NIST : RFC 7748
 	curve := ecdh.X25519()
 
@@ -136,16 +138,118 @@ func Compute_Shared_Secret(myPrivKey *ecdh.PrivateKey, receivedPubBytes []byte)
 	if err != nil {
 		return nil, fmt.Errorf("echec calcul ECDH: %v", err)
 	}
+	return secret, nil
+}
+
+// CLÉ UNIQUE (ancien fonctionnement, gardé pour les pairs qui ne connaissent que lui)
+// Prend ma clé privée et la clé publique reçue (en bytes) pour sortir la clé AES (hashée)
+func Compute_Shared_Secret(myPrivKey *ecdh.PrivateKey, receivedPubBytes []byte) ([]byte, error) {
+	secret, err := ECDH__secret(myPrivKey, receivedPubBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	// On hash le secret pour avoir une clé AES propre de 32 octets
 	hash := sha256.Sum256(secret)
 	return hash[:], nil
 }
 
+// DÉRIVATION DES CLÉS DE SESSION (HKDF, RFC 5869)
+//
+// Le secret ECDH seul ne suffit pas : il ne dit rien de qui a fait l'échange, et une seule clé pour les deux sens
+// oblige à des nonces aléatoires (qui peuvent se répéter). On dérive donc deux clés, une par sens, liées à tout
+// l'échange (le "transcript") : les deux clés publiques d'identité et les deux clés éphémères.
+// Les deux pairs trient leurs clés d'identité de la même façon, ils obtiennent donc les mêmes clés (croisées).
+
+// HKDF-Extract : concentre le secret (ikm) en une clé pseudo-aléatoire de 32 octets
+func HKDF__extract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// HKDF-Expand : tire length octets de la clé pseudo-aléatoire prk, pour l'usage décrit par info
+func HKDF__expand(prk []byte, info []byte, length int) []byte {
+
+	var output, previous []byte
+	for counter := byte(1); len(output) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(previous)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		previous = mac.Sum(nil)
+		output = append(output, previous...)
+	}
+	return output[:length]
+}
+
+// les clés d'une session, vues d'un des deux pairs
+type SessionKeys struct {
+	// clés AES (32 octets) pour ce qu'on envoie et ce qu'on reçoit
+	Send []byte
+	Recv []byte
+	// confirmation de clé : ce qu'on envoie pour prouver qu'on a les mêmes clés, et ce que le pair doit nous envoyer
+	SendConfirm []byte
+	RecvConfirm []byte
+}
+
+// dérive nos clés d'envoi et de réception (et de confirmation) à partir du secret ECDH et de l'échange complet
+// myIdentity/peerIdentity : clés publiques de signature (64 octets), myEphemeral/peerEphemeral : clés X25519 (32 octets)
+func Derive__session__keys(secret []byte, myIdentity []byte, peerIdentity []byte, myEphemeral []byte, peerEphemeral []byte) SessionKeys {
+
+	// le pair "bas" est celui dont la clé d'identité est la plus petite : les deux côtés sont d'accord sans se parler
+	iAmLow := bytes.Compare(myIdentity, peerIdentity) < 0
+
+	lowIdentity, highIdentity := peerIdentity, myIdentity
+	lowEphemeral, highEphemeral := peerEphemeral, myEphemeral
+	if iAmLow {
+		lowIdentity, highIdentity = myIdentity, peerIdentity
+		lowEphemeral, highEphemeral = myEphemeral, peerEphemeral
+	}
+
+	transcript := sha256.New()
+	transcript.Write([]byte("projet_internet session v1"))
+	transcript.Write(lowIdentity)
+	transcript.Write(highIdentity)
+	transcript.Write(lowEphemeral)
+	transcript.Write(highEphemeral)
+
+	prk := HKDF__extract(transcript.Sum(nil), secret)
+	lowToHigh := HKDF__expand(prk, []byte("low -> high"), 32)
+	highToLow := HKDF__expand(prk, []byte("high -> low"), 32)
+
+	// chacun prouve qu'il a la clé en envoyant un MAC de son rôle (différent dans les deux sens : pas de simple renvoi)
+	confirmKey := HKDF__expand(prk, []byte("key confirmation"), 32)
+	lowConfirm := hmac.New(sha256.New, confirmKey)
+	lowConfirm.Write([]byte("low"))
+	highConfirm := hmac.New(sha256.New, confirmKey)
+	highConfirm.Write([]byte("high"))
+
+	if iAmLow {
+		return SessionKeys{Send: lowToHigh, Recv: highToLow, SendConfirm: lowConfirm.Sum(nil), RecvConfirm: highConfirm.Sum(nil)}
+	}
+	return SessionKeys{Send: highToLow, Recv: lowToHigh, SendConfirm: highConfirm.Sum(nil), RecvConfirm: lowConfirm.Sum(nil)}
+}
+
+// prépare AES-GCM avec une clé de 32 octets (le nonce est choisi par l'appelant, voir p2p/keys.go)
+func New__AEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // CHIFFREMENT (AES-GCM)
 // AES-GCM est le standard de chiffrement symétrique suggéré par le NIST (cf NIST SP 800-38D, 2007)
 // On utilise donc le pacakge aes fourni par go crypto/aes
 func Encrypt_AES(key []byte, plaintext []byte) ([]byte, error) {
+	return Encrypt_AES__AD(key, plaintext, nil)
+}
+
+// même chose, mais en authentifiant aussi additionalData (qui n'est pas chiffré, ni inclus dans le résultat) :
+// le déchiffrement échoue si on ne lui redonne pas exactement les mêmes octets (ex: l'en-tête du message)
+func Encrypt_AES__AD(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
 	// Création du bloc AES
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -167,13 +271,18 @@ func Encrypt_AES(key []byte, plaintext []byte) ([]byte, error) {
 	// Chiffrement : Le résultat contient [Nonce + Ciphertext + Tag]
 	// rappel de la signature de la fonction : Seal(dst, nonce, plaintext, additionalData)
 	// Cette fonction chiffre le plaintext avec nonce, et l'append à la dst, puis append additionalData.
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, additionalData)
 	return ciphertext, nil
 }
 
 // DECHIFFREMENT (AES-GCM)
 // On suit la logique du chiffrement pour déchiffrer
 func Decrypt_AES(key []byte, ciphertext []byte) ([]byte, error) {
+	return Decrypt_AES__AD(key, ciphertext, nil)
+}
+
+// déchiffre un message chiffré par Encrypt_AES__AD avec les mêmes additionalData
+func Decrypt_AES__AD(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -193,7 +302,7 @@ func Decrypt_AES(key []byte, ciphertext []byte) ([]byte, error) {
 	nonce, actualCiphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
 	// Déchiffrement et vérification du tag d'intégrité
-	plaintext, err := aesGCM.Open(nil, nonce, actualCiphertext, nil)
+	plaintext, err := aesGCM.Open(nil, nonce, actualCiphertext, additionalData)
 	if err != nil {
 		return nil, fmt.Errorf("echec déchiffrement (mauvaise clé ou message altéré): %v", err)
 	}
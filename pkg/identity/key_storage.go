@@ -12,9 +12,14 @@ const my_file = "identity.pem"
 
 // fonction qui sauvegarde notre clef privee dans un fichier local (pour aider à la connexion ultérieurement)
 func Save__Identity(key *ecdsa.PrivateKey) error {
+	return Save__Identity__to(my_file, key)
+}
+
+// meme chose que Save__Identity, dans le fichier de notre choix
+func Save__Identity__to(path string, key *ecdsa.PrivateKey) error {
 
 	// on construit le fichier
-	file, err := os.Create(my_file)
+	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("création fichier impossible: %v", err)
 	}
@@ -37,9 +42,14 @@ func Save__Identity(key *ecdsa.PrivateKey) error {
 
 // fonction "inverse", on lit le contenu du fichier
 func Load_Identity() (*ecdsa.PrivateKey, error) {
+	return Load_Identity__from(my_file)
+}
+
+// meme chose que Load_Identity, depuis le fichier de notre choix
+func Load_Identity__from(path string) (*ecdsa.PrivateKey, error) {
 
 	// on lit le fichier
-	body, err := os.ReadFile(my_file)
+	body, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
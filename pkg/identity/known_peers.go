@@ -0,0 +1,194 @@
+package identity
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PAIRS CONNUS (trust on first use)
+//
+// l'annuaire donne la clef publique d'un pair, mais un annuaire compromis (ou usurpé) pourrait donner la sienne.
+// On retient donc la clef de chaque pair la première fois qu'il nous prouve la posséder (Hello signé), et on
+// compare les fois suivantes : une clef différente est suspecte.
+// Le fichier contient une ligne par pair :
+//
+//	nom empreinte(sha256 de la clef, en hexadécimal) date_du_premier_contact(unix)
+//
+// (le nom est échappé comme dans une URL : un nom annoncé dans un Hello peut contenir des espaces)
+
+const known_peers_file = "known_peers"
+
+// un pair dont on a retenu la clef
+type KnownPeer struct {
+	Name        string
+	Fingerprint string
+	FirstSeen   time.Time
+}
+
+// résultat de la comparaison d'une clef avec celle retenue
+type KeyStatus int
+
+const (
+	// premier contact : la clef vient d'être retenue
+	KeyNew KeyStatus = iota
+	// la clef est celle retenue
+	KeyMatch
+	// la clef n'est PAS celle retenue
+	KeyChanged
+)
+
+// les pairs connus, et le fichier où on les garde
+type KnownPeers struct {
+	path  string
+	peers map[string]KnownPeer
+	lock  sync.Mutex
+}
+
+// l'empreinte d'une clef publique (64 octets) : sha256 en hexadécimal
+func Fingerprint(pubKey []byte) string {
+	sum := sha256.Sum256(pubKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// lit les pairs connus du fichier par défaut
+func Load__known__peers() (*KnownPeers, error) {
+	return Load__known__peers__from(known_peers_file)
+}
+
+// lit les pairs connus d'un fichier (absent : aucun pair connu, il sera créé au premier contact)
+func Load__known__peers__from(path string) (*KnownPeers, error) {
+
+	known := &KnownPeers{path: path, peers: make(map[string]KnownPeer)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d : 'nom empreinte date' attendu", path, lineNum)
+		}
+		if raw, err := hex.DecodeString(fields[1]); err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d : empreinte invalide", path, lineNum)
+		}
+		firstSeen, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d : date invalide", path, lineNum)
+		}
+
+		name, err := url.PathUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d : nom invalide", path, lineNum)
+		}
+
+		known.peers[name] = KnownPeer{Name: name, Fingerprint: fields[1], FirstSeen: time.Unix(firstSeen, 0)}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return known, nil
+}
+
+// compare la clef d'un pair à celle retenue. Au premier contact, on la retient (et on l'écrit dans le fichier)
+// renvoie aussi l'empreinte retenue
+func (k *KnownPeers) Check(name string, pubKey []byte) (KeyStatus, string, error) {
+
+	fingerprint := Fingerprint(pubKey)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if peer, exists := k.peers[name]; exists {
+		if peer.Fingerprint == fingerprint {
+			return KeyMatch, peer.Fingerprint, nil
+		}
+		return KeyChanged, peer.Fingerprint, nil
+	}
+
+	k.peers[name] = KnownPeer{Name: name, Fingerprint: fingerprint, FirstSeen: time.Now()}
+	return KeyNew, fingerprint, k.save()
+}
+
+// retient cette clef pour ce pair, à la place de l'ancienne (l'user lui fait confiance)
+func (k *KnownPeers) Trust(name string, pubKey []byte) error {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.peers[name] = KnownPeer{Name: name, Fingerprint: Fingerprint(pubKey), FirstSeen: time.Now()}
+	return k.save()
+}
+
+// oublie la clef de ce pair (elle sera retenue à nouveau au prochain contact). Renvoie false s'il était inconnu
+func (k *KnownPeers) Forget(name string) (bool, error) {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, exists := k.peers[name]; !exists {
+		return false, nil
+	}
+	delete(k.peers, name)
+	return true, k.save()
+}
+
+// les pairs connus, par nom
+func (k *KnownPeers) List() []KnownPeer {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	list := make([]KnownPeer, 0, len(k.peers))
+	for _, peer := range k.peers {
+		list = append(list, peer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// réécrit le fichier (dans un fichier temporaire d'abord : un arrêt brutal ne le laisse pas à moitié écrit)
+// le verrou k.lock doit être pris
+func (k *KnownPeers) save() error {
+
+	names := make([]string, 0, len(k.peers))
+	for name := range k.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var content strings.Builder
+	content.WriteString("# pairs connus : nom empreinte(sha256 de la clef publique) premier_contact(unix)\n")
+	for _, name := range names {
+		peer := k.peers[name]
+		fmt.Fprintf(&content, "%s %s %d\n", url.PathEscape(peer.Name), peer.Fingerprint, peer.FirstSeen.Unix())
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,332 @@
+// Package memnet simule un réseau UDP en mémoire, pour faire tourner plusieurs pairs dans un même processus
+// (tests, démonstrations) sans ouvrir de vrais sockets.
+// Les connexions implémentent p2p.Transport. On peut simuler des pertes, des délais, des doublons,
+// des paquets dans le désordre et des NAT qui filtrent les paquets entrants.
+package memnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nombre de datagrammes en attente par connexion avant qu'on les jette (comme le buffer d'un socket)
+const inboxSize = 4096
+
+// conditions d'un lien entre deux pairs
+type Conditions struct {
+	// probabilité (entre 0 et 1) qu'un datagramme soit perdu
+	Loss float64
+	// probabilité qu'un datagramme soit livré deux fois
+	Duplicate float64
+	// probabilité qu'un datagramme soit retardé de ReorderDelay en plus (il arrive alors après les suivants)
+	Reorder float64
+	// retard ajouté aux datagrammes désordonnés (par défaut 20ms)
+	ReorderDelay time.Duration
+
+	// délai de base de chaque datagramme
+	Delay time.Duration
+	// variation aléatoire ajoutée au délai (entre 0 et Jitter)
+	Jitter time.Duration
+}
+
+// type de NAT devant une connexion : quels paquets entrants sont acceptés
+type NATKind int
+
+const (
+	// pas de NAT : tout est accepté
+	NoNAT NATKind = iota
+	// on accepte les paquets d'une IP à laquelle on a déjà envoyé quelque chose (peu importe le port)
+	AddressRestricted
+	// on accepte les paquets d'une IP:port à laquelle on a déjà envoyé quelque chose
+	PortRestricted
+)
+
+// statistiques du réseau (pour vérifier ce que les tests ont simulé)
+type Stats struct {
+	Sent       int64
+	Delivered  int64
+	Lost       int64
+	Duplicated int64
+	// paquets bloqués par un NAT
+	Filtered int64
+	// paquets jetés car la file du destinataire était pleine ou le destinataire inconnu
+	Dropped int64
+}
+
+// un lien orienté entre deux adresses
+type link__key struct {
+	from string
+	to   string
+}
+
+// le réseau en mémoire
+type Network struct {
+	lock sync.Mutex
+
+	conns    map[string]*Conn
+	defaults Conditions
+	links    map[link__key]Conditions
+	random   *rand.Rand
+	// perd les datagrammes choisis (voir SetFilter)
+	filter func(from, to string, data []byte) bool
+
+	sent, delivered, lost, duplicated, filtered, dropped atomic.Int64
+}
+
+// perd tous les datagrammes pour lesquels drop renvoie true (nil : aucun), en plus des conditions des liens.
+// Pour perdre un message précis (drop ne doit pas garder data)
+func (n *Network) SetFilter(drop func(from, to string, data []byte) bool) {
+	n.lock.Lock()
+	n.filter = drop
+	n.lock.Unlock()
+}
+
+// crée un réseau parfait (ni perte ni délai). seed rend les tirages aléatoires reproductibles
+func New(seed int64) *Network {
+	return &Network{
+		conns:  make(map[string]*Conn),
+		links:  make(map[link__key]Conditions),
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// change les conditions de tous les liens qui n'ont pas les leurs
+func (n *Network) SetConditions(c Conditions) {
+	n.lock.Lock()
+	n.defaults = c
+	n.lock.Unlock()
+}
+
+// change les conditions entre a et b (dans les deux sens)
+func (n *Network) SetLinkConditions(a, b string, c Conditions) {
+	n.lock.Lock()
+	n.links[link__key{from: a, to: b}] = c
+	n.links[link__key{from: b, to: a}] = c
+	n.lock.Unlock()
+}
+
+// ouvre une connexion à l'adresse donnée (ex: "10.0.0.1:9000")
+func (n *Network) Listen(address string) (*Conn, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	key := addr.String()
+	if _, exists := n.conns[key]; exists {
+		return nil, fmt.Errorf("adresse déjà utilisée : %s", key)
+	}
+
+	c := &Conn{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan datagram, inboxSize),
+		closed:  make(chan struct{}),
+		punched: make(map[string]time.Time),
+	}
+	n.conns[key] = c
+	return c, nil
+}
+
+// place la connexion à cette adresse derrière un NAT. timeout est la durée de vie d'une ouverture (0 = infinie)
+func (n *Network) SetNAT(address string, kind NATKind, timeout time.Duration) error {
+
+	n.lock.Lock()
+	c, exists := n.conns[address]
+	n.lock.Unlock()
+
+	if !exists {
+		return fmt.Errorf("adresse inconnue : %s", address)
+	}
+
+	c.lock.Lock()
+	c.nat = kind
+	c.natTimeout = timeout
+	c.lock.Unlock()
+	return nil
+}
+
+// renvoie les statistiques du réseau
+func (n *Network) Stats() Stats {
+	return Stats{
+		Sent:       n.sent.Load(),
+		Delivered:  n.delivered.Load(),
+		Lost:       n.lost.Load(),
+		Duplicated: n.duplicated.Load(),
+		Filtered:   n.filtered.Load(),
+		Dropped:    n.dropped.Load(),
+	}
+}
+
+// envoie un datagramme de from à to en appliquant les conditions du lien
+func (n *Network) send(from *Conn, to *net.UDPAddr, data []byte) {
+
+	n.sent.Add(1)
+
+	n.lock.Lock()
+	dest := n.conns[to.String()]
+	cond, exists := n.links[link__key{from: from.addr.String(), to: to.String()}]
+	if !exists {
+		cond = n.defaults
+	}
+
+	filter := n.filter
+
+	// tous les tirages sont faits sous le verrou (rand.Rand n'est pas thread-safe)
+	lost := n.random.Float64() < cond.Loss
+	copies := 1
+	if n.random.Float64() < cond.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = cond.Delay
+		if cond.Jitter > 0 {
+			delays[i] += time.Duration(n.random.Int63n(int64(cond.Jitter)))
+		}
+		if n.random.Float64() < cond.Reorder {
+			if cond.ReorderDelay > 0 {
+				delays[i] += cond.ReorderDelay
+			} else {
+				delays[i] += 20 * time.Millisecond
+			}
+		}
+	}
+	n.lock.Unlock()
+
+	if dest == nil {
+		n.dropped.Add(1)
+		return
+	}
+	if lost || (filter != nil && filter(from.addr.String(), to.String(), data)) {
+		n.lost.Add(1)
+		return
+	}
+	if copies > 1 {
+		n.duplicated.Add(1)
+	}
+
+	// le destinataire ne doit pas partager le tableau de l'émetteur
+	payload := append([]byte(nil), data...)
+	src := *from.addr
+
+	for _, delay := range delays {
+		d := datagram{data: payload, from: &src}
+		if delay <= 0 {
+			dest.receive(d)
+		} else {
+			time.AfterFunc(delay, func() { dest.receive(d) })
+		}
+	}
+}
+
+// un datagramme en transit
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// une connexion sur le réseau en mémoire (implémente p2p.Transport)
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	inbox   chan datagram
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock       sync.Mutex
+	nat        NATKind
+	natTimeout time.Duration
+	// destinations auxquelles on a envoyé quelque chose ("ip:port" et "ip"), et quand
+	punched map[string]time.Time
+}
+
+// clé d'une ouverture du NAT pour une adresse distante
+func (c *Conn) nat__key(addr *net.UDPAddr) string {
+	if c.nat == AddressRestricted {
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// un datagramme arrive : on applique le NAT puis on le met dans la file
+func (c *Conn) receive(d datagram) {
+
+	c.lock.Lock()
+	if c.nat != NoNAT {
+		opened, exists := c.punched[c.nat__key(d.from)]
+		if !exists || (c.natTimeout > 0 && time.Since(opened) > c.natTimeout) {
+			c.lock.Unlock()
+			c.network.filtered.Add(1)
+			return
+		}
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-c.closed:
+		c.network.dropped.Add(1)
+	case c.inbox <- d:
+		c.network.delivered.Add(1)
+	default:
+		c.network.dropped.Add(1)
+	}
+}
+
+// lit un datagramme (bloquant). Renvoie net.ErrClosed après Close
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case d := <-c.inbox:
+		n := copy(b, d.data)
+		return n, d.from, nil
+	}
+}
+
+// envoie un datagramme. Ouvre le NAT vers addr (les réponses de addr pourront passer)
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	// on retient la destination même sans NAT : un NAT ajouté plus tard (SetNAT) en tiendra compte
+	c.lock.Lock()
+	c.punched[addr.String()] = time.Now()
+	c.punched[addr.IP.String()] = time.Now()
+	c.lock.Unlock()
+
+	c.network.send(c, addr, b)
+	return len(b), nil
+}
+
+// notre adresse sur le réseau en mémoire
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// ferme la connexion et libère son adresse
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.network.lock.Lock()
+		if c.network.conns[c.addr.String()] == c {
+			delete(c.network.conns, c.addr.String())
+		}
+		c.network.lock.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,284 @@
+package memnet
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// ouvre une connexion sur le réseau, fermée à la fin du test
+func listen(t *testing.T, n *Network, address string) *Conn {
+	t.Helper()
+
+	c, err := n.Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%s) : %v", address, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// lit un datagramme dans la file de la connexion, ou renvoie false si rien n'arrive avant wait
+func read(c *Conn, wait time.Duration) (string, *net.UDPAddr, bool) {
+	select {
+	case d := <-c.inbox:
+		return string(d.data), d.from, true
+	case <-time.After(wait):
+		return "", nil, false
+	}
+}
+
+func send(t *testing.T, from *Conn, to *Conn, data string) {
+	t.Helper()
+
+	if _, err := from.WriteToUDP([]byte(data), to.addr); err != nil {
+		t.Fatalf("WriteToUDP : %v", err)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	send(t, a, b, "salut")
+
+	buf := make([]byte, 1500)
+	size, from, err := b.ReadFromUDP(buf)
+	if err != nil || string(buf[:size]) != "salut" {
+		t.Fatalf("reçu %q (%v), attendu \"salut\"", buf[:size], err)
+	}
+	if from.String() != "10.0.0.1:8000" {
+		t.Fatalf("émetteur %s, attendu 10.0.0.1:8000", from)
+	}
+
+	stats := n.Stats()
+	if stats.Sent != 1 || stats.Delivered != 1 {
+		t.Fatalf("statistiques %+v, attendu 1 envoyé et 1 livré", stats)
+	}
+}
+
+func TestAddressInUse(t *testing.T) {
+	n := New(1)
+	listen(t, n, "10.0.0.1:8000")
+
+	if _, err := n.Listen("10.0.0.1:8000"); err == nil {
+		t.Fatal("deux connexions sur la même adresse")
+	}
+}
+
+func TestLoss(t *testing.T) {
+	n := New(1)
+	n.SetConditions(Conditions{Loss: 1})
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	for i := 0; i < 10; i++ {
+		send(t, a, b, "perdu")
+	}
+
+	if data, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatalf("reçu %q malgré 100%% de pertes", data)
+	}
+	if stats := n.Stats(); stats.Lost != 10 || stats.Delivered != 0 {
+		t.Fatalf("statistiques %+v, attendu 10 pertes", stats)
+	}
+}
+
+func TestLinkConditions(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+	c := listen(t, n, "10.0.0.3:8000")
+
+	// seul le lien a <-> b perd tout
+	n.SetLinkConditions(a.addr.String(), b.addr.String(), Conditions{Loss: 1})
+
+	send(t, a, b, "perdu")
+	send(t, b, a, "perdu")
+	send(t, a, c, "livré")
+
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("a -> b aurait dû être perdu")
+	}
+	if _, _, ok := read(a, 50*time.Millisecond); ok {
+		t.Fatal("b -> a aurait dû être perdu")
+	}
+	if data, _, ok := read(c, time.Second); !ok || data != "livré" {
+		t.Fatalf("a -> c : reçu %q (ok=%v)", data, ok)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	n := New(1)
+	n.SetConditions(Conditions{Duplicate: 1})
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	send(t, a, b, "deux fois")
+
+	for i := 0; i < 2; i++ {
+		if data, _, ok := read(b, time.Second); !ok || data != "deux fois" {
+			t.Fatalf("copie %d : reçu %q (ok=%v)", i+1, data, ok)
+		}
+	}
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("plus de deux copies reçues")
+	}
+	if stats := n.Stats(); stats.Duplicated != 1 || stats.Delivered != 2 {
+		t.Fatalf("statistiques %+v, attendu 1 doublon et 2 livraisons", stats)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	// le premier datagramme est retardé, le second non : il doit arriver avant
+	n.SetConditions(Conditions{Reorder: 1, ReorderDelay: 50 * time.Millisecond})
+	send(t, a, b, "premier")
+	n.SetConditions(Conditions{})
+	send(t, a, b, "second")
+
+	for _, expected := range []string{"second", "premier"} {
+		if data, _, ok := read(b, time.Second); !ok || data != expected {
+			t.Fatalf("reçu %q (ok=%v), attendu %q", data, ok, expected)
+		}
+	}
+}
+
+func TestAddressRestrictedNAT(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	other := listen(t, n, "10.0.0.1:9000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	if err := n.SetNAT(b.addr.String(), AddressRestricted, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// b n'a encore rien envoyé à a : filtré
+	send(t, a, b, "filtré")
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("paquet entrant non filtré par le NAT")
+	}
+	if stats := n.Stats(); stats.Filtered != 1 {
+		t.Fatalf("statistiques %+v, attendu 1 paquet filtré", stats)
+	}
+
+	// b ouvre son NAT vers l'IP de a : tous les ports de cette IP passent
+	send(t, b, a, "ouverture")
+	send(t, a, b, "réponse")
+	send(t, other, b, "autre port")
+
+	for _, expected := range []string{"réponse", "autre port"} {
+		if data, _, ok := read(b, time.Second); !ok || data != expected {
+			t.Fatalf("reçu %q (ok=%v), attendu %q", data, ok, expected)
+		}
+	}
+}
+
+func TestPortRestrictedNAT(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	other := listen(t, n, "10.0.0.1:9000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	if err := n.SetNAT(b.addr.String(), PortRestricted, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	send(t, b, a, "ouverture")
+	send(t, other, b, "autre port")
+	send(t, a, b, "réponse")
+
+	// seul le port auquel b a écrit passe
+	if data, _, ok := read(b, time.Second); !ok || data != "réponse" {
+		t.Fatalf("reçu %q (ok=%v), attendu \"réponse\"", data, ok)
+	}
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("paquet d'un autre port non filtré")
+	}
+}
+
+func TestNATTimeout(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	if err := n.SetNAT(b.addr.String(), PortRestricted, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	send(t, b, a, "ouverture")
+	time.Sleep(50 * time.Millisecond)
+
+	// l'ouverture a expiré
+	send(t, a, b, "trop tard")
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("paquet accepté après l'expiration de l'ouverture du NAT")
+	}
+}
+
+func TestUnknownDestination(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+
+	to, _ := net.ResolveUDPAddr("udp", "10.0.0.9:8000")
+	if _, err := a.WriteToUDP([]byte("personne"), to); err != nil {
+		t.Fatalf("WriteToUDP : %v", err)
+	}
+	if stats := n.Stats(); stats.Dropped != 1 {
+		t.Fatalf("statistiques %+v, attendu 1 paquet jeté", stats)
+	}
+}
+
+func TestClose(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+
+	a.Close()
+
+	if _, _, err := a.ReadFromUDP(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("ReadFromUDP après Close : %v, attendu net.ErrClosed", err)
+	}
+	if _, err := a.WriteToUDP([]byte("x"), a.addr); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("WriteToUDP après Close : %v, attendu net.ErrClosed", err)
+	}
+
+	// l'adresse est libérée
+	listen(t, n, "10.0.0.1:8000")
+}
+
+func TestFilter(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "10.0.0.1:8000")
+	b := listen(t, n, "10.0.0.2:8000")
+
+	// on ne perd que les datagrammes qui commencent par "x"
+	n.SetFilter(func(from, to string, data []byte) bool {
+		return from == a.addr.String() && data[0] == 'x'
+	})
+
+	send(t, a, b, "xperdu")
+	send(t, a, b, "livré")
+
+	if data, _, ok := read(b, time.Second); !ok || data != "livré" {
+		t.Fatalf("reçu %q (ok=%v), attendu \"livré\"", data, ok)
+	}
+	if _, _, ok := read(b, 50*time.Millisecond); ok {
+		t.Fatal("datagramme filtré livré")
+	}
+	if stats := n.Stats(); stats.Lost != 1 {
+		t.Fatalf("statistiques %+v, attendu 1 perte", stats)
+	}
+
+	// sans filtre tout passe
+	n.SetFilter(nil)
+	send(t, a, b, "xlivré")
+	if data, _, ok := read(b, time.Second); !ok || data != "xlivré" {
+		t.Fatalf("reçu %q (ok=%v), attendu \"xlivré\"", data, ok)
+	}
+}
@@ -0,0 +1,256 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"project/pkg/identity"
+	"sync"
+	"time"
+)
+
+// un handler reçoit le message, son émetteur, et la session de l'émetteur (nil si le type n'en demande pas)
+type HandlerFunc func(req *Message, addr *net.UDPAddr, session *PeerSession)
+
+// description d'un type de message : le handler à appeler et les vérifications à faire avant de l'appeler
+// Listen__loop fait toutes ces vérifications, le handler n'a plus qu'à traiter un message valide
+type HandlerSpec struct {
+	// type du message (les types 0-127 sont des requêtes, 128-255 des réponses)
+	Type uint8
+	// nom affiché dans les logs
+	Name string
+	// la fonction appelée pour chaque message de ce type
+	Handler HandlerFunc
+
+	// l'émetteur doit nous avoir envoyé un Hello (sinon on répond "please hello first")
+	NeedSession bool
+	// la signature doit être valide (implique NeedSession : il faut la clef du pair)
+	NeedSignature bool
+	// le body peut être chiffré avec la clef de session : il est déchiffré avant la vérification de taille
+	AllowEncrypted bool
+
+	// taille minimale du body
+	MinBody int
+	// tailles exactes acceptées pour le body (vide = toutes les tailles >= MinBody)
+	BodySizes []int
+	// message Error renvoyé si la taille du body est invalide
+	SizeError string
+
+	// le handler peut bloquer longtemps (requête HTTP au serveur...) : il est traité par des workers à part
+	Slow bool
+}
+
+// noms des types de message enregistrés en plus de ceux du sujet (pour msg__type__to__string)
+var custom__type__names sync.Map
+
+// enregistre un type de message. Renvoie une erreur si ce type a déjà un handler
+// un utilisateur de la bibliothèque peut ainsi ajouter ses propres messages sans toucher à Listen__loop
+func (me *Me) Register__handler(spec HandlerSpec) error {
+
+	if spec.Handler == nil {
+		return fmt.Errorf("handler manquant pour le type %d", spec.Type)
+	}
+
+	// on ne peut pas vérifier une signature sans la clef du pair
+	if spec.NeedSignature || spec.AllowEncrypted {
+		spec.NeedSession = true
+	}
+
+	me.handlersLock.Lock()
+	defer me.handlersLock.Unlock()
+
+	if existing, exists := me.handlers[spec.Type]; exists {
+		return fmt.Errorf("le type %d a déjà un handler (%s)", spec.Type, existing.Name)
+	}
+
+	if spec.Name == "" {
+		spec.Name = msg__type__to__string(spec.Type)
+	} else if msg__type__to__string(spec.Type) != spec.Name {
+		custom__type__names.Store(spec.Type, spec.Name)
+	}
+
+	me.handlers[spec.Type] = &spec
+	return nil
+}
+
+// renvoie la description du type de message, ou nil s'il n'est pas géré
+func (me *Me) handler__for(msgType uint8) *HandlerSpec {
+	me.handlersLock.RLock()
+	defer me.handlersLock.RUnlock()
+	return me.handlers[msgType]
+}
+
+// les handlers du protocole (enregistrés par New__communication)
+func (me *Me) register__default__handlers() {
+
+	hashSize := "invalid hash size (must be 32 bytes)"
+	addrSize := "invalid addr size (must be 6 or 18 bytes)"
+
+	specs := []HandlerSpec{
+
+		////////////////
+		// REQUETES
+		////////////////
+
+		{Type: TypePing, Name: "Ping", Handler: me.Handle__ping, NeedSession: true},
+		// la signature d'un Hello se vérifie avec la clef donnée par le serveur : c'est le handler qui s'en charge
+		// (d'où Slow : on ne veut pas que la requête HTTP bloque les autres messages)
+		{Type: TypeHello, Name: "Hello", Handler: me.Handle__hellos, MinBody: 4, SizeError: "invalid hello format", Slow: true},
+		{Type: TypeRootRequest, Name: "RootRequest", Handler: me.Handle__RootRequest, NeedSession: true},
+		{Type: TypeDatumRequest, Name: "DatumRequest", Handler: me.Handle__DatumRequest, NeedSession: true, MinBody: 32, SizeError: hashSize},
+		{Type: TypeNatTraversalRequest, Name: "NatTraversalRequest", Handler: me.Handle__NatTraversalRequest, NeedSignature: true, BodySizes: []int{6, 18}, SizeError: addrSize},
+		{Type: TypeNatTraversalRequest2, Name: "NatTraversalRequest2", Handler: me.Handle__NatTraversalRequest2, NeedSignature: true, BodySizes: []int{6, 18}, SizeError: addrSize},
+		// traités avec les Hello, dans l'ordre d'arrivée (voir handshake.go). 64 octets : réponse à notre clé
+		{Type: TypeKeyExchange, Name: "KeyExchange", Handler: me.Handle__KeyExchange, NeedSignature: true, BodySizes: []int{32, 64}, SizeError: "invalid key size (must be 32 or 64 bytes)", Slow: true},
+		{Type: TypeKeyConfirm, Name: "KeyConfirm", Handler: me.Handle__KeyConfirm, NeedSession: true, BodySizes: []int{32}, SizeError: "invalid key confirmation size (must be 32 bytes)", Slow: true},
+		// enveloppe chiffrée : le message contenu repasse par dispatch une fois déchiffré
+		{Type: TypeEncrypted, Name: "Encrypted", Handler: me.Handle__Encrypted, NeedSession: true, MinBody: envelopeOverhead + 7, SizeError: "invalid encrypted message size"},
+
+		/////////////
+		// REPONSES
+		/////////////
+
+		{Type: TypeOk, Name: "Ok", Handler: me.Handle__Ok},
+		{Type: Error, Name: "Error", Handler: me.Handle__error},
+		{Type: TypeHelloReply, Name: "HelloReply", Handler: me.Handle__hellos, MinBody: 4, SizeError: "invalid helloReply format", Slow: true},
+		{Type: TypeRootReply, Name: "RootReply", Handler: me.Handle__RootReply, NeedSignature: true, MinBody: 32, SizeError: hashSize},
+		{Type: TypeDatum, Name: "Datum", Handler: me.Handle__Datum, NeedSession: true, AllowEncrypted: true, MinBody: 32, SizeError: hashSize},
+		{Type: TypeNoDatum, Name: "NoDatum", Handler: me.Handle__NoDatum, NeedSignature: true, MinBody: 32, SizeError: hashSize},
+	}
+
+	for _, spec := range specs {
+		if err := me.Register__handler(spec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// vérifie un message reçu selon la description de son type, puis appelle son handler
+func (me *Me) dispatch(req *Message, addr *net.UDPAddr) {
+
+	spec := me.handler__for(req.Type)
+
+	// mauvais type
+	if spec == nil {
+		fmt.Printf("type de message non géré : %d\n", req.Type)
+		me.Handle__if__error(req, addr, fmt.Sprintf("unknown message type: %d", req.Type))
+		return
+	}
+
+	var session *PeerSession
+
+	if spec.NeedSession {
+		var ok bool
+		session, ok = me.check__session(req, addr, spec)
+		if !ok {
+			return
+		}
+	}
+
+	// le body est peut-être chiffré : on le déchiffre avant de regarder sa taille
+	// (sauf s'il est arrivé dans une enveloppe : il a déjà été déchiffré en entier)
+	if spec.AllowEncrypted && !req.Sealed {
+		me.Mutex.Lock()
+		encrypted, sharedKey := session.IsEncrypted && !session.uses__envelope(), session.SharedKey
+		me.Mutex.Unlock()
+
+		if encrypted {
+			decryptedBody, err := identity.Decrypt_AES(sharedKey, req.Body)
+			if err != nil {
+				fmt.Printf("Erreur déchiffrement (%s) de %s : %v\n", spec.Name, addr, err)
+				return
+			}
+			Verbose_log("%s déchiffré avec succès de %s", spec.Name, addr)
+
+			// On "triche" : on modifie le message pour faire croire qu'il était en clair
+			req.Body = decryptedBody
+		}
+	}
+
+	if !body__size__ok(spec, len(req.Body)) {
+		fmt.Printf("Message (%s) invalide de %s (taille body incorrecte)\n", spec.Name, addr)
+
+		errorMsg := spec.SizeError
+		if errorMsg == "" {
+			errorMsg = fmt.Sprintf("invalid body size for message type %d", req.Type)
+		}
+		me.Handle__if__error(req, addr, errorMsg)
+		return
+	}
+
+	spec.Handler(req, addr, session)
+}
+
+// vérifie que l'émetteur a une session (et sa clef), et si besoin la signature du message
+func (me *Me) check__session(req *Message, addr *net.UDPAddr, spec *HandlerSpec) (*PeerSession, bool) {
+
+	// on prend le verrou sur les session et on récupère les infos sur la session
+	me.Mutex.Lock()
+	session, exists := me.Sessions[addr.String()]
+	var pubKey *ecdsa.PublicKey
+	if exists {
+		pubKey = session.PublicKey
+	}
+	me.Mutex.Unlock()
+
+	// si la session n'existe pas
+	if !exists {
+		fmt.Printf("Message (%s) reçu de %s, mais pair inconnu. Ignoré.\n", spec.Name, addr)
+		me.Handle__if__error(req, addr, "please hello first")
+		return nil, false
+	}
+
+	// si on ne connait pas encore la clef du peer
+	if pubKey == nil {
+		fmt.Printf("Message (%s) reçu de %s, mais clé publique inconnue. Ignoré.\n", spec.Name, addr)
+		me.Handle__if__error(req, addr, "your key is nowhere to be found (could be our fault), please Handshake (Hello)")
+		return nil, false
+	}
+
+	if spec.NeedSignature {
+		// Il ne faut pas vérifier tout le message mais seulement le "header" + le body (+ la date)
+		dataToVerify := req.signed__data()
+
+		if !identity.Verify__signature(pubKey, dataToVerify, req.Signature) {
+			fmt.Printf(" Signature invalide pour le message (%s) de %s\n", spec.Name, addr)
+			me.Handle__if__error(req, addr, "bad signature")
+			return nil, false
+		}
+
+		// une signature valide ne suffit pas : le message a pu être capturé puis renvoyé
+		me.Mutex.Lock()
+		dated := session.Extensions&ExtensionTimestamp != 0
+		me.Mutex.Unlock()
+
+		if err := me.check__replay(pubKey, req, dated); err != nil {
+			me.reject__replay(req, addr, err)
+			return nil, false
+		}
+	}
+
+	// on met à jour le lastseen
+	me.Mutex.Lock()
+	session.LastSeen = time.Now()
+	me.Mutex.Unlock()
+
+	return session, true
+}
+
+// renvoie true si la taille du body respecte la description du type
+func body__size__ok(spec *HandlerSpec, size int) bool {
+
+	if size < spec.MinBody {
+		return false
+	}
+
+	if len(spec.BodySizes) == 0 {
+		return true
+	}
+
+	for _, allowed := range spec.BodySizes {
+		if size == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,13 @@ package p2p
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"project/pkg/filesystem"
 	"strings"
 	"sync"
+	"time"
 )
 
 // fonction pour charger un fichier ou dossier local dans notre Database (pour le proposer aux autres pairs)
@@ -20,6 +21,8 @@ func (me *Me) Load__file__system(nodes []filesystem.Node) {
 	defer me.DbLock.Unlock()
 
 	me.Database = make(map[[32]byte][]byte)
+	// les noeuds des squelettes étaient dans la Database : ils seront relus sur le disque au besoin
+	me.Skeletons = make(map[string][32]byte)
 
 	// On remplit la map pour un accès rapide (O(1)) lors des requêtes
 	for _, node := range nodes {
@@ -35,6 +38,11 @@ func (me *Me) Load__file__system(nodes []filesystem.Node) {
 
 // fonction utile pour transformer un path en un hash pour ensuite télécharger seulement 1 fichier d'un arbre d'un pair
 func (me *Me) Get__hash__from__path(destAddr string, rootHash [32]byte, pathStr string) ([32]byte, error) {
+	return me.Get__hash__from__path__ctx(context.Background(), destAddr, rootHash, pathStr)
+}
+
+// variante de Get__hash__from__path qui peut être annulée via ctx
+func (me *Me) Get__hash__from__path__ctx(ctx context.Context, destAddr string, rootHash [32]byte, pathStr string) ([32]byte, error) {
 
 	pathStr = strings.Trim(pathStr, "/")
 
@@ -50,7 +58,7 @@ func (me *Me) Get__hash__from__path(destAddr string, rootHash [32]byte, pathStr
 	for _, nextHash := range parts {
 
 		// on cherche le hash suivant dans le dossier courant
-		nextHash, found, err := me.find__hash__in__dir(destAddr, currentHash, nextHash)
+		nextHash, found, err := me.find__hash__in__dir(ctx, destAddr, currentHash, nextHash)
 
 		if err != nil {
 			return [32]byte{}, fmt.Errorf("erreur réseau/lecture sur %s : %v", nextHash, err)
@@ -67,10 +75,10 @@ func (me *Me) Get__hash__from__path(destAddr string, rootHash [32]byte, pathStr
 }
 
 // fonction qui cherche un nom dans un dossier Directory et renvoie le hash associé
-func (me *Me) find__hash__in__dir(destAddr string, dirHash [32]byte, nameToFind string) ([32]byte, bool, error) {
+func (me *Me) find__hash__in__dir(ctx context.Context, destAddr string, dirHash [32]byte, nameToFind string) ([32]byte, bool, error) {
 
 	// on récupère le contenu du noeud
-	data, err := me.ensureDatum(dirHash, destAddr)
+	data, err := me.ensureDatum(ctx, dirHash, destAddr)
 	if err != nil {
 		return [32]byte{}, false, err
 	}
@@ -105,7 +113,7 @@ func (me *Me) find__hash__in__dir(destAddr string, dirHash [32]byte, nameToFind
 			copy(nextDirectory[:], hashesData[i*32:(i+1)*32])
 
 			// Appel récursif : on cherche le nom dans ce sous-bloc
-			foundHash, found, err := me.find__hash__in__dir(destAddr, nextDirectory, nameToFind)
+			foundHash, found, err := me.find__hash__in__dir(ctx, destAddr, nextDirectory, nameToFind)
 
 			if err != nil {
 				return [32]byte{}, false, err
@@ -122,72 +130,246 @@ func (me *Me) find__hash__in__dir(destAddr string, dirHash [32]byte, nameToFind
 	return [32]byte{}, false, nil
 }
 
-// fonction appelée pour "télécharger" l'arbre d'un pair dans notre DataBase
-func (me *Me) Download_tree(destAddr string, rootHash [32]byte) {
+// noeud qu'on n'a pas réussi à récupérer lors d'un téléchargement
+type MissingNode struct {
+	// le hash du noeud manquant
+	Hash [32]byte
+	// le chemin (relatif à la racine téléchargée) du fichier ou dossier concerné
+	Path string
+	// pourquoi on ne l'a pas (timeout, NoDatum, donnée corrompue, ...)
+	Reason error
+
+	// la tâche correspondante, pour pouvoir la relancer au second passage
+	// (nil si le noeud a été refusé : on ne doit jamais le redemander)
+	task *DownloadTask
+}
 
-	// on initialise un waitgroup
-	// un WaitGroup est comme un sem_barrier (il attends que tout le monde ait finit pour lacher)
-	var wg sync.WaitGroup
+// bilan d'un téléchargement, renvoyé par Download_tree
+type DownloadResult struct {
+	// nombre de noeuds reçus du réseau
+	Fetched int
+	// nombre de noeuds qu'on avait déjà dans notre Database
+	Cached int
+	// nombre d'octets reçus
+	Bytes int64
+	// durée totale (second passage compris)
+	Elapsed time.Duration
+	// noeuds manquants à la fin du téléchargement (avec leurs chemins et la raison)
+	Missing []MissingNode
+
+	// avec DownloadOptions.StreamTo : nombre de fichiers complètement écrits sur le disque
+	FilesWritten int
+	// avec DownloadOptions.StreamTo : fichiers locaux restés incomplets
+	IncompleteFiles []string
+}
 
-	// on cree la semaphore qui va reguler notre trafic (c'est le pipe dont on parlait plus haut)
-	semaphore := make(chan struct{}, 24)
+// renvoie true si tout l'arbre a été récupéré
+func (r *DownloadResult) Complete() bool {
+	return len(r.Missing) == 0
+}
 
-	// on incremente le WaitGroup de 1 (sinon il est déjà "fini")
-	wg.Add(1)
+// options d'un téléchargement
+type DownloadOptions struct {
+	// si true, on refait un passage sur les noeuds qui ont échoué (et seulement sur ceux là)
+	RetryFailed bool
+
+	// mode "squelette" : on ne garde que les Directory et BigDirectory (jamais les chunks)
+	// pour pouvoir explorer l'arbre du pair hors ligne (print, recherche de chemins)
+	MetadataOnly bool
+	// en mode squelette, on garde aussi le premier niveau des BigNode (la liste des hash des chunks d'un gros fichier)
+	IncludeBigNodes bool
+
+	// chemins (ou motifs) à récupérer avant le reste
+	Priority []string
+	// nombre de requêtes en parallèle (24 par défaut)
+	Workers int
+
+	// si non vide, les fichiers sont écrits dans ce dossier pendant le téléchargement (chemins relatifs à la racine du pair)
+	// les chunks ne sont alors pas gardés en mémoire : plus besoin de Rebuild__file__system
+	StreamTo string
+}
 
-	// on appelle notre fonction de téléchargement
-	me.Download_recursively(destAddr, rootHash, &wg, semaphore)
+// état partagé par tous les workers d'un même téléchargement
+type DownloadJob struct {
+	// la file de priorité des noeuds à récupérer
+	scheduler *download__scheduler
+	// les options choisies par l'appelant
+	opts DownloadOptions
+	// écriture des fichiers au fil de l'eau (nil sans DownloadOptions.StreamTo)
+	stream *stream__writer
+
+	// le bilan qu'on remplit au fur et à mesure, et son verrou
+	resultLock sync.Mutex
+	result     DownloadResult
+}
 
-	// on attends que notre WaitGroup termine
-	wg.Wait()
+// on note un noeud manquant dans le bilan
+func (job *DownloadJob) add__missing(task *DownloadTask, reason error) {
+	job.resultLock.Lock()
+	job.result.Missing = append(job.result.Missing, MissingNode{Hash: task.Hash, Path: task.Path, Reason: reason, task: task})
+	job.resultLock.Unlock()
 }
 
-func (me *Me) Download_recursively(destAddr string, hash [32]byte, wg *sync.WaitGroup, semaphore chan struct{}) {
-	// on lache le WaitGroup à la fin de la fonction
-	defer wg.Done()
+// comme add__missing, mais pour un noeud refusé (nom invalide, ...) : sans tâche, le second passage ne le relance pas
+func (job *DownloadJob) add__rejected(hash [32]byte, path string, reason error) {
+	job.resultLock.Lock()
+	job.result.Missing = append(job.result.Missing, MissingNode{Hash: hash, Path: path, Reason: reason})
+	job.resultLock.Unlock()
+}
 
-	// on vérifie si on a pas déjà ce fichier
-	// on prends le verrou sur la database pour gérer la concurrence
-	me.DbLock.Lock()
-	_, have := me.Database[hash]
-	me.DbLock.Unlock()
+// fonction appelée pour "télécharger" l'arbre d'un pair dans notre DataBase
+func (me *Me) Download_tree(destAddr string, rootHash [32]byte) *DownloadResult {
+	return me.Download_tree__ctx(context.Background(), destAddr, rootHash, DownloadOptions{RetryFailed: true})
+}
 
-	// si on l'a, on finit
-	if have {
-		return
+// variante de Download_tree qui peut être annulée via ctx : plus aucune requête n'est lancée
+// et celles en cours sont abandonnées dès que ctx est annulé
+func (me *Me) Download_tree__ctx(ctx context.Context, destAddr string, rootHash [32]byte, opts DownloadOptions) *DownloadResult {
+	return me.Download_selection__ctx(ctx, destAddr, []RemoteEntry{{Path: "", Hash: rootHash, IsDir: true}}, opts)
+}
+
+// télécharge plusieurs sous-arbres d'un même pair en un seul téléchargement (voir Resolve__patterns)
+// les chemins des noeuds manquants sont relatifs à la racine du pair
+func (me *Me) Download_selection__ctx(ctx context.Context, destAddr string, entries []RemoteEntry, opts DownloadOptions) *DownloadResult {
+
+	// on lance un chrono
+	start := time.Now()
+
+	if opts.Workers <= 0 {
+		opts.Workers = 24
 	}
 
-	// on prend 1 "ticket" pour notre semaphore, si c'est plein, on attend
-	semaphore <- struct{}{}
+	job := &DownloadJob{
+		scheduler: new__download__scheduler(opts.Priority),
+		opts:      opts,
+	}
 
-	// on rend le "ticket" à la fin de la fonction
-	defer func() { <-semaphore }()
+	if opts.StreamTo != "" && !opts.MetadataOnly {
+		job.stream = new__stream__writer(opts.StreamTo)
+		job.scheduler.stream = job.stream
+	}
 
-	// on demande les data sur le hash voulu
-	receivedData, err := me.Send__DatumRequest(destAddr, hash)
+	// une tâche par racine, dans l'ordre donné
+	for i, entry := range entries {
+		job.scheduler.push(&DownloadTask{Hash: entry.Hash, Path: entry.Path, Class: ClassStructure, order: []int{i}})
+	}
 
-	if err != nil {
-		fmt.Printf("echec récupération data du hash %x : %v\n", hash[:5], err)
-		return
+	me.run__download__workers(ctx, destAddr, job)
+
+	// second passage : on ne relance que les noeuds qui ont échoué
+	if opts.RetryFailed && len(job.result.Missing) > 0 && ctx.Err() == nil {
+
+		failed := job.result.Missing
+		job.result.Missing = nil
+
+		Verbose_log("second passage sur %d noeud(s) manquant(s)", len(failed))
+
+		for _, missing := range failed {
+			// un noeud refusé reste manquant
+			if missing.task == nil {
+				job.result.Missing = append(job.result.Missing, missing)
+				continue
+			}
+			job.scheduler.push(missing.task)
+		}
+		me.run__download__workers(ctx, destAddr, job)
+	}
+
+	// on ferme les fichiers qui n'ont pas pu être terminés
+	if job.stream != nil {
+		job.result.IncompleteFiles = job.stream.close__all()
+		job.result.FilesWritten = job.stream.completed
+	}
+
+	job.result.Elapsed = time.Since(start)
+	return &job.result
+}
+
+// lance opts.Workers workers qui vident la file du téléchargement, et attend qu'elle soit vide
+func (me *Me) run__download__workers(ctx context.Context, destAddr string, job *DownloadJob) {
+
+	// un WaitGroup est comme un sem_barrier (il attends que tout le monde ait finit pour lacher)
+	var wg sync.WaitGroup
+
+	for i := 0; i < job.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				task := job.scheduler.next()
+				if task == nil {
+					return
+				}
+				me.Download_recursively(ctx, destAddr, task, job)
+				job.scheduler.done()
+			}
+		}()
 	}
 
-	// Si le channel a été fermé (par Handle__NoDatum), on reçoit une donnée vide.
-	// On arrête le traitement pour ce noeud.
-	if len(receivedData) == 0 {
-		fmt.Printf("Abandon branche (NoDatum) pour le hash %x\n", hash[:4])
+	wg.Wait()
+}
+
+// télécharge le noeud de la tâche puis ajoute ses enfants dans la file du téléchargement
+func (me *Me) Download_recursively(ctx context.Context, destAddr string, task *DownloadTask, job *DownloadJob) {
+
+	hash := task.Hash
+	path := task.Path
+
+	// si le téléchargement a été annulé, on note le noeud comme manquant et on ne va pas plus loin
+	if ctx.Err() != nil {
+		job.add__missing(task, ctx.Err())
 		return
 	}
 
-	// on prends le verrou sur la Database et on y écrit les data
+	// on vérifie si on a pas déjà ce noeud
+	// on prends le verrou sur la database pour gérer la concurrence
 	me.DbLock.Lock()
-	me.Database[hash] = receivedData
+	receivedData, have := me.Database[hash]
 	me.DbLock.Unlock()
 
+	// en mode squelette, un fichier dont on connait déjà le type n'a pas besoin d'être redemandé
+	if !have && job.opts.MetadataOnly {
+		if _, known := me.Known__node__type(hash); known {
+			job.resultLock.Lock()
+			job.result.Cached++
+			job.resultLock.Unlock()
+			return
+		}
+	}
+
+	// si on l'a, pas besoin de le redemander, mais on continue quand même sur les enfants
+	// (un téléchargement précédent a pu s'arrêter en cours de route)
+	if have {
+		job.resultLock.Lock()
+		job.result.Cached++
+		job.resultLock.Unlock()
+	} else {
+		data, err := me.fetch__node(ctx, destAddr, hash, job)
+		if err != nil {
+			job.add__missing(task, err)
+			return
+		}
+		receivedData = data
+	}
+
 	// analyse du noeud reçu
 
 	// recupération du type
 	nodeType := receivedData[0]
 
+	// on écrit sur le disque ce qui peut déjà l'être
+	if job.stream != nil {
+		if err := me.stream__node(task, receivedData, job); err != nil {
+			// un chemin refusé ne doit pas être relancé au second passage
+			if errors.Is(err, errUnsafePath) {
+				job.add__rejected(task.Hash, task.Path, err)
+			} else {
+				job.add__missing(task, err)
+			}
+			return
+		}
+	}
+
 	// switch/case sur le type
 	switch nodeType {
 
@@ -201,197 +383,157 @@ func (me *Me) Download_recursively(destAddr string, hash [32]byte, wg *sync.Wait
 		count := len(entriesData) / 64
 
 		for i := 0; i < count; i++ {
+			// on récupère le nom de l'enfant pour construire son chemin
+			name := string(bytes.Trim(entriesData[i*64:i*64+32], "\x00"))
+
 			// on copie chaque hash des enfants
 			var childHash [32]byte
 			copy(childHash[:], entriesData[i*64+32:(i+1)*64])
 
-			// on va lancer récursivement un télechargement sur cet enfant donc on incremente notre WaitGroup
-			wg.Add(1)
+			// un nom comme ".." nous ferait écrire en dehors du dossier de téléchargement
+			if !Is__safe__name(name) {
+				job.add__rejected(childHash, join__remote__path(path, name), fmt.Errorf("nom d'entrée invalide %q", name))
+				continue
+			}
 
-			// on appelle notre fonction de telechargement
-			go me.Download_recursively(destAddr, childHash, wg, semaphore)
+			// l'enfant peut être un dossier ou un fichier : on le traite comme de la structure
+			job.scheduler.push(task.child(childHash, join__remote__path(path, name), ClassStructure, i))
 		}
 
-	// si c'est un BigNode ou un BigDirectory (meme principe)
+	// si c'est un BigNode ou un BigDirectory (meme principe, le chemin ne change pas)
 	case filesystem.TypeBig, filesystem.TypeBigDirectory:
 
+		// en mode squelette, on ne descend jamais vers les chunks d'un fichier
+		if nodeType == filesystem.TypeBig && job.opts.MetadataOnly {
+			return
+		}
+
 		// on coupe le type
 		hashesData := receivedData[1:]
 
 		// on va parcourir les enfants
 		count := len(hashesData) / 32
 
+		// sous un BigDirectory on trouve des dossiers, sous un BigNode des morceaux de fichier
+		childClass := ClassStructure
+		if nodeType == filesystem.TypeBig {
+			childClass = ClassContent
+		}
+
 		for i := 0; i < count; i++ {
 			// on copie chaque hash des enfants
 			var childHash [32]byte
 			copy(childHash[:], hashesData[i*32:(i+1)*32])
 
-			// on va lancer récursivement un télechargement sur cet enfant donc on incremente notre WaitGroup
-			wg.Add(1)
-
-			// on appelle notre fonction de telechargement
-			go me.Download_recursively(destAddr, childHash, wg, semaphore)
+			// on ajoute l'enfant dans la file du téléchargement
+			job.scheduler.push(task.child(childHash, path, childClass, i))
 		}
 	}
 }
 
-// fonction qui reconstruit tout un système de fichier à partir de notre Database
-// cette fonction ne crée que l'architecture du file system et délègue le reste (écriture des chunks) à un autre fonction
-// nodeHash est le noeud qu'on traite actuellement
-// currentPath est le lieu où on se trouve dans l'arborescence
-func (me *Me) Rebuild__file__system(nodeHash [32]byte, currentPath string) error {
-
-	// on prend un verrou sur la DB pour copier les data du node souhaité
-	me.DbLock.Lock()
-	data, exists := me.Database[nodeHash]
-	me.DbLock.Unlock()
+// demande un noeud au pair, vérifie son contenu et l'enregistre dans la Database
+func (me *Me) fetch__node(ctx context.Context, destAddr string, hash [32]byte, job *DownloadJob) ([]byte, error) {
 
-	// si le neoud n'existe pas
-	if !exists {
-		return fmt.Errorf("noeud manquant dans la base de données : %x", nodeHash[:4])
+	// on demande les data sur le hash voulu
+	receivedData, err := me.Send__DatumRequest__ctx(ctx, destAddr, hash)
+	if err != nil {
+		return nil, err
 	}
 
-	// on récupère le type du noeud
-	nodeType := data[0]
-
-	// switch/case sur le type
-	switch nodeType {
-
-	// SI c'est un Directory
-	case filesystem.TypeDirectory:
+	// (Send__DatumRequest__ctx a déjà vérifié que la donnée correspond bien au hash demandé)
 
-		// on crée le dossier sur le disque en local
-		if err := os.MkdirAll(currentPath, 0755); err != nil {
-			return fmt.Errorf("erreur création dossier %s: %v", currentPath, err)
+	// en mode squelette on ne garde pas le contenu des fichiers, seulement leur type
+	// en écriture au fil de l'eau, les chunks vont directement sur le disque
+	nodeType := receivedData[0]
+	keep := true
+	if job.opts.MetadataOnly {
+		switch nodeType {
+		case filesystem.TypeChunk:
+			keep = false
+		case filesystem.TypeBig:
+			keep = job.opts.IncludeBigNodes
 		}
+	} else if job.stream != nil && nodeType == filesystem.TypeChunk {
+		keep = false
+	}
 
-		// lecture de toutes les entrées : [Nom (32o)] + [Hash (32o)]
-
-		// on coupe le type
-		entriesData := data[1:]
-
-		// on parcourt toutes les entrées
-		entrySize := 64
-		count := len(entriesData) / entrySize
-
-		for i := 0; i < count; i++ {
-			start := i * entrySize
-
-			// suppréssion du padding sur le nom
-			nameBytes := entriesData[start : start+32]
-			name := string(bytes.Trim(nameBytes, "\x00"))
-
-			// on récupère le hash
-			var childHash [32]byte
-			copy(childHash[:], entriesData[start+32:start+64])
-
-			// on concaténe le nom de l'enfant a la fin du filepath
-			childPath := filepath.Join(currentPath, name)
+	// on prends le verrou sur la Database et on y écrit les data
+	me.DbLock.Lock()
+	if keep {
+		me.Database[hash] = receivedData
+	} else if job.opts.MetadataOnly {
+		me.NodeTypes[hash] = nodeType
+	}
+	me.DbLock.Unlock()
 
-			// appel récursif pour continuer à construire
-			if err := me.Rebuild__file__system(childHash, childPath); err != nil {
-				return err
-			}
-		}
+	job.resultLock.Lock()
+	job.result.Fetched++
+	job.result.Bytes += int64(len(receivedData))
+	job.resultLock.Unlock()
 
-	// Si c'est un BigDirectory
-	case filesystem.TypeBigDirectory:
+	return receivedData, nil
+}
 
-		// on coupe le type
-		hashesData := data[1:]
+// transmet un noeud reçu à l'écriture au fil de l'eau (voir stream.go)
+func (me *Me) stream__node(task *DownloadTask, data []byte, job *DownloadJob) error {
 
-		// on va parcourir les entrees
-		count := len(hashesData) / 32
+	switch data[0] {
 
-		for i := 0; i < count; i++ {
-			// on récupère le hash de l'enfant
-			var childHash [32]byte
-			copy(childHash[:], hashesData[i*32:(i+1)*32])
+	case filesystem.TypeDirectory:
+		// le dossier lui même (pas les sous-blocs d'un BigDirectory, qui ont le même chemin)
+		return job.stream.mkdir(task.Path)
 
-			// appel récursif sans changer le path car on ne s'est pas "déplacer" dans l'arborescence
-			if err := me.Rebuild__file__system(childHash, currentPath); err != nil {
-				return err
-			}
+	case filesystem.TypeChunk:
+		// un chunk au niveau "structure" est un fichier entier
+		if task.Class == ClassStructure {
+			return job.stream.write__whole(task.Path, data[1:])
 		}
+		return job.stream.deliver(me, task.Path, task.Hash, data[1:])
 
-	// si c'est un fichier (chunk ou BigNode, même logique)
-	case filesystem.TypeChunk, filesystem.TypeBig:
-
-		// on crée le fichier en local (ou on l'écrase)
-		file, err := os.Create(currentPath)
-		if err != nil {
-			return fmt.Errorf("erreur création fichier %s: %v", currentPath, err)
+	case filesystem.TypeBig:
+		// le haut d'un fichier : on prépare son écriture
+		if task.Class == ClassStructure {
+			return job.stream.advance(me, job.stream.open(task.Path, task.Hash))
 		}
-		defer file.Close()
-
-		// on appelle notre fonction dédiée au remplissage des fichiers
-		if err := me.rebuild__file__content(nodeHash, file); err != nil {
-			return err
+		// un BigNode intermédiaire : il est dans la Database, on regarde si ça débloque des chunks
+		if f := job.stream.get(task.Path); f != nil {
+			return job.stream.advance(me, f)
 		}
-
-	default:
-		return fmt.Errorf("type de noeud inconnu : %d", nodeType)
 	}
 
 	return nil
 }
 
-// fonction pour remplir les fichiers (appelée par Rebuild__file__system)
-func (me *Me) rebuild__file__content(hash [32]byte, file *os.File) error {
-
-	// on prend le verrou sur la DB
+// renvoie le type d'un noeud si on le connait localement (dans la Database ou grâce à un squelette)
+func (me *Me) Known__node__type(hash [32]byte) (byte, bool) {
 	me.DbLock.Lock()
-	data, exists := me.Database[hash]
-	me.DbLock.Unlock()
+	defer me.DbLock.Unlock()
 
-	// si le chunk qu'on cherche n'existe pas (peu de chance d'arriver au vu de notre implémentation)
-	if !exists {
-		return fmt.Errorf("chunk manquant : %x", hash[:4])
+	if data, exists := me.Database[hash]; exists {
+		return data[0], true
 	}
 
-	// on récupère le type du node (soit chunk soit BigNode)
-	nodeType := data[0]
-
-	// si c'est un chunk
-	switch nodeType {
-
-	// si on est sur une feuille
-	case filesystem.TypeChunk:
-		// on écrit tout sauf le premier octet (le type)
-		_, err := file.Write(data[1:])
-		return err
-
-	// si c'est un BigNode
-	case filesystem.TypeBig:
-
-		// on coupe le type
-		hashesData := data[1:]
-
-		// on va parcourir tout les enfants
-		count := len(hashesData) / 32
-
-		for i := 0; i < count; i++ {
-			// on récupère le hash de l'enfant
-			var childHash [32]byte
-			copy(childHash[:], hashesData[i*32:(i+1)*32])
-
-			// appel récursif pour continuer à écrire à la suite
-			if err := me.rebuild__file__content(childHash, file); err != nil {
-				return err
-			}
-		}
+	nodeType, exists := me.NodeTypes[hash]
+	return nodeType, exists
+}
 
-	default:
-		return fmt.Errorf("type de noeud inconnu (pas forcément inconnu mais problématique) : %d", nodeType)
+// concatène un nom à un chemin distant (toujours avec des "/", quel que soit l'OS)
+func join__remote__path(parent string, name string) string {
+	if parent == "" {
+		return name
 	}
-
-	return nil
+	return parent + "/" + name
 }
 
 // fonctions pour print un arbre
 
 // fonction mère pour print un arbre (le sien ou celui d'un pair)
 func (me *Me) Print__Tree(targetAddr string) {
+	me.Print__Tree__ctx(context.Background(), targetAddr)
+}
+
+// variante de Print__Tree qui peut être annulée via ctx
+func (me *Me) Print__Tree__ctx(ctx context.Context, targetAddr string) {
 
 	var currentRootHash [32]byte
 
@@ -408,7 +550,7 @@ func (me *Me) Print__Tree(targetAddr string) {
 	} else {
 
 		// on demande le roothash au pair spécifié
-		hashBytes, err := me.Send__RootRequest(targetAddr)
+		hashBytes, err := me.Send__RootRequest__ctx(ctx, targetAddr)
 		if err != nil {
 			fmt.Printf("Erreur : Impossible de contacter %s : %v\n", targetAddr, err)
 			return
@@ -417,14 +559,23 @@ func (me *Me) Print__Tree(targetAddr string) {
 		copy(currentRootHash[:], hashBytes)
 	}
 
-	me.recursive__print__tree(currentRootHash, "", targetAddr)
+	me.recursive__print__tree(ctx, currentRootHash, "", targetAddr)
+
+	if ctx.Err() != nil {
+		fmt.Println("affichage de l'arbre interrompu")
+	}
 }
 
 // fonction "fille" pour print le systeme de fichier
-func (me *Me) recursive__print__tree(nodeHash [32]byte, prefix string, targetAddr string) {
+func (me *Me) recursive__print__tree(ctx context.Context, nodeHash [32]byte, prefix string, targetAddr string) {
 
 	// on utilise notre fonction qui récupère les data d'un noeud (auprès d'un pair ou dans notre propre DB)
-	data, err := me.ensureDatum(nodeHash, targetAddr)
+	data, err := me.ensureDatum(ctx, nodeHash, targetAddr)
+
+	// annulation : on remonte sans rien afficher de plus
+	if ctx.Err() != nil {
+		return
+	}
 
 	if err != nil {
 		if targetAddr == "" {
@@ -453,20 +604,27 @@ func (me *Me) recursive__print__tree(nodeHash [32]byte, prefix string, targetAdd
 			var childHash [32]byte
 			copy(childHash[:], entriesData[start+32:start+64])
 
-			// on récupère les data sur l'enfant i
-			childData, err := me.ensureDatum(childHash, targetAddr)
+			// on récupère le type de l'enfant i (localement si possible, sinon auprès du pair)
+			childType, known := me.Known__node__type(childHash)
+			if !known {
+				childData, err := me.ensureDatum(ctx, childHash, targetAddr)
 
-			if err != nil {
-				fmt.Printf("erreur récupération de %s|%s, on arrête \n", prefix, name)
-				return
-			}
+				if ctx.Err() != nil {
+					return
+				}
 
-			childType := childData[0]
+				if err != nil {
+					fmt.Printf("erreur récupération de %s|%s, on arrête \n", prefix, name)
+					return
+				}
+
+				childType = childData[0]
+			}
 
 			// si l'enfant un DIrectory ou un BigDirectory, on continue récursivement
 			if childType == 1 || childType == 3 {
 				fmt.Printf("%s├── %s/\n", prefix, name)
-				me.recursive__print__tree(childHash, prefix+"│   ", targetAddr)
+				me.recursive__print__tree(ctx, childHash, prefix+"│   ", targetAddr)
 			} else {
 				// si c'est un fichieer, on met juste son nom.
 				// on a atteint une feuille de l'arbre (ou un BigNode qui est en quelques sorte une feuille) donc on arrête
@@ -483,13 +641,13 @@ func (me *Me) recursive__print__tree(nodeHash [32]byte, prefix string, targetAdd
 			var childHash [32]byte
 			copy(childHash[:], hashesData[i*hashSize:(i+1)*hashSize])
 
-			me.recursive__print__tree(childHash, prefix, targetAddr)
+			me.recursive__print__tree(ctx, childHash, prefix, targetAddr)
 		}
 	}
 }
 
 // fonction qui récupère les data d'un noeud qu'il soit en local ou pas (que ce soit notre propre systeme de fichier ou celui d'un peer)
-func (me *Me) ensureDatum(hash [32]byte, targetAddr string) ([]byte, error) {
+func (me *Me) ensureDatum(ctx context.Context, hash [32]byte, targetAddr string) ([]byte, error) {
 
 	// on vérifie si on l'a pas déjà localement
 	me.DbLock.Lock()
@@ -508,7 +666,7 @@ func (me *Me) ensureDatum(hash [32]byte, targetAddr string) ([]byte, error) {
 	}
 
 	// sinon, on demande la data au peer
-	askedData, err := me.Send__DatumRequest(targetAddr, hash)
+	askedData, err := me.Send__DatumRequest__ctx(ctx, targetAddr, hash)
 	if err != nil {
 		return nil, err
 	}
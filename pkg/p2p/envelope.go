@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ENVELOPPE CHIFFRÉE
+//
+// Sans enveloppe, seul le body des Datum est chiffré : les hashs des DatumRequest, les RootReply, NoDatum et Ok
+// voyagent en clair et révèlent ce que l'on télécharge.
+// Si les deux pairs annoncent ExtensionEnvelope, une fois l'échange de clés fait, chaque message (sauf ceux du
+// handshake) est entièrement chiffré, signature comprise, et placé dans le body d'un message TypeEncrypted :
+//
+//	Id (4) | Type = 21 (1) | Length (2) | Numéro du message (8) | AES-GCM( message complet ) + Tag (16)
+//
+// L'en-tête (Id, Type, Length) est authentifié comme données associées, et l'Id du message contenu doit être le
+// même : une réponse ne peut pas être déplacée sur une autre requête. Chaque sens a sa clé, et le numéro du message
+// sert de nonce (voir keys.go).
+// Avec un pair qui ne connaît pas l'extension, on garde l'ancien fonctionnement (body des Datum chiffré seul)
+
+// taille ajoutée par l'enveloppe : numéro du message (8) + tag AES-GCM (16)
+const envelopeOverhead = 8 + 16
+
+// les messages qui ne vont jamais dans une enveloppe : ceux qui servent à établir la clef (et l'enveloppe elle-même)
+func sealable(msgType uint8) bool {
+	switch msgType {
+	case TypeHello, TypeHelloReply, TypeKeyExchange, TypeKeyConfirm, TypeEncrypted:
+		return false
+	}
+	return true
+}
+
+// true si les messages de cette session voyagent dans des enveloppes. Le verrou me.Mutex doit être pris
+func (session *PeerSession) uses__envelope() bool {
+	return session.IsEncrypted && session.Extensions&ExtensionEnvelope != 0 && session.keys != nil
+}
+
+// l'en-tête d'une enveloppe : c'est lui qui est authentifié (données associées d'AES-GCM)
+func envelope__header(id uint32, bodyLen int) []byte {
+
+	header := make([]byte, 7)
+	binary.BigEndian.PutUint32(header[0:4], id)
+	header[4] = TypeEncrypted
+	binary.BigEndian.PutUint16(header[5:7], uint16(bodyLen))
+	return header
+}
+
+// met un message (déjà signé s'il doit l'être) dans une enveloppe, chiffrée avec la clé d'envoi (numéro counter)
+func seal__message(send cipher.AEAD, counter uint64, msg Message) Message {
+
+	inner := msg.Serialize()
+	header := envelope__header(msg.Id, len(inner)+envelopeOverhead)
+
+	body := make([]byte, 8, len(inner)+envelopeOverhead)
+	binary.BigEndian.PutUint64(body, counter)
+	body = send.Seal(body, counter__nonce(counter), inner, header)
+
+	return Message{Id: msg.Id, Type: TypeEncrypted, Body: body}
+}
+
+// handler des enveloppes : on déchiffre, puis le message contenu suit le chemin habituel (dispatch)
+func (me *Me) Handle__Encrypted(req *Message, addr *net.UDPAddr, session *PeerSession) {
+
+	counter := binary.BigEndian.Uint64(req.Body[:8])
+	plaintext, err := me.open__envelope(addr, session, envelope__header(req.Id, len(req.Body)), counter, req.Body[8:])
+
+	// on n'a pas (ou plus) de clef avec ce pair : il faut refaire le handshake
+	// (la réponse part en clair : l'émetteur ne pourrait pas la déchiffrer non plus)
+	if errors.Is(err, errNoSessionKey) {
+		fmt.Printf("Message chiffré reçu de %s, mais aucune clef de session. Ignoré.\n", addr)
+		me.send__plain(error__message(req.Id, "encrypted message but no session key, please Handshake (Hello)"), addr)
+		me.resync__key(addr)
+		return
+	}
+	if errors.Is(err, ErrReplay) {
+		// (message en double sur le réseau, ou rejeu : on l'ignore)
+		Verbose_log("Enveloppe de %s ignorée : %v", addr, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Erreur déchiffrement (Encrypted) de %s : %v\n", addr, err)
+		me.send__plain(error__message(req.Id, "cannot decrypt message, please Handshake (Hello)"), addr)
+		me.resync__key(addr)
+		return
+	}
+
+	inner, err := Deserialize(plaintext)
+	if err != nil || inner.Id != req.Id || !sealable(inner.Type) {
+		fmt.Printf("Enveloppe invalide reçue de %s\n", addr)
+		return
+	}
+
+	Verbose_log("%s déchiffré avec succès de %s", msg__type__to__string(inner.Type), addr)
+
+	inner.Sealed = true
+	me.dispatch(inner, addr)
+}
+
+// construit un message Error
+func error__message(id uint32, text string) Message {
+	return Message{Id: id, Type: Error, Body: []byte(text)}
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// les erreurs du protocole : on peut les tester avec errors.Is (ex: errors.Is(err, ErrHelloFirst))
+var (
+	// aucune réponse du pair après tous les essais
+	ErrTimeout = errors.New("aucune réponse du pair (timeout)")
+	// le pair ne nous connaît pas (pas de Hello, ou session oubliée)
+	ErrHelloFirst = errors.New("le pair demande un Hello (please hello first)")
+	// le pair (ou le serveur) ne trouve pas notre clé publique
+	ErrUnknownKey = errors.New("le pair ne trouve pas notre clé publique")
+	// le pair n'a pas pu vérifier la signature de notre message
+	ErrBadSignature = errors.New("signature refusée par le pair (bad signature)")
+	// le pair trouve le body de notre message mal formé
+	ErrInvalidBody = errors.New("body refusé par le pair (taille ou format invalide)")
+	// le pair ne connaît pas ce type de message
+	ErrUnknownType = errors.New("type de message inconnu du pair")
+	// le pair ne possède pas ce noeud
+	ErrNoDatum = errors.New("le pair ne possède pas ce noeud (NoDatum)")
+	// message refusé comme rejeu (id déjà reçu, ou date trop vieille)
+	ErrReplay = errors.New("message rejoué (id déjà reçu ou date hors fenêtre)")
+	// la clef donnée par l'annuaire n'est pas celle retenue au premier contact (voir known.go)
+	ErrKeyChanged = errors.New("clef différente de celle retenue au premier contact")
+	// l'un des deux pairs exige le chiffrement, et la session est en clair (voir policy.go)
+	ErrEncryptionRequired = errors.New("chiffrement exigé, session en clair")
+	// message Error que l'on ne sait pas classer
+	ErrRemote = errors.New("erreur renvoyée par le pair")
+)
+
+// un message Error reçu en réponse à l'une de nos requêtes
+type ProtocolError struct {
+	// le pair qui a répondu
+	Peer string
+	// le texte du message Error, tel que reçu
+	Message string
+	// la catégorie de l'erreur (ErrHelloFirst, ErrBadSignature, ... ou ErrRemote)
+	Kind error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%v (%s : %q)", e.Kind, e.Peer, e.Message)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Kind
+}
+
+// correspondance entre les textes des messages Error (les nôtres et ceux des autres implémentations) et nos erreurs
+// on cherche seulement un morceau du texte : chaque implémentation formule ses messages un peu différemment
+// l'ordre compte : "your key is nowhere to be found, please Handshake (Hello)" doit donner ErrUnknownKey
+var error__patterns = []struct {
+	text string
+	kind error
+}{
+	{"replay", ErrReplay},
+	{"encryption required", ErrEncryptionRequired},
+	{"pinned key", ErrKeyChanged},
+	{"key is nowhere", ErrUnknownKey},
+	{"unknown key", ErrUnknownKey},
+	{"no key", ErrUnknownKey},
+	{"hello first", ErrHelloFirst},
+	// seulement la demande d'un Hello ("please Handshake (Hello)") : "handshake failed" ou "handshake in progress"
+	// ne veulent pas dire que le pair nous a oubliés, un nouveau Hello remettrait sa session à zéro
+	{"please handshake (hello)", ErrHelloFirst},
+	{"unknown peer", ErrHelloFirst},
+	{"bad signature", ErrBadSignature},
+	{"invalid signature", ErrBadSignature},
+	{"unknown message type", ErrUnknownType},
+	{"unknown type", ErrUnknownType},
+	{"invalid", ErrInvalidBody},
+	{"size", ErrInvalidBody},
+	{"format", ErrInvalidBody},
+}
+
+// renvoie la catégorie d'un message Error reçu
+func classify__error(message string) error {
+
+	lower := strings.ToLower(strings.TrimSpace(message))
+
+	for _, pattern := range error__patterns {
+		if strings.Contains(lower, pattern.text) {
+			return pattern.kind
+		}
+	}
+	return ErrRemote
+}
+
+// renvoie true si l'erreur peut se corriger en refaisant un Hello (le pair a oublié notre session ou notre clé)
+func needs__rehello(err error) bool {
+	return errors.Is(err, ErrHelloFirst) || errors.Is(err, ErrUnknownKey)
+}
@@ -0,0 +1,41 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		message string
+		kind    error
+	}{
+		{"please hello first", ErrHelloFirst},
+		{"Please Hello First!", ErrHelloFirst},
+		{"unknown peer", ErrHelloFirst},
+		{"encrypted message but no session key, please Handshake (Hello)", ErrHelloFirst},
+		{"cannot decrypt message, please Handshake (Hello)", ErrHelloFirst},
+		{"your key is nowhere to be found (could be our fault), please Handshake (Hello)", ErrUnknownKey},
+		{"encryption required by policy, please Handshake (Hello) with encryption", ErrEncryptionRequired},
+		{"replayed message", ErrReplay},
+		{"bad signature", ErrBadSignature},
+		{"invalid body size", ErrInvalidBody},
+		// les autres erreurs de l'échange de clés ne demandent pas de Hello
+		{"handshake failed", ErrRemote},
+		{"handshake in progress", ErrRemote},
+		{"something went wrong", ErrRemote},
+	}
+
+	for _, test := range tests {
+		if kind := classify__error(test.message); kind != test.kind {
+			t.Errorf("classify__error(%q) = %v, attendu %v", test.message, kind, test.kind)
+		}
+	}
+
+	if needs__rehello(classify__error("handshake failed")) {
+		t.Error("\"handshake failed\" ne doit pas provoquer de nouveau Hello")
+	}
+	if !errors.Is(&ProtocolError{Kind: classify__error("please hello first")}, ErrHelloFirst) {
+		t.Error("ProtocolError ne se compare pas à son Kind")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
-	"project/pkg/client"
 
 	//"project/pkg/filesystem"
 	"project/pkg/identity"
@@ -14,101 +13,19 @@ import (
 	"time"
 )
 
-// fonction à qui les handler délègue les vérifications de base
-func (me *Me) msg__verifier(req *Message, addr *net.UDPAddr, is_rootRequest bool, is_length_32 bool, verif_needed bool) (*PeerSession, bool) {
-
-	// on prend le verrou sur les session et on récupère les infos sur la session
-	me.Mutex.Lock()
-	session, exists := me.Sessions[addr.String()]
-
-	// si la session n'existe pas
-	if !exists {
-		me.Mutex.Unlock()
-		fmt.Printf("Message (Type %d) reçu de %s, mais pair inconnu. Ignoré.\n", req.Type, addr)
-		me.Handle__if__error(req, addr, "please hello first")
-		return nil, false
-	}
-
-	// si on ne connait pas encore la clef du peer
-	if session.PublicKey == nil {
-		me.Mutex.Unlock()
-		fmt.Printf("Message (Type %d) reçu de %s, mais clé publique inconnue. Ignoré.\n", req.Type, addr)
-		me.Handle__if__error(req, addr, "your key is nowhere to be found (could be our fault), please Handshake (Hello)")
-		return nil, false
-	}
-
-	if !is_rootRequest {
-		if is_length_32 {
-			if len(req.Body) < 32 {
-				fmt.Printf("Message (Type %d) invalide de %s (taille body incorrecte)\n", req.Type, addr)
-
-				me.Handle__if__error(req, addr, "invalid hash size (must be 32 bytes)")
-				return nil, false
-			}
-		} else {
-			if len(req.Body) != 6 && len(req.Body) != 18 {
-				fmt.Printf("Message (Type %d) invalide de %s (taille body incorrecte)\n", req.Type, addr)
-
-				me.Handle__if__error(req, addr, "invalid addr size (must be 6 or 18 bytes)")
-				return nil, false
-			}
-		}
-	}
-
-	if verif_needed {
-
-		serializedMsg := req.Serialize()
-		dataToVerify := serializedMsg[:7+len(req.Body)]
-
-		if !identity.Verify__signature(session.PublicKey, dataToVerify, req.Signature) {
-			me.Mutex.Unlock()
-			fmt.Printf(" Signature invalide pour le message (Type %d) de %s\n", req.Type, addr)
-			me.Handle__if__error(req, addr, "bad signature")
-			return nil, false
-		}
-	}
-
-	// on met à jour le lastseen
-	session.LastSeen = time.Now()
-
-	me.Mutex.Unlock()
-
-	return session, true
-}
-
 // HANDLERS DE GESTION LORS DE LA RECEPTION DE Hello, Ping, Error etc
 
 // Handler pour les messages de type OK
-func (me *Me) Handle__Ok(req *Message, addr *net.UDPAddr) {
-
-	// je prend le verrou sur la map de pipe
-	me.PendingLock.Lock()
-	// je regarde s'il existe bien un pipe qui attend cette réponse
-	respChan, exists := me.PendingRequests[Key__from__Id(req.Id)]
-
-	// si OUI
-	if exists {
+func (me *Me) Handle__Ok(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
-		select {
-
-		// on essaye d'écrire la donnée dans le pipe
-		case respChan <- req.Body:
-
-		// sinon, on delete le pipe
-		default:
-		}
-
-		// on nettoie notre map de pipe car l'ID est unique
-		delete(me.PendingRequests, Key__from__Id(req.Id))
-	}
-	// on lache le verrou
-	me.PendingLock.Unlock()
+	// on transmet la réponse à la requête qui l'attend (même pair, même id)
+	me.Requests.Deliver(addr, req.Id, &Response{Type: TypeOk, Body: req.Body, From: addr, Verified: false})
 
 	Verbose_log("Ok reçu de %s", addr)
 }
 
 // handler pour les hellos (hello et helloReply)
-func (me *Me) Handle__hellos(req *Message, addr *net.UDPAddr) {
+func (me *Me) Handle__hellos(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	isReply := false
 	if req.Type == TypeHelloReply {
@@ -116,33 +33,41 @@ func (me *Me) Handle__hellos(req *Message, addr *net.UDPAddr) {
 	}
 
 	// on récupère le nom de l'emetteur (le nom est placé après les 4octets de bitmap représentants les extensions)
-	if len(req.Body) < 4 {
-		fmt.Println("le message Hello est incorrect")
-
-		if isReply {
-			me.Handle__if__error(req, addr, "invalid helloReply format")
-		} else {
-			me.Handle__if__error(req, addr, "invalid hello format")
-		}
-		return
-	}
+	// (Listen__loop a déjà vérifié que le body fait au moins 4 octets)
 	sender := strings.Trim(string(req.Body[4:]), "\x00")
 
 	// on récupère la clef publique de l'emetteur en la demandant au serveur
-	pubKeyBytes, err := client.Get__publicKey(me.ServerURL, sender)
+	pubKeyBytes, err := me.lookup__key(sender)
 	if err != nil {
 		fmt.Printf("clef de %s introuvable\n", sender)
 
 		me.Handle__if__error(req, addr, "sender's key is nowhere to be found")
 		return
 	}
-	pubKey, _ := identity.Bytes__to__PublicKey(pubKeyBytes)
+	pubKey, err := identity.Bytes__to__PublicKey(pubKeyBytes)
+	if err != nil {
+		fmt.Printf("clef de %s invalide : %v\n", sender, err)
+
+		me.Handle__if__error(req, addr, "sender's key is nowhere to be found")
+		return
+	}
 
-	// Il ne faut pas vérifier tout le message mais seulement le "header" + le body
-	dataToVerify := req.Serialize()[:7+len(req.Body)]
+	// Il ne faut pas vérifier tout le message mais seulement le "header" + le body (+ la date)
+	dataToVerify := req.signed__data()
 
 	// on vérifie
-	if !identity.Verify__signature(pubKey, dataToVerify, req.Signature) {
+	valid := identity.Verify__signature(pubKey, dataToVerify, req.Signature)
+
+	// la clef venait peut-être du cache et le pair en a changé depuis : on la redemande à l'annuaire
+	if !valid {
+		if freshBytes := me.refresh__key(sender, pubKeyBytes); freshBytes != nil {
+			if fresh, err := identity.Bytes__to__PublicKey(freshBytes); err == nil && identity.Verify__signature(fresh, dataToVerify, req.Signature) {
+				pubKey, pubKeyBytes, valid = fresh, freshBytes, true
+			}
+		}
+	}
+
+	if !valid {
 		fmt.Printf("signature invalide recue de %s, message jeté\n", sender)
 
 		// on avertit l'emetteur qu'il y a eu une erreur
@@ -154,6 +79,51 @@ func (me *Me) Handle__hellos(req *Message, addr *net.UDPAddr) {
 		return
 	}
 
+	// un Hello rejoué (depuis une autre adresse) créerait une session au nom de l'émetteur
+	// (un Hello peut ne pas être daté : on ne sait pas forcément si le pair connaît l'extension)
+	if err := me.check__replay(pubKey, req, false); err != nil {
+		me.reject__replay(req, addr, err)
+		return
+	}
+
+	// On lit les extensions du message reçu
+	extensions := binary.BigEndian.Uint32(req.Body[0:4])
+
+	// un Hello non daté d'un pair qui sait dater n'est protégé que par la fenêtre des ids : capturé, il pourrait être
+	// rejoué plus tard depuis une autre adresse. Il ne crée (ni ne déplace) donc pas de session : on y répond, et le
+	// pair, qui voit que nous datons aussi, refait un Hello daté (voir Send__hello__ctx)
+	if req.Timestamp == 0 && extensions&ExtensionTimestamp != 0 {
+		if isReply {
+			// une réponse non datée n'est acceptée que si on attend vraiment une réponse à ce Hello
+			if !me.Requests.Is__pending(addr, req.Id) {
+				fmt.Printf("HelloReply non daté et inattendu de %s, ignoré\n", addr)
+				return
+			}
+		} else {
+			Verbose_log("Hello non daté de %s (%s) : réponse sans session, en attente d'un Hello daté", sender, addr)
+			reply := Message{
+				Id:   req.Id,
+				Type: TypeHelloReply,
+				Body: me.hello__body(me.policy__for__addr(addr)),
+			}
+			me.sign__message(&reply, addr)
+			me.Send__UDP(reply, addr)
+			return
+		}
+	}
+
+	// l'émetteur a bien la clef donnée par l'annuaire : est-ce celle qu'on connaît pour ce nom ?
+	if !me.check__pinned__key(sender, pubKeyBytes) {
+		keyError := "sender's key does not match the pinned key we know for this name"
+		if isReply {
+			// notre Send__hello échoue tout de suite (au lieu d'attendre un timeout)
+			me.Requests.Deliver(addr, req.Id, &Response{Type: Error, Body: []byte(keyError), From: addr})
+		} else {
+			me.Handle__if__error(req, addr, keyError)
+		}
+		return
+	}
+
 	me.Mutex.Lock()
 
 	// on regarde si ce pair existe dans notre liste de pairs actifs
@@ -182,95 +152,69 @@ func (me *Me) Handle__hellos(req *Message, addr *net.UDPAddr) {
 			session.LastSeen = time.Now()
 		} else {
 			// Sécurité au cas où
-			me.Sessions[addr.String()] = &PeerSession{
+			session = &PeerSession{
 				LastSeen:  time.Now(),
 				PublicKey: pubKey,
 			}
+			me.Sessions[addr.String()] = session
 		}
 	}
+	session.Extensions = extensions
+	session.Name = sender
+	policy := me.policy__for__session(session)
 	me.Mutex.Unlock()
 
-	if isReply {
-
-		// je prend le verrou sur la map de pipe
-		me.PendingLock.Lock()
-		// je regarde s'il existe bien un pipe qui attend cette réponse
-		respChan, exists := me.PendingRequests[Key__from__Id((req.Id))]
-
-		// si OUI
-		if exists {
-
-			select {
-
-			// on essaye d'écrire la donnée dans le pipe
-			case respChan <- req.Body:
+	// on prévient celui qui veut savoir qui nous a dit bonjour (le serveur d'annuaire note ainsi les adresses)
+	if me.OnHello != nil {
+		me.OnHello(sender, addr)
+	}
 
-			// sinon, on delete le pipe
-			default:
-			}
+	if isReply {
 
-			// on nettoie notre map de pipe car l'ID est unique
-			delete(me.PendingRequests, Key__from__Id((req.Id)))
-		}
-		// on lache le verrou
-		me.PendingLock.Unlock()
+		// on transmet la réponse à la requête qui l'attend (même pair, même id)
+		me.Requests.Deliver(addr, req.Id, &Response{Type: TypeHelloReply, Body: req.Body, From: addr, Verified: true})
 
 	} else {
 		//reponse
 
-		// on cree le body
-		body := make([]byte, 4+len(me.PeerName))
-
-		var extensions uint32 = 0
-		extensions |= ExtensionNAT
-		extensions |= ExtensionEncryption
-		binary.BigEndian.PutUint32(body[0:4], extensions)
-
-		copy(body[4:], []byte(me.PeerName))
-
 		// on cree la struct Message de la réponse
 		reply := Message{
 			Id:   req.Id,
 			Type: TypeHelloReply,
-			Body: body,
+			Body: me.hello__body(policy),
 		}
 
-		unsignedData := reply.Serialize()
-		sig, _ := identity.Sign(me.PrivateKey, unsignedData)
-		reply.Signature = sig
+		me.sign__message(&reply, addr)
 		me.Send__UDP(reply, addr)
 	}
 
-	// On lit les extensions du message reçu
-	extensions := binary.BigEndian.Uint32(req.Body[0:4])
+	// le pair n'a pas encore de session pour nous (réponse non datée à notre Hello non daté) :
+	// on attend la réponse à notre Hello daté pour échanger les clés
+	pendingDatedHello := isReply && req.Timestamp == 0 && extensions&ExtensionTimestamp != 0
 
-	// On vérifie si le bit Encryption est activé
-	if (extensions & ExtensionEncryption) != 0 {
+	// On vérifie si le bit Encryption est activé (et qu'on veut bien chiffrer avec ce pair)
+	if (extensions&ExtensionEncryption) != 0 && policy != EncryptionOff && !pendingDatedHello {
 		fmt.Printf("%s supporte le chiffrement !\n", sender)
 
-		// On lance l'échange de clés (dans une goroutine pour ne pas bloquer)
-		go me.Send__KeyExchange(addr.String())
+		if extensions&ExtensionEnvelope == 0 {
+			// ancien fonctionnement : chacun envoie sa clé (dans une goroutine pour ne pas bloquer)
+			go me.Send__KeyExchange(addr.String())
+		} else if isReply {
+			// c'est nous qui avons dit bonjour : nous lançons l'échange (voir handshake.go)
+			go me.start__handshake(addr, false)
+		}
 	}
 }
 
-// fonction qui gère la réception d'un ping
-func (me *Me) Handle__ping(req *Message, addr *net.UDPAddr) {
-
-	me.Mutex.Lock()
-	session, exists := me.Sessions[addr.String()]
-
-	if !exists {
-		me.Mutex.Unlock()
-		fmt.Printf("Ping reçu de %s, mais pair inconnu. Ignoré.\n", addr)
-
-		me.Handle__if__error(req, addr, " please hello first")
-		return
-	}
+// fonction qui gère la réception d'un ping (Listen__loop a déjà vérifié qu'on connait l'émetteur)
+func (me *Me) Handle__ping(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
-	// puisqu'on a reçu un message valide d'une session connue, on met à jour le LastSeen
-	session.LastSeen = time.Now()
+	Verbose_log("Ping reçu de %s", addr)
+	me.reply__ok(req, addr)
+}
 
-	me.Mutex.Unlock()
+// répond Ok à une requête
+func (me *Me) reply__ok(req *Message, addr *net.UDPAddr) {
 
 	// on cree la struct Message de la réponse
 	reply := Message{
@@ -279,7 +223,6 @@ func (me *Me) Handle__ping(req *Message, addr *net.UDPAddr) {
 		Body: []byte{},
 	}
 
-	Verbose_log("Ping reçu de %s", addr)
 	me.Send__UDP(reply, addr)
 }
 
@@ -297,46 +240,29 @@ func (me *Me) Handle__if__error(req *Message, addr *net.UDPAddr, errorMsg string
 }
 
 // focntion qui gère les messages d'erreurs recus
-func (me *Me) Handle__error(req *Message, addr *net.UDPAddr) {
+func (me *Me) Handle__error(req *Message, addr *net.UDPAddr, session *PeerSession) {
 	errorMessage := string(req.Body)
 
+	// on transmet l'erreur à la requête qui l'attend (même pair, même id) : c'est elle qui la traitera
+	if me.Requests.Deliver(addr, req.Id, &Response{Type: Error, Body: req.Body, From: addr, Verified: false}) {
+		Verbose_log("Error reçu de %s (Id: %d) : %s (%v)\n", addr, req.Id, errorMessage, classify__error(errorMessage))
+		return
+	}
+
+	// personne n'attendait cette erreur : on l'affiche
 	fmt.Printf("Error recu de %s (Id: %d) :\n", addr, req.Id)
 	fmt.Printf("Message : %s\n", errorMessage)
-
-	// je prend le verrou sur la map de pipe
-	me.PendingLock.Lock()
-	// je regarde s'il existe bien un pipe qui attend cette réponse
-	respChan, exists := me.PendingRequests[Key__from__Id((req.Id))]
-
-	// si OUI
-	if exists {
-
-		select {
-
-		// on essaye d'écrire la donnée dans le pipe
-		case respChan <- req.Body:
-
-		// sinon, on delete le pipe
-		default:
-		}
-
-		// on nettoie notre map de pipe car l'ID est unique
-		delete(me.PendingRequests, Key__from__Id((req.Id)))
-	}
-	// on lache le verrou
-	me.PendingLock.Unlock()
 }
 
 // fonction qui gère les messages RootRequest = une demande d'envoi du roothash (pourrait se nommer Send__RootReply)
-func (me *Me) Handle__RootRequest(req *Message, addr *net.UDPAddr) {
-
-	_, success := me.msg__verifier(req, addr, true, false, false)
-	if !success {
-		return
-	}
+func (me *Me) Handle__RootRequest(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	// le corps de la réponse est simplement le RootHash (32 octets)
-	body := me.RootHash[:]
+	// (copié sous le verrou de la Database : 'load' peut le changer pendant qu'on répond)
+	me.DbLock.Lock()
+	rootHash := me.RootHash
+	me.DbLock.Unlock()
+	body := rootHash[:]
 
 	// on cree la struct Message de la réponse,
 	// L'ID est le même que celui de la requête, et le body est le hash qui sert de réponse
@@ -347,13 +273,10 @@ func (me *Me) Handle__RootRequest(req *Message, addr *net.UDPAddr) {
 	}
 
 	// On signe le message RootReply conformément à la Section 4.3
-	unsignedData := reply.Serialize()
-	sig, err := identity.Sign(me.PrivateKey, unsignedData)
-	if err != nil {
+	if err := me.sign__message(&reply, addr); err != nil {
 		fmt.Println("Erreur signature RootReply:", err)
 		return
 	}
-	reply.Signature = sig
 
 	me.Send__UDP(reply, addr)
 
@@ -361,15 +284,20 @@ func (me *Me) Handle__RootRequest(req *Message, addr *net.UDPAddr) {
 }
 
 // Handler pour les DatumRequest
-func (me *Me) Handle__DatumRequest(req *Message, addr *net.UDPAddr) {
+func (me *Me) Handle__DatumRequest(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
-	session, success := me.msg__verifier(req, addr, false, true, false)
-	if !success {
+	Verbose_log("DatumRequest reçu de %s", addr)
+
+	// nos données ne partent pas en clair vers un pair pour qui on exige le chiffrement
+	me.Mutex.Lock()
+	refused := !session.IsEncrypted && me.policy__for__session(session) == EncryptionRequire
+	me.Mutex.Unlock()
+	if refused {
+		fmt.Printf("DatumRequest de %s refusée : chiffrement exigé, session en clair\n", addr)
+		me.Handle__if__error(req, addr, "encryption required by policy, please Handshake (Hello) with encryption")
 		return
 	}
 
-	Verbose_log("DatumRequest reçu de %s", addr)
-
 	// On récupère le hash demandé
 	var requestedHash [32]byte
 	copy(requestedHash[:], req.Body)
@@ -399,7 +327,12 @@ func (me *Me) Handle__DatumRequest(req *Message, addr *net.UDPAddr) {
 		copy(replyBody[0:32], requestedHash[:])
 		copy(replyBody[32:], data)
 
-		if session.IsEncrypted {
+		// (avec les enveloppes, c'est le message entier qui sera chiffré par Send__UDP)
+		me.Mutex.Lock()
+		encryptBody := session.IsEncrypted && !session.uses__envelope()
+		me.Mutex.Unlock()
+
+		if encryptBody {
 			// On chiffre le tout
 			encryptedBody, err := identity.Encrypt_AES(session.SharedKey, replyBody)
 			if err == nil {
@@ -430,11 +363,7 @@ func (me *Me) Handle__DatumRequest(req *Message, addr *net.UDPAddr) {
 		}
 
 		// on signe le message
-		unsignedData := reply.Serialize()
-		sig, err := identity.Sign(me.PrivateKey, unsignedData)
-
-		if err == nil {
-			reply.Signature = sig
+		if err := me.sign__message(&reply, addr); err == nil {
 			me.Send__UDP(reply, addr)
 			Verbose_log("Envoi d'un NoDatum à %s", addr)
 		}
@@ -442,134 +371,56 @@ func (me *Me) Handle__DatumRequest(req *Message, addr *net.UDPAddr) {
 }
 
 // handler à la reception d'un RootReply
-func (me *Me) Handle__RootReply(req *Message, addr *net.UDPAddr) {
-
-	_, success := me.msg__verifier(req, addr, false, true, true)
-	if !success {
-		return
-	}
+func (me *Me) Handle__RootReply(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	Verbose_log("RootReply reçu de %s", addr)
 
-	// mise à jour du RootHash de notre DataBase
-	copy(me.RootHash[:], req.Body[:32])
-	Verbose_log("roothash mis à jour: %x\n", me.RootHash)
-
-	// je prend le verrou sur la map de pipe
-	me.PendingLock.Lock()
-	// je regarde s'il existe bien un pipe qui attend cette réponse
-	respChan, exists := me.PendingRequests[Key__from__Id(req.Id)]
-
-	// si OUI
-	if exists {
-
-		select {
-
-		// on essaye d'écrire la donnée dans le pipe
-		case respChan <- req.Body:
-
-		// sinon, on delete le pipe
-		default:
-		}
-
-		// on nettoie notre map de pipe car l'ID est unique
-		delete(me.PendingRequests, Key__from__Id(req.Id))
-	}
-	// on lache le verrou
-	me.PendingLock.Unlock()
+	// (c'est la racine du pair : notre RootHash ne change pas)
+	// on transmet la réponse à la requête qui l'attend (même pair, même id)
+	me.Requests.Deliver(addr, req.Id, &Response{Type: TypeRootReply, Body: req.Body, From: addr, Verified: true})
 }
 
 // handler pour les Datum : je redirige vers le pipe qui l'attend
-func (me *Me) Handle__Datum(req *Message, addr *net.UDPAddr) {
+func (me *Me) Handle__Datum(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
-	session, success := me.msg__verifier(req, addr, false, true, false)
-	if !success {
-		return
-	}
+	// (Listen__loop a déjà déchiffré le body si la session est chiffrée)
 
-	if session.IsEncrypted {
-		Verbose_log("Le datum reçu de %s est chiffré.", addr)
-		// Déchiffrement
-		decryptedBody, err := identity.Decrypt_AES(session.SharedKey, req.Body)
-		if err != nil {
-			fmt.Printf("Erreur déchiffrement de %s : %v\n", addr, err)
+	// un Datum en clair (ni dans une enveloppe, ni chiffré par l'ancien fonctionnement) : refusé si on exige le chiffrement
+	if !req.Sealed {
+		me.Mutex.Lock()
+		legacyEncrypted := session.IsEncrypted && !session.uses__envelope()
+		refused := !legacyEncrypted && me.policy__for__session(session) == EncryptionRequire
+		me.Mutex.Unlock()
+		if refused {
+			fmt.Printf("Datum en clair de %s refusé (chiffrement exigé)\n", addr)
 			return
 		}
-
-		Verbose_log("Datum déchiffré avec succès de %s", addr)
-
-		// On "triche" : on modifie le message pour faire croire qu'il était en clair
-		req.Body = decryptedBody
 	}
 
-	// recuperation du hash
+	// recuperation du hash et des data
 	var receivedHash [32]byte
 	copy(receivedHash[:], req.Body[:32])
-
-	// recuperation des data
 	dataContent := req.Body[32:]
 
-	// on prend le verrou sur notre map de pipe et on verifie si l'un d'eux attend ce hash
-	me.PendingLock.Lock()
-	respChan, exists := me.PendingRequests[receivedHash]
-
-	// Si OUI
-	if exists {
-
-		// on essaye d'écrire la donnée dans le pipe
-		select {
-
-		case respChan <- dataContent:
-
-		default:
-
-		}
-		// on nettoie la map
-		delete(me.PendingRequests, receivedHash)
-	}
-	// on lache le verrou
-	me.PendingLock.Unlock()
+	// on transmet le Datum à la requête qui l'attend, en indiquant si son contenu correspond bien au hash annoncé
+	verified := sha256.Sum256(dataContent) == receivedHash
+	me.Requests.Deliver(addr, req.Id, &Response{Type: TypeDatum, Body: req.Body, From: addr, Verified: verified})
 }
 
-func (me *Me) Handle__NoDatum(req *Message, addr *net.UDPAddr) {
-
-	_, success := me.msg__verifier(req, addr, false, true, true)
-	if !success {
-		return
-	}
+func (me *Me) Handle__NoDatum(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	missingHash := req.Body[:32]
 
 	Verbose_log("NoDatum reçu de %s, le peer ne possède pas le hash : %x\n", addr, missingHash[:5])
 
-	// On prépare la clé pour la chercher dans la map
-	var hashArray [32]byte
-	copy(hashArray[:], missingHash)
-
-	// On touche à la map partagée, donc on lock
-	me.PendingLock.Lock()
-	ch, waiting := me.PendingRequests[hashArray]
-
-	if waiting {
-		// Quelqu'un attendait ce fichier via un channel
-		// On supprime l'entrée de la map
-		delete(me.PendingRequests, hashArray)
-
-		// On ferme le channel
-		// Cela va envoyer une valeur "vide" (nil) instantanément à Download_recursively.
-		close(ch)
+	// on prévient la requête qui attendait ce noeud : le téléchargement le notera comme manquant
+	if me.Requests.Deliver(addr, req.Id, &Response{Type: TypeNoDatum, Body: req.Body, From: addr, Verified: true}) {
 		fmt.Printf("échec envoyé au processus de téléchargement.\n")
 	}
-	me.PendingLock.Unlock()
 }
 
 // handlr pour les NatTraversalRequest(1) : A nous demande d'être l'intermédiaire entre lui et B (équivalent à Send__NatTraversalRequest2)
-func (me *Me) Handle__NatTraversalRequest(req *Message, addr *net.UDPAddr) {
-
-	_, success := me.msg__verifier(req, addr, false, false, true)
-	if !success {
-		return
-	}
+func (me *Me) Handle__NatTraversalRequest(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	Verbose_log("NatTraversalRequest reçu de %s", addr)
 
@@ -611,7 +462,7 @@ func (me *Me) Handle__NatTraversalRequest(req *Message, addr *net.UDPAddr) {
 	}
 	// on répond OK à l'emetteur
 	Verbose_log("Envoi d'un Ok à l'intermédiaire\n")
-	me.Handle__ping(req, addr)
+	me.reply__ok(req, addr)
 
 	Verbose_log("Envoi d'un NatTraversalRequest2 à %s\n", targetAddrStr)
 	go func() {
@@ -623,12 +474,7 @@ func (me *Me) Handle__NatTraversalRequest(req *Message, addr *net.UDPAddr) {
 }
 
 // Handler pour les requetes de NatTraversalRequest2 : si on reèoit cette requête, on envoie un ping à l'adresse cible
-func (me *Me) Handle__NatTraversalRequest2(req *Message, addr *net.UDPAddr) {
-
-	_, success := me.msg__verifier(req, addr, false, false, true)
-	if !success {
-		return
-	}
+func (me *Me) Handle__NatTraversalRequest2(req *Message, addr *net.UDPAddr, session *PeerSession) {
 
 	Verbose_log("NatTraversalRequest2 reçu de %s", addr)
 
@@ -649,72 +495,10 @@ func (me *Me) Handle__NatTraversalRequest2(req *Message, addr *net.UDPAddr) {
 	// on assemble Ip et port
 	targetAddrStr := fmt.Sprintf("%s:%d", targetIP.String(), targetPort)
 
-	// il faut envoyer un Ok à l'envoyeur du NatTraversalRequest2, on appelle notre fonction Handle__Ping qui fait exactement ca
+	// il faut envoyer un Ok à l'envoyeur du NatTraversalRequest2
 	Verbose_log("Envoi d'un Ok à l'intermédiaire")
-	me.Handle__ping(req, addr)
+	me.reply__ok(req, addr)
 
 	Verbose_log("Tentative de ping à la cible")
 	go me.Send__ping(targetAddrStr)
 }
-
-func (me *Me) Handle__KeyExchange(req *Message, addr *net.UDPAddr) {
-	// On verrouille pour lire la map des sessions de manière thread-safe
-	me.Mutex.Lock()
-	session, exists := me.Sessions[addr.String()]
-	me.Mutex.Unlock()
-
-	// Cette variable permet de savoir si la clé a déjà été généré.
-	// Si c'est le cas, on a déjà envoyé notre clé, donc on n'en aura plus besoin après cette fonction.
-	// > La même variable existe dans "Send_KeyExchange" dans senders.go
-	isAlreadyDefinedEphemeralPrivKey := false
-
-	if !exists || session.PublicKey == nil {
-		return
-	}
-
-	// On vérifie d'abord la signature du message envoyé
-	dataToVerify := req.Serialize()[:7+len(req.Body)]
-	if !identity.Verify__signature(session.PublicKey, dataToVerify, req.Signature) {
-		fmt.Printf("ALERTE: Signature invalide pour KeyExchange de %s\n", addr)
-		return
-	}
-
-	me.Mutex.Lock()
-	defer me.Mutex.Unlock()
-
-	// Si on reçoit la clé de l'autre AVANT d'avoir décidé d'envoyer la nôtre,
-	// on doit quand même générer notre moitié du secret pour faire le calcul.
-	if session.EphemeralPriv == nil {
-		// On génère la clé, MAIS ON NE L'ENVOIE PAS ICI.
-		// C'est le rôle de Hello/HelloReply de gérer l'envoi.
-		priv, _, err := identity.Generate_Ephemeral_Key()
-		if err != nil {
-			return
-		}
-		session.EphemeralPriv = priv
-	} else {
-		isAlreadyDefinedEphemeralPrivKey = true
-	}
-
-	// Calcul du secret
-	sharedKey, err := identity.Compute_Shared_Secret(session.EphemeralPriv, req.Body)
-	if err != nil {
-		fmt.Printf("Erreur crypto : %v\n", err)
-		return
-	}
-
-	// On enregistre les informations pour la session
-	session.SharedKey = sharedKey
-	session.IsEncrypted = true
-
-	// On garde EphemeralPriv tant que la session est active ou on le supprime
-	// Pour l'instant, on peut le laisser à nil pour dire "c'est fini"
-
-	if isAlreadyDefinedEphemeralPrivKey {
-		session.EphemeralPriv = nil
-	}
-
-	if Verbose {
-		fmt.Printf("SECRET ÉTABLI AVEC %s (Passivement)\n", addr)
-	}
-}
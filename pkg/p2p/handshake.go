@@ -0,0 +1,457 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"project/pkg/identity"
+	"time"
+)
+
+// ÉCHANGE DE CLÉS (handshake)
+//
+// Avec un pair qui connaît ExtensionEnvelope, chaque session suit un automate :
+//
+//	Idle -> Sent (notre clé éphémère est partie) -> Confirming (clés calculées, KeyConfirm envoyé) -> Done
+//
+//   - c'est celui qui a dit bonjour (il reçoit le HelloReply) qui lance l'échange : le pair a déjà créé notre
+//     session, le KeyExchange ne peut donc pas arriver avant elle
+//   - la réponse à un KeyExchange contient notre clé éphémère suivie de celle du pair (64 octets) :
+//     l'initiateur sait à quel échange elle répond, et ignore les réponses à un ancien échange
+//   - si les deux pairs lancent un échange en même temps, celui dont la clé d'identité est la plus petite garde
+//     le sien ; l'autre y répond avec la clé éphémère qu'il avait envoyée
+//   - chacun envoie un KeyConfirm (MAC tiré des clés, voir identity.Derive__session__keys) : on ne chiffre qu'une
+//     fois celui du pair vérifié, ou une enveloppe du pair déchiffrée avec les nouvelles clés
+//   - sans réponse, on renvoie nos messages (après 1s, 2s, 4s...) ; au bout de handshakeMaxAttempts essais
+//     l'échange a échoué, et selon me.HandshakeFailure on continue en clair ou on ferme la session. Un changement
+//     de clé qui échoue garde les clés actuelles (jusqu'à leur limite) : on ne repasse jamais en clair
+//
+// Avec un pair sans ExtensionEnvelope, on garde l'ancien fonctionnement : chacun envoie sa clé après le Hello,
+// et le body des Datum est chiffré (sha256 du secret) dès qu'on a reçu celle du pair
+
+// état de l'échange de clés avec un pair
+type HandshakeState int
+
+const (
+	// aucun échange
+	HandshakeIdle HandshakeState = iota
+	// on a envoyé notre clé éphémère, on attend celle du pair
+	HandshakeSent
+	// clés calculées et KeyConfirm envoyé, on attend la confirmation du pair
+	HandshakeConfirming
+	// les deux pairs ont les mêmes clés
+	HandshakeDone
+	// le pair n'a pas répondu à temps
+	HandshakeFailed
+)
+
+func (s HandshakeState) String() string {
+	switch s {
+	case HandshakeIdle:
+		return "aucun"
+	case HandshakeSent:
+		return "clé envoyée"
+	case HandshakeConfirming:
+		return "confirmation en attente"
+	case HandshakeDone:
+		return "établi"
+	case HandshakeFailed:
+		return "échoué"
+	}
+	return fmt.Sprintf("HandshakeState(%d)", int(s))
+}
+
+// que faire quand un échange de clés n'aboutit pas
+type HandshakeFailurePolicy int
+
+const (
+	// on continue en clair (comme avec un pair qui ne chiffre pas)
+	HandshakeFallbackPlaintext HandshakeFailurePolicy = iota
+	// on ferme la session : le pair devra refaire un Hello
+	HandshakeAbort
+)
+
+const (
+	// premier délai avant de renvoyer nos messages (doublé à chaque essai), si me.HandshakeRetry vaut 0
+	handshakeRetry = time.Second
+	// nombre d'essais avant d'abandonner
+	handshakeMaxAttempts = 5
+	// juste après un échange, des messages chiffrés avec des clés plus anciennes encore (ou en double)
+	// peuvent arriver : on ne relance pas d'échange pour eux
+	handshakeGrace = 5 * time.Second
+)
+
+// un échange de clés avec un pair
+type handshake struct {
+	state HandshakeState
+	// c'est nous qui l'avons lancé
+	initiator bool
+
+	// notre clé éphémère et celle du pair
+	ephemeral     *ecdh.PrivateKey
+	peerEphemeral []byte
+
+	// les clés calculées (installées dans session.keys une fois confirmées)
+	keys *session__keys
+	// KeyConfirm du pair arrivé avant son KeyExchange (vérifié dès qu'on a les clés)
+	earlyConfirm []byte
+
+	// nombre de renvois
+	attempts int
+	// fin de l'échange
+	completed time.Time
+}
+
+// état de l'échange de clés avec addr ("ip:port")
+func (me *Me) Handshake__state(addr string) HandshakeState {
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+
+	session, exists := me.Sessions[addr]
+	if !exists || session.handshake == nil {
+		return HandshakeIdle
+	}
+	return session.handshake.state
+}
+
+// lance un échange de clés dont nous sommes l'initiateur. Rien à faire si un échange est en cours,
+// ou s'il a déjà abouti (sauf force : changement de clé, clés désynchronisées)
+func (me *Me) start__handshake(addr *net.UDPAddr, force bool) error {
+
+	me.Mutex.Lock()
+	session, exists := me.Sessions[addr.String()]
+	if !exists || session.PublicKey == nil {
+		me.Mutex.Unlock()
+		return fmt.Errorf("session inconnue")
+	}
+
+	if hs := session.handshake; hs != nil {
+		if hs.state == HandshakeSent || hs.state == HandshakeConfirming || (hs.state == HandshakeDone && !force) {
+			me.Mutex.Unlock()
+			return nil
+		}
+	}
+
+	priv, pub, err := identity.Generate_Ephemeral_Key()
+	if err != nil {
+		me.Mutex.Unlock()
+		return err
+	}
+	hs := &handshake{state: HandshakeSent, initiator: true, ephemeral: priv}
+	session.handshake = hs
+	me.Mutex.Unlock()
+
+	Verbose_log("échange de clés avec %s (nous commençons)", addr)
+	go me.retransmit__handshake(addr, hs)
+	return me.send__key__exchange(addr, pub, nil)
+}
+
+// handler des KeyExchange (Listen__loop a déjà vérifié la session et la signature du message)
+func (me *Me) Handle__KeyExchange(req *Message, addr *net.UDPAddr, session *PeerSession) {
+
+	peerEphemeral := append([]byte(nil), req.Body[:32]...)
+	// clé éphémère à laquelle le pair répond (absente s'il lance l'échange)
+	var answered []byte
+	if len(req.Body) == 64 {
+		answered = req.Body[32:]
+	}
+
+	me.Mutex.Lock()
+
+	// chiffrement désactivé avec ce pair : il finira par abandonner l'échange
+	if me.policy__for__session(session) == EncryptionOff {
+		me.Mutex.Unlock()
+		Verbose_log("KeyExchange de %s ignoré (chiffrement désactivé avec ce pair)", addr)
+		return
+	}
+
+	if session.Extensions&ExtensionEnvelope == 0 {
+		me.legacy__key__exchange(session, peerEphemeral, addr)
+		me.Mutex.Unlock()
+		return
+	}
+
+	hs := session.handshake
+	reply, confirm, started := false, true, false
+	var err error
+
+	switch {
+	case hs != nil && hs.state == HandshakeSent && answered != nil:
+		if !bytes.Equal(answered, hs.ephemeral.PublicKey().Bytes()) {
+			me.Mutex.Unlock()
+			Verbose_log("KeyExchange de %s : réponse à un ancien échange, ignorée", addr)
+			return
+		}
+		// la réponse à notre échange
+		err = me.derive__handshake__keys(addr, session, hs, peerEphemeral)
+
+	case hs != nil && hs.state == HandshakeSent:
+		// les deux pairs ont commencé en même temps : la plus petite clé d'identité garde son échange
+		if me.is__low__side(session) {
+			me.Mutex.Unlock()
+			Verbose_log("KeyExchange de %s : échanges simultanés, on garde le nôtre", addr)
+			return
+		}
+		hs.initiator = false
+		reply = true
+		err = me.derive__handshake__keys(addr, session, hs, peerEphemeral)
+
+	case hs != nil && (hs.state == HandshakeConfirming || hs.state == HandshakeDone) && bytes.Equal(peerEphemeral, hs.peerEphemeral):
+		// le pair renvoie sa clé : notre réponse ou notre confirmation s'est perdue
+		reply = !hs.initiator
+
+	default:
+		// nouvel échange lancé par le pair (premier échange, changement de clé, pair redémarré...) : on y répond
+		var priv *ecdh.PrivateKey
+		priv, _, err = identity.Generate_Ephemeral_Key()
+		if err == nil {
+			hs = &handshake{state: HandshakeSent, ephemeral: priv}
+			session.handshake = hs
+			reply, started = true, true
+			err = me.derive__handshake__keys(addr, session, hs, peerEphemeral)
+		}
+	}
+
+	if err != nil {
+		me.Mutex.Unlock()
+		fmt.Printf("Erreur crypto : %v\n", err)
+		return
+	}
+
+	ephemeral := hs.ephemeral.PublicKey().Bytes()
+	sendConfirm := hs.keys.sendConfirm
+	me.Mutex.Unlock()
+
+	if started {
+		go me.retransmit__handshake(addr, hs)
+	}
+	if reply {
+		me.send__key__exchange(addr, ephemeral, peerEphemeral)
+	}
+	if confirm {
+		me.send__key__confirm(addr, sendConfirm)
+	}
+}
+
+// handler des KeyConfirm : le pair prouve qu'il a calculé les mêmes clés que nous
+func (me *Me) Handle__KeyConfirm(req *Message, addr *net.UDPAddr, session *PeerSession) {
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+
+	hs := session.handshake
+	if hs == nil {
+		return
+	}
+	if hs.keys == nil {
+		// arrivé avant le KeyExchange du pair (les messages peuvent se doubler) : on le garde pour plus tard
+		Verbose_log("KeyConfirm de %s avant nos clés, gardé", addr)
+		hs.earlyConfirm = append([]byte(nil), req.Body...)
+		return
+	}
+
+	if !hmac.Equal(req.Body, hs.keys.recvConfirm) {
+		// confirmation d'un ancien échange, ou clés différentes : l'échange finira par échouer ou être relancé
+		fmt.Printf("Confirmation de clé invalide de %s, ignorée\n", addr)
+		return
+	}
+
+	if hs.state == HandshakeConfirming {
+		me.complete__handshake(addr, session, hs)
+	}
+}
+
+// calcule les clés de l'échange avec la clé éphémère du pair, et passe en attente de confirmation
+// (ou termine l'échange si la confirmation du pair est déjà là). Le verrou me.Mutex doit être pris
+func (me *Me) derive__handshake__keys(addr *net.UDPAddr, session *PeerSession, hs *handshake, peerEphemeral []byte) error {
+
+	secret, err := identity.ECDH__secret(hs.ephemeral, peerEphemeral)
+	if err != nil {
+		return err
+	}
+
+	keys, err := me.new__session__keys(hs.ephemeral.PublicKey().Bytes(), peerEphemeral, secret, identity.PublicKey__to__bytes(session.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	hs.peerEphemeral = peerEphemeral
+	hs.keys = keys
+	hs.state = HandshakeConfirming
+
+	if hs.earlyConfirm != nil && hmac.Equal(hs.earlyConfirm, keys.recvConfirm) {
+		me.complete__handshake(addr, session, hs)
+	}
+	hs.earlyConfirm = nil
+	return nil
+}
+
+// le pair a confirmé : on chiffre désormais avec les nouvelles clés. Le verrou me.Mutex doit être pris
+func (me *Me) complete__handshake(addr *net.UDPAddr, session *PeerSession, hs *handshake) {
+
+	hs.state = HandshakeDone
+	hs.completed = time.Now()
+
+	// les anciennes clés servent encore un peu à lire les messages envoyés avant le changement
+	if session.keys != nil && session.keys != hs.keys {
+		session.keys.retired = hs.completed
+		session.previous = session.keys
+	}
+	session.keys = hs.keys
+	session.IsEncrypted = true
+
+	if Verbose {
+		fmt.Printf("SECRET ÉTABLI AVEC %s (confirmé)\n", addr)
+	}
+}
+
+// l'échange n'a pas abouti à temps : on applique me.HandshakeFailure. Le verrou me.Mutex doit être pris
+func (me *Me) fail__handshake(addr *net.UDPAddr, session *PeerSession, hs *handshake) {
+
+	hs.state = HandshakeFailed
+
+	// un changement de clé qui échoue ne doit pas nous faire repasser en clair (il suffirait de perdre un message) :
+	// on garde les clés actuelles jusqu'à leur limite (voir next__send__nonce), et on relancera l'échange
+	if session.IsEncrypted && session.keys != nil {
+		session.keys.rekeying = false
+		fmt.Printf("Changement de clé avec %s sans réponse : on garde les clés actuelles\n", addr)
+		return
+	}
+
+	if me.HandshakeFailure == HandshakeAbort || me.policy__for__session(session) == EncryptionRequire {
+		delete(me.Sessions, addr.String())
+		fmt.Printf("Échange de clés avec %s sans réponse : session fermée\n", addr)
+		return
+	}
+
+	session.keys = nil
+	session.previous = nil
+	session.IsEncrypted = false
+	fmt.Printf("Échange de clés avec %s sans réponse : on continue en clair\n", addr)
+}
+
+// renvoie nos messages de l'échange hs tant que le pair n'a pas confirmé, puis abandonne
+func (me *Me) retransmit__handshake(addr *net.UDPAddr, hs *handshake) {
+
+	interval := me.HandshakeRetry
+	if interval == 0 {
+		interval = handshakeRetry
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-me.closed:
+			return
+		}
+		interval *= 2
+
+		me.Mutex.Lock()
+		session, exists := me.Sessions[addr.String()]
+		if !exists || session.handshake != hs || hs.state == HandshakeDone || hs.state == HandshakeFailed {
+			me.Mutex.Unlock()
+			return
+		}
+
+		hs.attempts++
+		if hs.attempts >= handshakeMaxAttempts {
+			me.fail__handshake(addr, session, hs)
+			me.Mutex.Unlock()
+			return
+		}
+
+		ephemeral := hs.ephemeral.PublicKey().Bytes()
+		var answered, sendConfirm []byte
+		if !hs.initiator {
+			answered = hs.peerEphemeral
+		}
+		if hs.keys != nil {
+			sendConfirm = hs.keys.sendConfirm
+		}
+		me.Mutex.Unlock()
+
+		Verbose_log("échange de clés avec %s : renvoi n°%d", addr, hs.attempts)
+		me.send__key__exchange(addr, ephemeral, answered)
+		if sendConfirm != nil {
+			me.send__key__confirm(addr, sendConfirm)
+		}
+	}
+}
+
+// nos clés ne permettent pas de lire ce que le pair nous envoie : on relance un échange
+// (sauf juste après un échange : ce sont sans doute des messages chiffrés avec les clés précédentes)
+func (me *Me) resync__key(addr *net.UDPAddr) {
+
+	me.Mutex.Lock()
+	if session, exists := me.Sessions[addr.String()]; exists && session.handshake != nil {
+		hs := session.handshake
+		if hs.state == HandshakeDone && time.Since(hs.completed) < handshakeGrace {
+			me.Mutex.Unlock()
+			return
+		}
+	}
+	me.Mutex.Unlock()
+
+	go func() {
+		if err := me.start__handshake(addr, true); err != nil {
+			Verbose_log("nouvel échange de clés avec %s impossible : %v", addr, err)
+		}
+	}()
+}
+
+// ancien fonctionnement : une seule clé (sha256 du secret), utilisée dès qu'on a la clé du pair.
+// Le verrou me.Mutex doit être pris
+func (me *Me) legacy__key__exchange(session *PeerSession, peerEphemeral []byte, addr *net.UDPAddr) {
+
+	// Si on reçoit la clé de l'autre AVANT d'avoir envoyé la nôtre, on génère quand même notre moitié du secret
+	// (c'est Hello/HelloReply qui se charge de l'envoyer)
+	hs, err := session.legacy__handshake()
+	if err != nil {
+		return
+	}
+
+	sharedKey, err := identity.Compute_Shared_Secret(hs.ephemeral, peerEphemeral)
+	if err != nil {
+		fmt.Printf("Erreur crypto : %v\n", err)
+		return
+	}
+
+	session.SharedKey = sharedKey
+	session.IsEncrypted = true
+	hs.peerEphemeral = peerEphemeral
+	hs.state = HandshakeDone
+	hs.completed = time.Now()
+
+	if Verbose {
+		fmt.Printf("SECRET ÉTABLI AVEC %s (Passivement)\n", addr)
+	}
+}
+
+// l'échange de l'ancien fonctionnement : notre clé éphémère est gardée tant que la session est active
+// (le pair calcule le secret avec elle). Le verrou me.Mutex doit être pris
+func (session *PeerSession) legacy__handshake() (*handshake, error) {
+
+	if session.handshake != nil && session.handshake.ephemeral != nil {
+		return session.handshake, nil
+	}
+
+	priv, _, err := identity.Generate_Ephemeral_Key()
+	if err != nil {
+		return nil, err
+	}
+	session.handshake = &handshake{state: HandshakeSent, ephemeral: priv}
+	return session.handshake, nil
+}
+
+// true si notre clé d'identité est plus petite que celle du pair (c'est alors notre échange qui est gardé)
+func (me *Me) is__low__side(session *PeerSession) bool {
+
+	pub, err := identity.Extract__PubKey(me.PrivateKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Compare(identity.PublicKey__to__bytes(pub), identity.PublicKey__to__bytes(session.PublicKey)) < 0
+}
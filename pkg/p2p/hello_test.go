@@ -0,0 +1,101 @@
+package p2p_test
+
+import (
+	"encoding/binary"
+	"net"
+	"project/pkg/identity"
+	"project/pkg/p2p"
+	"project/pkg/p2ptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// un Hello de name, signé avec sign, sans date
+func undated__hello(t *testing.T, id uint32, name string, sign func([]byte) ([]byte, error)) []byte {
+	t.Helper()
+
+	body := make([]byte, 4+len(name))
+	binary.BigEndian.PutUint32(body[0:4], p2p.ExtensionNAT|p2p.ExtensionTimestamp|p2p.ExtensionEncryption|p2p.ExtensionEnvelope)
+	copy(body[4:], name)
+
+	msg := p2p.Message{Id: id, Type: p2p.TypeHello, Body: body}
+	sig, err := sign(msg.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Signature = sig
+	return msg.Serialize()
+}
+
+func TestHelloReplayDoesNotRebind(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	// on écoute les Hello d'alice vers bob, comme un attaquant sur le chemin
+	var lock sync.Mutex
+	var captured [][]byte
+	c.Net.SetFilter(func(from, to string, data []byte) bool {
+		if from == alice.Addr && to == bob.Addr && len(data) > 4 && data[4] == p2p.TypeHello {
+			lock.Lock()
+			captured = append(captured, append([]byte(nil), data...))
+			lock.Unlock()
+		}
+		return false
+	})
+
+	c.Hello(alice, bob)
+	c.Net.SetFilter(nil)
+
+	// premier contact : un Hello non daté, puis le Hello daté qui crée la session
+	lock.Lock()
+	hellos := captured
+	lock.Unlock()
+	if len(hellos) < 2 {
+		t.Fatalf("%d Hello capturé(s), attendu au moins 2 (non daté puis daté)", len(hellos))
+	}
+
+	mallory, err := c.Net.Listen("10.0.0.200:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+
+	sign := func(data []byte) ([]byte, error) { return identity.Sign(alice.Key, data) }
+
+	tests := []struct {
+		name  string
+		hello []byte
+	}{
+		{"Hello non daté rejoué", hellos[0]},
+		{"Hello daté rejoué", hellos[len(hellos)-1]},
+		// un id que la fenêtre a oublié : seule l'absence de date peut le trahir
+		{"Hello non daté, id inconnu", undated__hello(t, 0x5eed, alice.Name, sign)},
+	}
+
+	dest, err := net.ResolveUDPAddr("udp", bob.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := mallory.WriteToUDP(test.hello, dest); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			bob.Me.Mutex.Lock()
+			_, rebound := bob.Me.Sessions[mallory.LocalAddr().String()]
+			_, kept := bob.Me.Sessions[alice.Addr]
+			bob.Me.Mutex.Unlock()
+
+			if rebound {
+				t.Fatal("session créée pour l'adresse de l'attaquant")
+			}
+			if !kept {
+				t.Fatal("session d'alice perdue")
+			}
+		})
+	}
+}
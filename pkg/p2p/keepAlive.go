@@ -13,17 +13,33 @@ func (me *Me) Start__maintenance__loop() {
 	// Le timer s'arrêtera lorsque la maintenance_loop s'éteindra
 	defer ticker.Stop()
 
-	for range ticker.C {
-		me.Mutex.Lock()
+	for {
+		// on s'arrête quand notre pair est fermé (Close)
+		select {
+		case <-me.closed:
+			return
+		case <-ticker.C:
+		}
 
-		// boolean
-		ping_server := false
+		// les adresses de nos serveurs (la découverte peut faire une requête HTTP : on le fait avant de prendre le verrou)
+		servers := make(map[string]string)
+		for _, server := range me.Servers() {
+			udpAddr, err := server.UDP__addr()
+			if err != nil {
+				continue
+			}
+			if sAddr, err := net.ResolveUDPAddr("udp", udpAddr); err == nil {
+				servers[sAddr.String()] = udpAddr
+			}
+		}
 
-		sAddr, err := net.ResolveUDPAddr("udp", me.ServerUDPAddr)
-		if err == nil {
-			// s'il existe deja une session avec le serveur alors il faut le prendre en compte dans les keep alive
-			if _, exists := me.Sessions[sAddr.String()]; exists {
-				ping_server = true
+		me.Mutex.Lock()
+
+		// les serveurs avec qui on a déjà une session : il faut les prendre en compte dans les keep alive
+		var ping_servers []string
+		for key, udpAddr := range servers {
+			if _, exists := me.Sessions[key]; exists {
+				ping_servers = append(ping_servers, udpAddr)
 			}
 		}
 
@@ -46,11 +62,18 @@ func (me *Me) Start__maintenance__loop() {
 				go me.Send__ping(addr)
 			}
 		}
+
+		// les clés trop vieilles (même sans trafic, une session peut durer des heures avec les keep-alives)
+		rekeys := me.sessions__to__rekey()
 		me.Mutex.Unlock()
 
-		if ping_server {
-			Verbose_log("Keep-alive : Envoi Hello au serveur")
-			go me.Send__hello(me.ServerUDPAddr)
+		for _, addr := range rekeys {
+			go me.rekey(addr)
+		}
+
+		for _, udpAddr := range ping_servers {
+			Verbose_log("Keep-alive : Envoi Hello au serveur %s", udpAddr)
+			go me.Send__hello(udpAddr)
 		}
 	}
 }
@@ -78,14 +101,48 @@ func (me *Me) List__active__peers() []string {
 			key = fmt.Sprintf("clef publique (signatures) %x...", pubBytes[:32])
 		}
 
-		encryptionStatus := ""
-		if session.IsEncrypted {
-			encryptionStatus = "Chiffrement via échange de clef DH"
+		encryptionStatus := "en clair"
+		if session.uses__envelope() {
+			encryptionStatus = "Chiffrement via échange de clef DH (enveloppes)"
+		} else if session.IsEncrypted {
+			encryptionStatus = "Chiffrement via échange de clef DH (Datum seulement)"
+		} else if session.handshake != nil && session.handshake.state != HandshakeIdle {
+			encryptionStatus = "échange de clef : " + session.handshake.state.String()
 		}
 
-		entry := fmt.Sprintf("- %-25s : %-25s + %s", addr, key, encryptionStatus)
+		entry := fmt.Sprintf("- %-25s %-12s : %-25s + %s [politique %s]", addr, session.Name, key, encryptionStatus, me.policy__for__session(session))
 		activeList = append(activeList, entry)
 	}
 
 	return activeList
 }
+
+// indique si on a une session avec l'adresse addr ("ip:port", résolue comme les clefs de Sessions)
+func (me *Me) Has__session(addr string) bool {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return false
+	}
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	_, exists := me.Sessions[udpAddr.String()]
+	return exists
+}
+
+// renvoie le nom annoncé par le pair à l'adresse addr dans son Hello ("" si on n'a pas de session avec lui)
+func (me *Me) Session__name(addr string) string {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return ""
+	}
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	if session, exists := me.Sessions[udpAddr.String()]; exists {
+		return session.Name
+	}
+	return ""
+}
@@ -0,0 +1,282 @@
+package p2p
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"project/pkg/identity"
+	"time"
+)
+
+// CLÉS DE SESSION (pour les enveloppes, voir envelope.go)
+//
+// Après l'échange de clés, chaque pair a une clé pour envoyer et une autre pour recevoir (identity.Derive__session__keys).
+// Le nonce d'AES-GCM est un compteur : 4 octets à zéro puis le numéro du message (8 octets), qui ne se répète jamais
+// pour une même clé. Le numéro voyage en clair dans l'enveloppe ; à la réception, une fenêtre refuse les numéros déjà vus.
+// Au-delà d'un certain nombre de messages ou d'octets, ou d'une certaine durée, on change de clé (nouvel échange
+// avec de nouvelles clés éphémères, voir handshake.go). Les messages partis avec les anciennes clés pendant le
+// changement arrivent encore : on garde les clés précédentes pour les lire pendant keyOverlap.
+// (avec un pair sans enveloppe, la clé de l'ancien fonctionnement ne change jamais : il ne saurait pas suivre)
+
+const (
+	// changement de clé après ce nombre de messages chiffrés (envoyés + reçus) avec la même clé
+	DefaultRekeyAfterMessages = 1 << 20
+	// ou après ce nombre d'octets
+	DefaultRekeyAfterBytes = 1 << 30
+	// ou après cette durée
+	DefaultRekeyAfter = 15 * time.Minute
+
+	// durée pendant laquelle on lit encore les messages chiffrés avec les clés précédentes
+	keyOverlap = 30 * time.Second
+
+	// nombre de numéros de messages retenus à la réception (les messages peuvent arriver dans le désordre)
+	counterWindow = 1024
+)
+
+// les clés d'une session et leur usage
+type session__keys struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	// numéro du dernier message envoyé (le premier est 1)
+	sendCounter uint64
+	// numéros des messages reçus
+	recvWindow counter__window
+
+	// trafic chiffré avec ces clés (envoyé + reçu)
+	messages uint64
+	bytes    uint64
+
+	// pour la confirmation de clé (KeyConfirm) : ce qu'on envoie, et ce que le pair doit envoyer
+	sendConfirm []byte
+	recvConfirm []byte
+
+	// un changement de clé est en cours
+	rekeying bool
+	created  time.Time
+	// remplacées par de nouvelles clés (on ne s'en sert plus que pour lire, pendant keyOverlap)
+	retired time.Time
+}
+
+// on n'a aucune clé pour lire les enveloppes de ce pair
+var errNoSessionKey = errors.New("aucune clé de session")
+
+// fenêtre glissante des numéros de messages reçus
+type counter__window struct {
+	// plus grand numéro reçu
+	highest uint64
+	// un bit par numéro, pour les counterWindow derniers
+	seen [counterWindow / 64]uint64
+}
+
+// dérive les clés de session à partir de notre clé éphémère et de celle du pair
+func (me *Me) new__session__keys(ephemeral []byte, peerEphemeral []byte, secret []byte, peerIdentity []byte) (*session__keys, error) {
+
+	pub, err := identity.Extract__PubKey(me.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	derived := identity.Derive__session__keys(secret, identity.PublicKey__to__bytes(pub), peerIdentity, ephemeral, peerEphemeral)
+
+	send, err := identity.New__AEAD(derived.Send)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := identity.New__AEAD(derived.Recv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session__keys{send: send, recv: recv, sendConfirm: derived.SendConfirm, recvConfirm: derived.RecvConfirm, created: time.Now()}, nil
+}
+
+// le nonce d'AES-GCM pour un numéro de message
+func counter__nonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// limites de trafic par clé (celles de Me, ou les valeurs par défaut)
+func (me *Me) rekey__limits() (uint64, uint64) {
+
+	messages, bytes := me.RekeyAfterMessages, me.RekeyAfterBytes
+	if messages == 0 {
+		messages = DefaultRekeyAfterMessages
+	}
+	if bytes == 0 {
+		bytes = DefaultRekeyAfterBytes
+	}
+	return messages, bytes
+}
+
+// durée de vie des clés (celle de Me, ou la valeur par défaut)
+func (me *Me) rekey__after() time.Duration {
+	if me.RekeyAfter == 0 {
+		return DefaultRekeyAfter
+	}
+	return me.RekeyAfter
+}
+
+// true s'il faut changer ces clés (une seule fois par clé). Le verrou me.Mutex doit être pris
+func (me *Me) keys__expired(keys *session__keys) bool {
+
+	maxMessages, maxBytes := me.rekey__limits()
+	if keys.rekeying || (keys.messages < maxMessages && keys.bytes < maxBytes && time.Since(keys.created) < me.rekey__after()) {
+		return false
+	}
+	keys.rekeying = true
+	return true
+}
+
+// compte un message chiffré avec ces clés. Renvoie true s'il faut lancer un changement de clé
+// (une seule fois par clé). Le verrou me.Mutex doit être pris
+func (me *Me) account__traffic(keys *session__keys, size int) bool {
+
+	keys.messages++
+	keys.bytes += uint64(size)
+
+	return me.keys__expired(keys)
+}
+
+// les pairs dont les clés ont dépassé leur durée de vie sans trafic pour le remarquer (appelé par la maintenance)
+// Le verrou me.Mutex doit être pris
+func (me *Me) sessions__to__rekey() []*net.UDPAddr {
+
+	var due []*net.UDPAddr
+	for addr, session := range me.Sessions {
+		if !session.uses__envelope() || !me.keys__expired(session.keys) {
+			continue
+		}
+		if udpAddr, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			due = append(due, udpAddr)
+		}
+	}
+	return due
+}
+
+// réserve le numéro du prochain message vers dest et renvoie la clé d'envoi (nil si les messages partent en clair)
+func (me *Me) next__send__nonce(dest *net.UDPAddr, size int) (cipher.AEAD, uint64, error) {
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+
+	session, exists := me.Sessions[dest.String()]
+	if !exists || !session.uses__envelope() {
+		return nil, 0, nil
+	}
+	keys := session.keys
+
+	// la clé a servi deux fois plus que prévu : le changement de clé n'aboutit pas, on arrête de s'en servir
+	maxMessages, maxBytes := me.rekey__limits()
+	if keys.messages >= 2*maxMessages || keys.bytes >= 2*maxBytes {
+		return nil, 0, fmt.Errorf("clé de session avec %s épuisée, changement de clé en attente", dest)
+	}
+
+	keys.sendCounter++
+	if me.account__traffic(keys, size) {
+		go me.rekey(dest)
+	}
+	return keys.send, keys.sendCounter, nil
+}
+
+// déchiffre une enveloppe reçue de addr (numéro du message + données chiffrées)
+// pendant un échange, le pair a peut-être déjà nos nouvelles clés : réussir à déchiffrer avec elles vaut confirmation
+func (me *Me) open__envelope(addr *net.UDPAddr, session *PeerSession, header []byte, counter uint64, ciphertext []byte) ([]byte, error) {
+
+	me.Mutex.Lock()
+	// dans l'ordre : les clés actuelles, celles de l'échange en cours, les précédentes
+	var candidates [3]*session__keys
+	if session.IsEncrypted {
+		candidates[0] = session.keys
+	}
+	hs := session.handshake
+	if hs != nil && hs.state == HandshakeConfirming {
+		candidates[1] = hs.keys
+	}
+	if previous := session.previous; previous != nil && time.Since(previous.retired) < keyOverlap {
+		candidates[2] = previous
+	}
+	me.Mutex.Unlock()
+
+	var keys *session__keys
+	var plaintext []byte
+	err := errNoSessionKey
+	for i, candidate := range candidates {
+		if candidate == nil {
+			continue
+		}
+		plaintext, err = candidate.recv.Open(nil, counter__nonce(counter), ciphertext, header)
+		if err != nil {
+			continue
+		}
+		keys = candidate
+
+		// lu avec les clés de l'échange : le pair les a, c'est une confirmation
+		if i == 1 {
+			me.Mutex.Lock()
+			if session.handshake == hs && hs.state == HandshakeConfirming {
+				me.complete__handshake(addr, session, hs)
+			}
+			me.Mutex.Unlock()
+		}
+		break
+	}
+	if errors.Is(err, errNoSessionKey) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("echec déchiffrement (mauvaise clé ou message altéré): %v", err)
+	}
+
+	// le message est authentique : on vérifie qu'il n'a pas déjà été reçu
+	me.Mutex.Lock()
+	fresh := keys.recvWindow.check__and__set(counter)
+	rekey := fresh && me.account__traffic(keys, len(ciphertext))
+	me.Mutex.Unlock()
+
+	if !fresh {
+		return nil, fmt.Errorf("%w : message chiffré n°%d déjà reçu", ErrReplay, counter)
+	}
+	if rekey {
+		go me.rekey(addr)
+	}
+	return plaintext, nil
+}
+
+// change de clé avec le pair : un nouvel échange dont nous sommes l'initiateur.
+// On garde les clés actuelles jusqu'à ce que le pair confirme les nouvelles
+func (me *Me) rekey(addr *net.UDPAddr) {
+
+	Verbose_log("changement de clé avec %s", addr)
+	if err := me.start__handshake(addr, true); err != nil {
+		fmt.Printf("changement de clé avec %s impossible : %v\n", addr, err)
+	}
+}
+
+// renvoie false si le numéro a déjà été reçu (ou s'il est trop vieux pour le savoir), et le note sinon
+func (w *counter__window) check__and__set(counter uint64) bool {
+
+	// 0 n'est jamais utilisé ; trop vieux : hors de la fenêtre
+	if counter == 0 || counter+counterWindow <= w.highest {
+		return false
+	}
+
+	// numéro plus grand que tous les précédents : on fait glisser la fenêtre (en oubliant les bits réutilisés)
+	if counter > w.highest {
+		for n := w.highest + 1; n <= counter && n <= w.highest+counterWindow; n++ {
+			w.seen[(n%counterWindow)/64] &^= 1 << (n % 64)
+		}
+		w.highest = counter
+	}
+
+	word, bit := (counter%counterWindow)/64, uint64(1)<<(counter%64)
+	if w.seen[word]&bit != 0 {
+		return false
+	}
+	w.seen[word] |= bit
+	return true
+}
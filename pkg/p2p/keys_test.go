@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"project/pkg/identity"
+	"testing"
+	"time"
+)
+
+// des clés de session dont la clé d'envoi est aussi la clé de réception (on peut se lire soi-même)
+func test__session__keys(t *testing.T, seed byte) *session__keys {
+	t.Helper()
+
+	aead, err := identity.New__AEAD(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &session__keys{send: aead, recv: aead, created: time.Now()}
+}
+
+func TestCounterWindow(t *testing.T) {
+	var window counter__window
+
+	// dans l'ordre : chaque numéro reçu, et s'il doit être accepté
+	steps := []struct {
+		counter uint64
+		ok      bool
+	}{
+		{0, false}, // jamais utilisé
+		{1, true},
+		{1, false}, // doublon
+		{5, true},
+		{3, true}, // dans le désordre, mais dans la fenêtre
+		{3, false},
+		{2, true},
+		{2000, true}, // la fenêtre glisse
+		{977, true},  // le plus vieux numéro encore dans la fenêtre
+		{976, false}, // sous la fenêtre
+		{5, false},   // reçu, puis sorti de la fenêtre
+		{1976, true},
+		{3000, true}, // même case que 1976 : la fenêtre l'a oubliée en glissant
+		{1976, false},
+		{3000, false},
+		{1000000, true}, // saut plus grand que la fenêtre
+		{999999, true},
+		{1000000, false},
+		{2999, false},
+	}
+
+	for i, step := range steps {
+		if ok := window.check__and__set(step.counter); ok != step.ok {
+			t.Fatalf("étape %d : numéro %d accepté=%v, attendu %v", i, step.counter, ok, step.ok)
+		}
+	}
+}
+
+func TestOpenEnvelopeKeys(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "10.0.0.1:8000")
+	header := envelope__header(1, 10)
+
+	seal := func(keys *session__keys, counter uint64) []byte {
+		return keys.send.Seal(nil, counter__nonce(counter), []byte("message"), header)
+	}
+
+	tests := []struct {
+		name string
+		// il y a combien de temps les clés précédentes ont été remplacées
+		retired time.Duration
+		// le message est chiffré avec les clés précédentes
+		usePrevious bool
+		ok          bool
+	}{
+		{name: "clés actuelles", ok: true},
+		{name: "clés précédentes, juste après le changement", retired: time.Second, usePrevious: true, ok: true},
+		{name: "clés précédentes, avant la fin du recouvrement", retired: keyOverlap - time.Second, usePrevious: true, ok: true},
+		{name: "clés précédentes, après le recouvrement", retired: keyOverlap + time.Second, usePrevious: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current, previous := test__session__keys(t, 1), test__session__keys(t, 2)
+			previous.retired = time.Now().Add(-test.retired)
+			session := &PeerSession{IsEncrypted: true, Extensions: ExtensionEnvelope, keys: current, previous: previous}
+
+			keys := current
+			if test.usePrevious {
+				keys = previous
+			}
+
+			plaintext, err := (&Me{}).open__envelope(addr, session, header, 1, seal(keys, 1))
+			if test.ok && (err != nil || string(plaintext) != "message") {
+				t.Fatalf("refusé : %q, %v", plaintext, err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("accepté")
+			}
+		})
+	}
+
+	// un message déjà reçu est refusé, même s'il se déchiffre
+	keys := test__session__keys(t, 3)
+	session := &PeerSession{IsEncrypted: true, Extensions: ExtensionEnvelope, keys: keys}
+	me := &Me{}
+
+	if _, err := me.open__envelope(addr, session, header, 7, seal(keys, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := me.open__envelope(addr, session, header, 7, seal(keys, 7)); !errors.Is(err, ErrReplay) {
+		t.Fatalf("doublon : %v, attendu ErrReplay", err)
+	}
+
+	// l'en-tête est authentifié
+	if _, err := me.open__envelope(addr, session, envelope__header(2, 10), 8, seal(keys, 8)); err == nil {
+		t.Fatal("en-tête modifié accepté")
+	}
+}
+
+func TestSendNonceLimit(t *testing.T) {
+	dest, _ := net.ResolveUDPAddr("udp", "10.0.0.1:8000")
+	keys := test__session__keys(t, 1)
+	// le changement de clé n'aboutira jamais : on ne connaît pas la clé du pair
+	keys.rekeying = true
+
+	me := &Me{
+		RekeyAfterMessages: 10,
+		Sessions: map[string]*PeerSession{
+			dest.String(): {IsEncrypted: true, Extensions: ExtensionEnvelope, keys: keys},
+		},
+	}
+
+	// chaque message a un numéro différent, jusqu'à deux fois la limite
+	for expected := uint64(1); expected <= 20; expected++ {
+		_, counter, err := me.next__send__nonce(dest, 100)
+		if err != nil {
+			t.Fatalf("message %d refusé : %v", expected, err)
+		}
+		if counter != expected {
+			t.Fatalf("numéro %d, attendu %d", counter, expected)
+		}
+	}
+
+	// au-delà, on n'envoie plus rien avec cette clé (et le numéro n'avance plus)
+	for i := 0; i < 3; i++ {
+		if _, _, err := me.next__send__nonce(dest, 100); err == nil {
+			t.Fatal("clé utilisée au-delà de sa limite")
+		}
+	}
+	if keys.sendCounter != 20 {
+		t.Fatalf("numéro d'envoi %d après refus, attendu 20", keys.sendCounter)
+	}
+
+	// la limite en octets compte aussi
+	keys = test__session__keys(t, 2)
+	keys.rekeying = true
+	me.RekeyAfterBytes = 1000
+	me.Sessions[dest.String()].keys = keys
+
+	if _, _, err := me.next__send__nonce(dest, 2000); err != nil {
+		t.Fatalf("premier message refusé : %v", err)
+	}
+	if _, _, err := me.next__send__nonce(dest, 10); err == nil {
+		t.Fatal("clé utilisée au-delà de sa limite en octets")
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"fmt"
+	"project/pkg/identity"
+	"strings"
+)
+
+// CLEFS RETENUES (trust on first use, voir identity.KnownPeers)
+//
+// Handle__hellos demande la clef de l'émetteur à l'annuaire. Une fois la signature du Hello vérifiée avec elle,
+// on la compare à celle retenue au premier contact : si l'annuaire en donne une autre, quelqu'un essaie peut-être de
+// se faire passer pour ce pair. On le crie, et selon me.KeyChange on refuse le Hello (le pair reste inconnu tant que
+// l'user n'a pas fait confiance à la nouvelle clef) ou on continue
+
+// que faire quand l'annuaire donne pour un pair une autre clef que celle retenue
+type KeyChangePolicy int
+
+const (
+	// on refuse ses Hello jusqu'à ce que l'user fasse confiance à la nouvelle clef
+	KeyChangeBlock KeyChangePolicy = iota
+	// on prévient seulement
+	KeyChangeWarn
+)
+
+func (p KeyChangePolicy) String() string {
+	switch p {
+	case KeyChangeBlock:
+		return "block"
+	case KeyChangeWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("KeyChangePolicy(%d)", int(p))
+}
+
+// lit "block" ou "warn"
+func Parse__key__change__policy(text string) (KeyChangePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "block":
+		return KeyChangeBlock, nil
+	case "warn":
+		return KeyChangeWarn, nil
+	}
+	return KeyChangeBlock, fmt.Errorf("politique de changement de clef inconnue : %s (block ou warn)", text)
+}
+
+// compare la clef d'un pair (dont la signature vient d'être vérifiée) à celle retenue.
+// Renvoie false s'il faut refuser son Hello
+func (me *Me) check__pinned__key(name string, pubKey []byte) bool {
+
+	// pas de pairs connus (ex: serveur d'annuaire, tests) : on fait confiance à l'annuaire
+	if me.KnownPeers == nil {
+		return true
+	}
+
+	status, pinned, err := me.KnownPeers.Check(name, pubKey)
+	if err != nil {
+		fmt.Printf("pairs connus : écriture impossible : %v\n", err)
+	}
+
+	switch status {
+	case identity.KeyNew:
+		fmt.Printf("Premier contact avec %s : clef retenue (empreinte %s)\n", name, pinned[:16])
+
+	case identity.KeyChanged:
+		blocked := me.KeyChange == KeyChangeBlock
+
+		fmt.Println()
+		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		fmt.Printf("@  ATTENTION : LA CLEF DE %s A CHANGÉ !\n", name)
+		fmt.Println("@  Quelqu'un essaie peut-être de se faire passer pour ce pair (annuaire compromis ?)")
+		fmt.Printf("@  clef retenue       : %s\n", pinned)
+		fmt.Printf("@  clef de l'annuaire : %s\n", identity.Fingerprint(pubKey))
+		if blocked {
+			fmt.Printf("@  Hello refusé. Si le changement est légitime : 'trust %s'\n", name)
+		} else {
+			fmt.Printf("@  On continue quand même (keychange = warn). Pour retenir la nouvelle clef : 'trust %s'\n", name)
+		}
+		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+
+		return !blocked
+	}
+
+	return true
+}
@@ -22,9 +22,17 @@ const (
 	TypeNoDatum    = 133
 
 	TypeKeyExchange = 20
+	// enveloppe chiffrée qui contient un autre message (voir envelope.go)
+	TypeEncrypted = 21
+	// confirmation que les deux pairs ont calculé les mêmes clés (voir handshake.go)
+	TypeKeyConfirm = 22
 
 	ExtensionNAT        = 1
 	ExtensionEncryption = 2
+	// les messages signés portent une date, couverte par la signature (protection contre le rejeu, voir replay.go)
+	ExtensionTimestamp = 4
+	// après l'échange de clés, tous les messages (sauf ceux du handshake) voyagent dans une enveloppe TypeEncrypted
+	ExtensionEnvelope = 8
 )
 
 // structure des messages UDP
@@ -34,17 +42,25 @@ type Message struct {
 	Length    uint16
 	Body      []byte
 	Signature []byte
+	// date d'envoi (millisecondes unix), placée après la signature et couverte par elle. 0 = pas de date
+	Timestamp uint64
+
+	// le message est arrivé dans une enveloppe chiffrée (TypeEncrypted). Pas envoyé sur le réseau
+	Sealed bool
 }
 
 // Pour transformer un message (struct Message) en message (chaine d'octets en binaire)
 func (m *Message) Serialize() []byte {
 
 	// Id + Type + Length = 7 octets
-	// donc le message fait bien 7 + len(Body) + 64 (signature)
+	// donc le message fait bien 7 + len(Body) + 64 (signature) + 8 (date, si ExtensionTimestamp)
 	totalSize := 7 + len(m.Body)
 	if len(m.Signature) != 0 {
 		totalSize += 64
 	}
+	if m.Timestamp != 0 {
+		totalSize += 8
+	}
 
 	data := make([]byte, totalSize)
 
@@ -61,13 +77,28 @@ func (m *Message) Serialize() []byte {
 	copy(data[7:], m.Body)
 
 	// ecriture de la signature
+	offset := 7 + len(m.Body)
 	if len(m.Signature) != 0 {
-		copy(data[7+len(m.Body):], m.Signature)
+		copy(data[offset:], m.Signature)
+		offset += 64
+	}
+
+	// ecriture de la date
+	if m.Timestamp != 0 {
+		binary.BigEndian.PutUint64(data[offset:], m.Timestamp)
 	}
 
 	return data
 }
 
+// les octets couverts par la signature : le "header", le body, et la date s'il y en a une
+// (c'est aussi ce que Serialize renvoie avant que la signature soit ajoutée)
+func (m *Message) signed__data() []byte {
+	unsigned := *m
+	unsigned.Signature = nil
+	return unsigned.Serialize()
+}
+
 // Transformation inverse (chaine d'octets en bianire) to (struct Message)
 func Deserialize(data []byte) (*Message, error) {
 	if len(data) < 7 {
@@ -95,7 +126,13 @@ func Deserialize(data []byte) (*Message, error) {
 		copy(signature, data[7+int(bodyLen):7+int(bodyLen)+64])
 	}
 
-	// tout ce qui vient après la signature est ignoré
+	// puis la date (ExtensionTimestamp)
+	var timestamp uint64
+	if len(data) >= 7+int(bodyLen)+64+8 {
+		timestamp = binary.BigEndian.Uint64(data[7+int(bodyLen)+64:])
+	}
+
+	// tout ce qui vient après est ignoré
 
 	return &Message{
 		Id:        id,
@@ -103,6 +140,7 @@ func Deserialize(data []byte) (*Message, error) {
 		Length:    bodyLen,
 		Body:      body,
 		Signature: signature,
+		Timestamp: timestamp,
 	}, nil
 }
 
@@ -133,7 +171,17 @@ func msg__type__to__string(msgType uint8) string {
 		return "NatTraversalRequest"
 	case TypeNatTraversalRequest2:
 		return "NatTraversalRequest2"
+	case TypeKeyExchange:
+		return "KeyExchange"
+	case TypeEncrypted:
+		return "Encrypted"
+	case TypeKeyConfirm:
+		return "KeyConfirm"
 	default:
+		// type ajouté avec Register__handler
+		if name, exists := custom__type__names.Load(msgType); exists {
+			return name.(string)
+		}
 		return fmt.Sprintf("Unknown(%d)", msgType)
 	}
 }
@@ -1,12 +1,15 @@
 package p2p
 
 import (
-	"crypto/ecdh"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"project/pkg/client"
+	"project/pkg/identity"
 	"sync"
 	"time"
 )
@@ -28,31 +31,100 @@ func LogMsg(format string, a ...interface{}) {
 }
 
 type Me struct {
-	// notre connexion UDP
-	Conn *net.UDPConn
+	// notre connexion UDP (ou tout autre Transport)
+	Conn Transport
 	// notre clef privee
 	PrivateKey *ecdsa.PrivateKey
 	// notre nom
 	PeerName string
-	// url du serveur (pour gagner du temps)
-	ServerURL string
 	// le roothash associé a notre database
 	RootHash [32]byte
 	// notre database
 	Database map[[32]byte][]byte
 	// un verrou posé sur la DB
 	DbLock sync.Mutex
+	// type des noeuds dont on n'a pas gardé le contenu (fichiers vus lors d'un téléchargement de squelette)
+	NodeTypes map[[32]byte]byte
+	// racine du dernier squelette téléchargé pour chaque pair (nom -> roothash, voir skeleton.go)
+	Skeletons map[string][32]byte
+	// dossier où on garde les squelettes (vide : seulement en mémoire)
+	SkeletonDir string
+
+	// Deprecated: URL du serveur principal, gardée pour les anciens appelants (lecture seule, voir Primary__server)
+	ServerURL string
+	// Deprecated: adresse UDP du serveur principal si elle était connue quand il a été ajouté
+	// (lecture seule ; Primary__server().UDP__addr() la découvre au besoin)
+	ServerUDPAddr string
 
-	// pipe: des requetes lancées dans certaines fonctions attendent des reponses qui seront lus par d'autres fonctions. Il nous faut alors des pipe
+	// Deprecated: plus utilisé, les réponses attendues passent par Requests (voir RequestTracker).
+	// Gardé (vide) pour ne pas casser les anciens appelants
 	PendingRequests map[[32]byte]chan []byte
-	// le verrou qui l'accompagne
+	// Deprecated: le verrou qui accompagnait PendingRequests
 	PendingLock sync.Mutex
 
-	// On stocke l'adresse UDP du serveur, celles des peers, et on crée un Mutex pour éviter les conflits entre suppression et màj
-	// ainsi que les adresses IP et ports de chaque peer, associé à la dernière fois qu'on l'a "vu"
-	ServerUDPAddr string
-	Sessions      map[string]*PeerSession
-	Mutex         sync.Mutex
+	// où trouver la clef publique d'un pair (par défaut : on la demande à nos serveurs d'annuaire)
+	PublicKeyLookup func(name string) ([]byte, error)
+	// les clefs et adresses des pairs déjà demandées à l'annuaire (voir client.Cache)
+	Directory *client.Cache
+	// les clefs retenues au premier contact (nil : on fait confiance à l'annuaire, voir known.go)
+	KnownPeers *identity.KnownPeers
+	// que faire quand l'annuaire donne une autre clef que celle retenue (par défaut : on refuse le Hello)
+	KeyChange KeyChangePolicy
+	// appelée après chaque Hello ou HelloReply valide (nom et adresse de l'émetteur)
+	OnHello func(name string, addr *net.UDPAddr)
+
+	// les requêtes qui attendent une réponse, par (pair, id du message)
+	Requests *RequestTracker
+
+	// nombre de workers qui traitent les messages reçus, et de workers pour les messages lents
+	// (à régler avant Listen__loop, DefaultReceiveWorkers et DefaultSlowWorkers si 0)
+	ReceiveWorkers int
+	SlowWorkers    int
+
+	// changement de clé de session après ce nombre de messages ou d'octets chiffrés (0 = DefaultRekeyAfterMessages/Bytes)
+	RekeyAfterMessages uint64
+	RekeyAfterBytes    uint64
+	// ou après cette durée (0 = DefaultRekeyAfter)
+	RekeyAfter time.Duration
+	// que faire quand le pair ne termine pas l'échange de clés (par défaut : on continue en clair)
+	// (avec la politique require, la session est toujours fermée)
+	HandshakeFailure HandshakeFailurePolicy
+	// premier délai avant de renvoyer les messages d'un échange de clés (0 = 1 seconde, doublé à chaque essai)
+	HandshakeRetry time.Duration
+
+	// les handlers des messages reçus, par type (voir Register__handler)
+	handlers map[uint8]*HandlerSpec
+	// le verrou qui l'accompagne
+	handlersLock sync.RWMutex
+
+	// DatumRequests en cours, par (pair, hash) : deux demandes identiques partagent la même requête réseau
+	inflight map[inflight__key]*inflight__call
+	// Hello en cours pour rétablir une session oubliée par le pair, par adresse
+	rehellos map[string]*inflight__call
+	// le verrou qui les accompagne
+	inflightLock sync.Mutex
+
+	// les ids des messages signés déjà reçus, par clef publique du pair (voir replay.go)
+	replays    map[string]*replay__window
+	replayLock sync.Mutex
+
+	// politique de chiffrement globale, et celles propres à un pair (par nom ou clef, voir policy.go)
+	encryption   EncryptionPolicy
+	policies     map[string]EncryptionPolicy
+	policiesLock sync.Mutex
+
+	// les serveurs d'annuaire (voir Add__server), le principal en premier
+	servers     []*DirectoryServer
+	serversLock sync.Mutex
+
+	// On stocke les adresses IP et ports de chaque peer, associé à la dernière fois qu'on l'a "vu"
+	// et on crée un Mutex pour éviter les conflits entre suppression et màj
+	Sessions map[string]*PeerSession
+	Mutex    sync.Mutex
+
+	// fermé par Close
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // Structure pour suivre l'état d'un pair
@@ -60,16 +132,24 @@ type PeerSession struct {
 	// Des informations nécessaires pour le timeout
 	LastSeen  time.Time
 	PublicKey *ecdsa.PublicKey
+	// le nom annoncé dans son Hello
+	Name string
 
 	// Des informations nécessaires pour le handshake Diffie Hellman
-	// La clé AES calculée
+	// La clé AES calculée (ancien fonctionnement : une seule clé, pour le body des Datum)
 	SharedKey []byte
-
-	// La clé privée temporaire pour cet échange
-	EphemeralPriv *ecdh.PrivateKey // Ma clé privée temporaire pour cet échange
-
-	// Pour savoir si le handshake est fini
+	// les clés des enveloppes (une par sens, voir keys.go)
+	keys *session__keys
+	// les clés d'avant le dernier changement de clé (lues encore pendant keyOverlap)
+	previous *session__keys
+	// l'échange de clés en cours ou le dernier (clés éphémères, état, voir handshake.go)
+	handshake *handshake
+
+	// Pour savoir si le handshake est fini (et confirmé par le pair)
 	IsEncrypted bool
+
+	// les extensions annoncées dans le dernier Hello (ou HelloReply) du pair
+	Extensions uint32
 }
 
 func (me *Me) Generate__random__id() uint32 {
@@ -90,15 +170,23 @@ func (me *Me) Generate__random__id() uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
-// convertit une ID (4 octets) en une Key (32 octets) : utile pour notre gestion des timeout message
-func Key__from__Id(id uint32) [32]byte {
-
-	// on crée la variable
-	var key [32]byte
+// clef des DatumRequests en cours : le pair interrogé et le hash demandé
+type inflight__key struct {
+	peer string
+	hash [32]byte
+}
 
-	// on y écrit l'id dans les octets de poids fort
-	binary.BigEndian.PutUint32(key[:4], id)
-	return key
+// une DatumRequest en cours, partagée par tous ceux qui attendent ce hash
+type inflight__call struct {
+	// fermé quand la réponse (ou l'erreur) est disponible
+	done chan struct{}
+	data []byte
+	err  error
+
+	// nombre d'appelants qui attendent encore la réponse
+	waiters int
+	// pour abandonner la requête quand plus personne ne l'attend
+	cancel context.CancelFunc
 }
 
 // fonction pour établir une nouvelle connexion UDP
@@ -116,20 +204,62 @@ func New__communication(port int, priv *ecdsa.PrivateKey, name string, serverURL
 		return nil, err
 	}
 
-	// Adresse UDP du serveur en dur
-	serverUDP := "81.194.30.229:8443"
+	// l'adresse UDP du serveur sera demandée au serveur lui-même
+	return New__communication__on(conn, priv, name, serverURL, ""), nil
+}
+
+// crée notre pair sur un transport déjà ouvert (socket UDP, ou réseau en mémoire pour les tests)
+// serverUDP est l'adresse UDP du serveur (pour les keep-alives et la NAT traversal), découverte via serverURL si vide
+// sans serverURL ni serverUDP, le pair n'a pas de serveur (on peut en ajouter avec Add__server)
+func New__communication__on(tr Transport, priv *ecdsa.PrivateKey, name string, serverURL string, serverUDP string) *Me {
 
 	// on renvoie nos infos dans la structure crée dans ce but
-	return &Me{
-		Conn:            conn,
-		PrivateKey:      priv,
-		PeerName:        name,
-		ServerURL:       serverURL,
+	me := &Me{
+		Conn:       tr,
+		PrivateKey: priv,
+		PeerName:   name,
+		Requests:   New__request__tracker(),
+		Directory:  client.New__cache(),
+		inflight:   make(map[inflight__key]*inflight__call),
+		rehellos:   make(map[string]*inflight__call),
+		replays:    make(map[string]*replay__window),
+		policies:   make(map[string]EncryptionPolicy),
+		Database:   make(map[[32]byte][]byte),
+		NodeTypes:  make(map[[32]byte]byte),
+		Skeletons:  make(map[string][32]byte),
+		Sessions:   make(map[string]*PeerSession),
+		handlers:   make(map[uint8]*HandlerSpec),
+		closed:     make(chan struct{}),
+
+		// (Deprecated, voir Requests)
 		PendingRequests: make(map[[32]byte]chan []byte),
-		Database:        make(map[[32]byte][]byte),
-		ServerUDPAddr:   serverUDP,
-		Sessions:        make(map[string]*PeerSession),
-	}, nil
+	}
+
+	if serverURL != "" || serverUDP != "" {
+		me.Add__server(New__directory__server(serverURL, "", serverUDP))
+	}
+
+	// les messages du protocole (on peut en ajouter d'autres avec Register__handler)
+	me.register__default__handlers()
+
+	return me
+}
+
+// renvoie la clef publique (64 octets) d'un pair
+func (me *Me) lookup__key(name string) ([]byte, error) {
+	if me.PublicKeyLookup != nil {
+		return me.PublicKeyLookup(name)
+	}
+	return me.key__from__servers(name)
+}
+
+// ferme notre pair : Listen__loop et la boucle de maintenance s'arrêtent
+func (me *Me) Close() error {
+
+	me.closeOnce.Do(func() {
+		close(me.closed)
+	})
+	return me.Conn.Close()
 }
 
 // Boucle qui écoute les messages arrivant sur le port définit par la fonction New__communication
@@ -141,12 +271,20 @@ func (me *Me) Listen__loop() {
 	// On lance la maintenant__loop qui gère les timeouts et keepalives
 	go me.Start__maintenance__loop()
 
-	// boucle infinie
+	// les messages sont traités par des workers : la boucle ne fait que lire le port
+	pool := me.start__receive__pool()
+
+	// boucle infinie (jusqu'à Close)
 	for {
 		// n = taille
 		// addr = emetteur
 		n, addr, err := me.Conn.ReadFromUDP(buffer)
 		if err != nil {
+			// le transport a été fermé (Close) : on s'arrête
+			if errors.Is(err, net.ErrClosed) {
+				pool.stop()
+				return
+			}
 			fmt.Println("erreur lecture sur le port:", err)
 			continue
 		}
@@ -161,60 +299,7 @@ func (me *Me) Listen__loop() {
 			Verbose_log("[DEBUG] Received : type: %s, id: %d, addr: %s", msg__type__to__string(msg.Type), msg.Id, addr)
 		}
 
-		// on agit différement selon le Type de message
-		switch msg.Type {
-
-		////////////////
-		// REQUETES
-		////////////////
-
-		case TypePing:
-			me.Handle__ping(msg, addr)
-
-		case TypeHello:
-			me.Handle__hellos(msg, addr)
-
-		case TypeRootRequest:
-			me.Handle__RootRequest(msg, addr)
-
-		case TypeDatumRequest:
-			me.Handle__DatumRequest(msg, addr)
-
-		case TypeNatTraversalRequest2:
-			me.Handle__NatTraversalRequest2(msg, addr)
-
-		case TypeNatTraversalRequest:
-			me.Handle__NatTraversalRequest(msg, addr)
-
-		/////////////
-		// REPONSES
-		/////////////
-
-		case Error:
-			me.Handle__error(msg, addr)
-
-		case TypeHelloReply:
-			me.Handle__hellos(msg, addr)
-
-		case TypeOk:
-			me.Handle__Ok(msg, addr)
-
-		case TypeRootReply:
-			me.Handle__RootReply(msg, addr)
-
-		case TypeNoDatum:
-			me.Handle__NoDatum(msg, addr)
-
-		case TypeDatum:
-			me.Handle__Datum(msg, addr)
-
-		case TypeKeyExchange:
-			me.Handle__KeyExchange(msg, addr)
-
-		// mauvais type
-		default:
-			fmt.Printf("type de message non géré : %d\n", msg.Type)
-			me.Handle__if__error(msg, addr, fmt.Sprintf("unknown message type: %d", msg.Type))
-		}
+		// un worker vérifiera le message selon son type puis appellera le handler enregistré pour ce type
+		pool.submit(msg, addr)
 	}
 }
@@ -0,0 +1,233 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"project/pkg/identity"
+	"strings"
+	"time"
+)
+
+// POLITIQUE DE CHIFFREMENT
+//
+// Par défaut (prefer), on chiffre avec les pairs qui annoncent ExtensionEncryption, et on parle en clair aux autres.
+//   - require : pas de Datum en clair. On refuse les DatumRequest d'un pair sans chiffrement (Error "encryption
+//     required"), on ne télécharge pas depuis lui (ErrEncryptionRequired), et un échange de clés qui échoue ferme la session
+//   - off : on n'annonce pas le chiffrement à ce pair et on ignore ses KeyExchange (pairs de confiance sur un réseau
+//     local, pour économiser le CPU). Prend effet au prochain Hello
+//
+// La politique globale se règle avec Set__default__encryption ; on peut la remplacer pour un pair, désigné par son nom
+// ou par sa clef publique en hexadécimal (la clef l'emporte sur le nom)
+
+// politique de chiffrement avec un pair
+type EncryptionPolicy int
+
+const (
+	// chiffré si le pair sait faire, en clair sinon
+	EncryptionPrefer EncryptionPolicy = iota
+	// toujours chiffré : on refuse d'échanger des données en clair
+	EncryptionRequire
+	// jamais chiffré
+	EncryptionOff
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	case EncryptionOff:
+		return "off"
+	}
+	return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+}
+
+// lit "require", "prefer" ou "off"
+func Parse__encryption__policy(text string) (EncryptionPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	case "off":
+		return EncryptionOff, nil
+	}
+	return EncryptionPrefer, fmt.Errorf("politique de chiffrement inconnue : %s (require, prefer ou off)", text)
+}
+
+// délai laissé à un échange de clés en cours avant de refuser un téléchargement (politique require)
+const encryptionWait = 5 * time.Second
+
+// la clef sous laquelle on range la politique d'un pair : sa clef publique en hexadécimal, ou son nom
+func policy__key(peer string) string {
+
+	peer = strings.TrimSpace(peer)
+	if raw, err := hex.DecodeString(peer); err == nil && len(raw) == 64 {
+		return strings.ToLower(peer)
+	}
+	return peer
+}
+
+// change la politique globale (celle des pairs sans politique propre)
+func (me *Me) Set__default__encryption(policy EncryptionPolicy) {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+	me.encryption = policy
+}
+
+// la politique globale
+func (me *Me) Default__encryption() EncryptionPolicy {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+	return me.encryption
+}
+
+// donne une politique à un pair (nom ou clef publique en hexadécimal)
+func (me *Me) Set__encryption__policy(peer string, policy EncryptionPolicy) {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+	me.policies[policy__key(peer)] = policy
+}
+
+// le pair revient à la politique globale
+func (me *Me) Clear__encryption__policy(peer string) {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+	delete(me.policies, policy__key(peer))
+}
+
+// les politiques propres à un pair (copie)
+func (me *Me) Encryption__policies() map[string]EncryptionPolicy {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+
+	policies := make(map[string]EncryptionPolicy, len(me.policies))
+	for peer, policy := range me.policies {
+		policies[peer] = policy
+	}
+	return policies
+}
+
+// la politique pour un pair dont on connaît le nom et/ou la clef (vides si inconnus)
+func (me *Me) Encryption__policy__for(name string, pubKey []byte) EncryptionPolicy {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+
+	if len(pubKey) > 0 {
+		if policy, exists := me.policies[hex.EncodeToString(pubKey)]; exists {
+			return policy
+		}
+	}
+	if name != "" {
+		if policy, exists := me.policies[name]; exists {
+			return policy
+		}
+	}
+	return me.encryption
+}
+
+// la politique pour le pair d'une session. Le verrou me.Mutex doit être pris
+func (me *Me) policy__for__session(session *PeerSession) EncryptionPolicy {
+
+	var pubKey []byte
+	if session.PublicKey != nil {
+		pubKey = identity.PublicKey__to__bytes(session.PublicKey)
+	}
+	return me.Encryption__policy__for(session.Name, pubKey)
+}
+
+// la politique pour une adresse (la globale si on n'a pas de session avec elle)
+func (me *Me) policy__for__addr(addr *net.UDPAddr) EncryptionPolicy {
+
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+
+	session, exists := me.Sessions[addr.String()]
+	if !exists {
+		return me.Default__encryption()
+	}
+	return me.policy__for__session(session)
+}
+
+// exige-t-on le chiffrement avec au moins un pair ? (globalement, ou pour un pair en particulier)
+func (me *Me) requires__encryption__somewhere() bool {
+
+	me.policiesLock.Lock()
+	defer me.policiesLock.Unlock()
+
+	if me.encryption == EncryptionRequire {
+		return true
+	}
+	for _, policy := range me.policies {
+		if policy == EncryptionRequire {
+			return true
+		}
+	}
+	return false
+}
+
+// avant d'envoyer une requête de données à un pair : avec la politique require, la session doit être chiffrée
+// (si un échange de clés est en cours, on lui laisse le temps de finir).
+// Sans session, on ne sait pas encore qui est le pair (ni donc sa politique) : on fait d'abord un Hello
+func (me *Me) require__encryption(ctx context.Context, addr *net.UDPAddr) error {
+
+	deadline := time.Now().Add(encryptionWait)
+	started, helloed := false, false
+
+	for {
+		me.Mutex.Lock()
+		session, exists := me.Sessions[addr.String()]
+		if !exists {
+			me.Mutex.Unlock()
+
+			if !me.requires__encryption__somewhere() {
+				return nil
+			}
+			if helloed {
+				return fmt.Errorf("%w : pas de session avec %s", ErrEncryptionRequired, addr)
+			}
+			helloed = true
+			if err := me.rehello(ctx, addr.String()); err != nil {
+				return fmt.Errorf("%w : Hello vers %s impossible (%v)", ErrEncryptionRequired, addr, err)
+			}
+			continue
+		}
+		if me.policy__for__session(session) != EncryptionRequire || session.IsEncrypted {
+			me.Mutex.Unlock()
+			return nil
+		}
+		pending := session.handshake != nil && (session.handshake.state == HandshakeSent || session.handshake.state == HandshakeConfirming)
+		canStart := !pending && !started && session.Extensions&ExtensionEnvelope != 0
+		me.Mutex.Unlock()
+
+		// aucun échange en cours, mais le pair sait chiffrer : on en lance un. D'abord un Hello, pour que le pair
+		// connaisse nos extensions actuelles (notre politique avec lui a pu changer depuis le dernier)
+		if canStart {
+			started, pending = true, true
+			if err := me.rehello(ctx, addr.String()); err != nil {
+				pending = false
+			} else if err := me.start__handshake(addr, false); err != nil {
+				pending = false
+			}
+		}
+
+		if !pending || time.Now().After(deadline) {
+			return fmt.Errorf("%w : %s", ErrEncryptionRequired, addr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"project/pkg/filesystem"
+	"sync"
+)
+
+// nombre de fichiers écrits en parallèle par défaut lors d'une reconstruction
+const DefaultRebuildWorkers = 8
+
+// un fichier à écrire : son noeud racine (chunk ou BigNode) et son chemin local
+type rebuild__job struct {
+	hash [32]byte
+	path string
+}
+
+// la place d'un chunk dans son fichier
+type chunk__placement struct {
+	hash   [32]byte
+	offset int64
+}
+
+// fonction qui reconstruit tout un système de fichier à partir de notre Database
+// nodeHash est la racine à reconstruire, currentPath l'endroit où l'écrire
+func (me *Me) Rebuild__file__system(nodeHash [32]byte, currentPath string) error {
+	return me.Rebuild__file__system__with__workers(nodeHash, currentPath, DefaultRebuildWorkers)
+}
+
+// meme fonction, en choisissant le nombre de fichiers écrits en parallèle
+// 1) on crée toute l'arborescence des dossiers et on liste les fichiers
+// 2) des workers écrivent les fichiers, chaque chunk étant placé à son offset (calculé grâce aux BigNode) avec WriteAt
+func (me *Me) Rebuild__file__system__with__workers(nodeHash [32]byte, currentPath string, workers int) error {
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// étape 1 : l'arborescence
+	var jobs []rebuild__job
+	if err := me.rebuild__tree(nodeHash, currentPath, &jobs); err != nil {
+		return err
+	}
+
+	// étape 2 : les fichiers, en parallèle
+	jobsChan := make(chan rebuild__job)
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var errs []error
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobsChan {
+				if err := me.rebuild__file(job); err != nil {
+					errLock.Lock()
+					errs = append(errs, err)
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		jobsChan <- job
+	}
+	close(jobsChan)
+	wg.Wait()
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	if len(errs) > 1 {
+		return fmt.Errorf("%d fichier(s) en erreur, dont : %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+// crée les dossiers sous nodeHash et ajoute dans jobs les fichiers à écrire
+// currentPath est le lieu où on se trouve dans l'arborescence
+func (me *Me) rebuild__tree(nodeHash [32]byte, currentPath string, jobs *[]rebuild__job) error {
+
+	// on prend un verrou sur la DB pour copier les data du node souhaité
+	me.DbLock.Lock()
+	data, exists := me.Database[nodeHash]
+	me.DbLock.Unlock()
+
+	// si le neoud n'existe pas
+	if !exists {
+		return fmt.Errorf("noeud manquant dans la base de données : %x", nodeHash[:4])
+	}
+
+	// switch/case sur le type
+	switch data[0] {
+
+	// SI c'est un Directory
+	case filesystem.TypeDirectory:
+
+		// on crée le dossier sur le disque en local
+		if err := os.MkdirAll(currentPath, 0755); err != nil {
+			return fmt.Errorf("erreur création dossier %s: %v", currentPath, err)
+		}
+
+		// lecture de toutes les entrées : [Nom (32o)] + [Hash (32o)]
+		entriesData := data[1:]
+		count := len(entriesData) / 64
+
+		for i := 0; i < count; i++ {
+			start := i * 64
+
+			// suppréssion du padding sur le nom
+			name := string(bytes.Trim(entriesData[start:start+32], "\x00"))
+
+			// un nom comme ".." nous ferait écrire en dehors du dossier voulu
+			if !Is__safe__name(name) {
+				return fmt.Errorf("nom d'entrée invalide %q dans %s", name, currentPath)
+			}
+
+			var childHash [32]byte
+			copy(childHash[:], entriesData[start+32:start+64])
+
+			if err := me.rebuild__tree(childHash, filepath.Join(currentPath, name), jobs); err != nil {
+				return err
+			}
+		}
+
+	// Si c'est un BigDirectory : on ne se "déplace" pas dans l'arborescence
+	case filesystem.TypeBigDirectory:
+
+		hashesData := data[1:]
+		count := len(hashesData) / 32
+
+		for i := 0; i < count; i++ {
+			var childHash [32]byte
+			copy(childHash[:], hashesData[i*32:(i+1)*32])
+
+			if err := me.rebuild__tree(childHash, currentPath, jobs); err != nil {
+				return err
+			}
+		}
+
+	// si c'est un fichier (chunk ou BigNode), il sera écrit par un worker
+	case filesystem.TypeChunk, filesystem.TypeBig:
+		*jobs = append(*jobs, rebuild__job{hash: nodeHash, path: currentPath})
+
+	default:
+		return fmt.Errorf("type de noeud inconnu : %d", data[0])
+	}
+
+	return nil
+}
+
+// écrit un fichier : on calcule d'abord la place de chaque chunk, puis on les écrit avec WriteAt
+func (me *Me) rebuild__file(job rebuild__job) error {
+
+	var placements []chunk__placement
+	size, err := me.file__layout(job.hash, 0, &placements)
+	if err != nil {
+		return fmt.Errorf("%s : %v", job.path, err)
+	}
+
+	// on crée le fichier en local (ou on l'écrase) à sa taille finale
+	file, err := os.Create(job.path)
+	if err != nil {
+		return fmt.Errorf("erreur création fichier %s: %v", job.path, err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("erreur taille du fichier %s: %v", job.path, err)
+	}
+
+	for _, placement := range placements {
+		me.DbLock.Lock()
+		data := me.Database[placement.hash]
+		me.DbLock.Unlock()
+
+		// on écrit tout sauf le premier octet (le type)
+		if _, err := file.WriteAt(data[1:], placement.offset); err != nil {
+			return fmt.Errorf("erreur écriture %s: %v", job.path, err)
+		}
+	}
+
+	return nil
+}
+
+// parcourt le fichier hash (dans l'ordre) et note l'offset de chaque chunk à partir de offset
+// renvoie l'offset de fin (donc la taille du fichier pour l'appel de départ)
+func (me *Me) file__layout(hash [32]byte, offset int64, placements *[]chunk__placement) (int64, error) {
+
+	me.DbLock.Lock()
+	data, exists := me.Database[hash]
+	me.DbLock.Unlock()
+
+	// si le chunk qu'on cherche n'existe pas (peu de chance d'arriver au vu de notre implémentation)
+	if !exists {
+		return 0, fmt.Errorf("chunk manquant : %x", hash[:4])
+	}
+
+	switch data[0] {
+
+	// si on est sur une feuille
+	case filesystem.TypeChunk:
+		*placements = append(*placements, chunk__placement{hash: hash, offset: offset})
+		return offset + int64(len(data)-1), nil
+
+	// si c'est un BigNode, les enfants se suivent
+	case filesystem.TypeBig:
+		hashesData := data[1:]
+		count := len(hashesData) / 32
+
+		for i := 0; i < count; i++ {
+			var childHash [32]byte
+			copy(childHash[:], hashesData[i*32:(i+1)*32])
+
+			next, err := me.file__layout(childHash, offset, placements)
+			if err != nil {
+				return 0, err
+			}
+			offset = next
+		}
+		return offset, nil
+
+	default:
+		return 0, fmt.Errorf("type de noeud inconnu (pas forcément inconnu mais problématique) : %d", data[0])
+	}
+}
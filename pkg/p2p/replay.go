@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"project/pkg/identity"
+	"time"
+)
+
+// PROTECTION CONTRE LE REJEU
+//
+// une signature prouve qui a écrit un message, pas quand : sans autre précaution, un KeyExchange ou un
+// NatTraversalRequest capturé peut être renvoyé plus tard, et même depuis une autre adresse (après un Hello rejoué).
+// Deux défenses :
+//   - chaque pair (identifié par sa clef, pas par son adresse) a une fenêtre des ids de messages signés déjà reçus :
+//     un id déjà vu est refusé
+//   - si les deux pairs annoncent ExtensionTimestamp dans leur Hello, les messages signés portent leur date d'envoi,
+//     couverte par la signature : un message trop vieux (ou trop dans le futur) est refusé.
+//     La fenêtre garde les ids au moins aussi longtemps qu'une date est acceptée, donc tout rejeu est détecté
+//
+// Le premier Hello vers un pair ne peut pas être daté (on ne sait pas encore s'il connaît l'extension) : seule la
+// fenêtre des ids le protège. Il ne crée donc pas de session chez un pair qui date ses messages : la réponse lui
+// apprend que nous datons aussi, et c'est notre second Hello, daté, qui crée la session (voir Handle__hellos)
+
+const (
+	// écart maximum accepté entre la date d'un message et notre horloge
+	MaxClockSkew = 2 * time.Minute
+	// durée pendant laquelle on se souvient d'un id (une date n'est acceptée que pendant 2*MaxClockSkew)
+	replayRetention = 2 * MaxClockSkew
+	// nombre maximum d'ids retenus par pair (pour les pairs sans dates)
+	replayWindowSize = 4096
+)
+
+// un message signé déjà reçu (une requête et sa réponse ont le même id : on distingue par le type)
+type replay__key struct {
+	id      uint32
+	msgType uint8
+}
+
+// les messages signés récemment reçus d'un pair
+type replay__window struct {
+	seen map[replay__key]time.Time
+	// les mêmes clefs, dans l'ordre d'arrivée (pour oublier les plus vieilles)
+	order []replay__key
+}
+
+// date à mettre dans nos messages signés vers dest : maintenant si le pair date aussi ses messages, 0 sinon
+func (me *Me) timestamp__for(dest *net.UDPAddr) uint64 {
+
+	me.Mutex.Lock()
+	session, exists := me.Sessions[dest.String()]
+	supported := exists && session.Extensions&ExtensionTimestamp != 0
+	me.Mutex.Unlock()
+
+	if !supported {
+		return 0
+	}
+	return uint64(time.Now().UnixMilli())
+}
+
+// date le message (si le destinataire connaît ExtensionTimestamp) puis le signe
+func (me *Me) sign__message(msg *Message, dest *net.UDPAddr) error {
+
+	msg.Timestamp = me.timestamp__for(dest)
+
+	sig, err := identity.Sign(me.PrivateKey, msg.signed__data())
+	if err != nil {
+		return err
+	}
+	msg.Signature = sig
+	return nil
+}
+
+// vérifie qu'un message signé (signature déjà vérifiée) n'est pas rejoué : date récente, id jamais vu pour ce pair
+// requireTimestamp : le pair a annoncé ExtensionTimestamp, un message sans date est donc suspect
+// renvoie une erreur ErrReplay sinon
+func (me *Me) check__replay(pubKey *ecdsa.PublicKey, req *Message, requireTimestamp bool) error {
+
+	now := time.Now()
+
+	if req.Timestamp != 0 {
+		sent := time.UnixMilli(int64(req.Timestamp))
+		if skew := now.Sub(sent); skew > MaxClockSkew || skew < -MaxClockSkew {
+			return fmt.Errorf("%w : date du message hors fenêtre (%v d'écart)", ErrReplay, skew.Round(time.Second))
+		}
+	} else if requireTimestamp {
+		return fmt.Errorf("%w : message sans date alors que le pair utilise ExtensionTimestamp", ErrReplay)
+	}
+
+	peer := string(identity.PublicKey__to__bytes(pubKey))
+	key := replay__key{id: req.Id, msgType: req.Type}
+
+	me.replayLock.Lock()
+	defer me.replayLock.Unlock()
+
+	window, exists := me.replays[peer]
+	if !exists {
+		window = &replay__window{seen: make(map[replay__key]time.Time)}
+		me.replays[peer] = window
+	}
+	window.forget__old(now)
+
+	if _, seen := window.seen[key]; seen {
+		return fmt.Errorf("%w : %s (id %d) déjà reçu", ErrReplay, msg__type__to__string(req.Type), req.Id)
+	}
+
+	window.seen[key] = now
+	window.order = append(window.order, key)
+	return nil
+}
+
+// oublie les ids trop vieux, et les plus anciens si la fenêtre est pleine
+func (w *replay__window) forget__old(now time.Time) {
+
+	drop := 0
+	for drop < len(w.order) {
+		oldest := w.order[drop]
+		if now.Sub(w.seen[oldest]) <= replayRetention && len(w.order)-drop < replayWindowSize {
+			break
+		}
+		delete(w.seen, oldest)
+		drop++
+	}
+	w.order = w.order[drop:]
+}
+
+// refuse un message rejoué : on répond une erreur aux requêtes, on ignore simplement les réponses
+func (me *Me) reject__replay(req *Message, addr *net.UDPAddr, err error) {
+
+	fmt.Printf("Message (%s) de %s refusé : %v\n", msg__type__to__string(req.Type), addr, err)
+
+	if req.Type < 128 {
+		me.Handle__if__error(req, addr, "replayed message (duplicate id or stale timestamp)")
+	}
+}
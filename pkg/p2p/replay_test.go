@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"math"
+	"net"
+	"project/pkg/identity"
+	"testing"
+	"time"
+)
+
+// une paire de clefs pour les tests
+func test__key(t *testing.T) (*ecdsa.PrivateKey, *ecdsa.PublicKey) {
+	t.Helper()
+
+	priv, err := identity.KeyGen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := identity.Extract__PubKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+// date (millisecondes unix) décalée de offset par rapport à maintenant
+func test__timestamp(offset time.Duration) uint64 {
+	return uint64(time.Now().Add(offset).UnixMilli())
+}
+
+func TestCheckReplay(t *testing.T) {
+	_, pub := test__key(t)
+
+	tests := []struct {
+		name string
+		// messages déjà reçus du même pair
+		before []Message
+		msg    Message
+		// le pair date ses messages (ExtensionTimestamp)
+		dated bool
+		ok    bool
+	}{
+		{name: "premier message", msg: Message{Id: 1, Type: TypePing}, ok: true},
+		{name: "id rejoué", before: []Message{{Id: 1, Type: TypePing}}, msg: Message{Id: 1, Type: TypePing}},
+		{name: "même id, autre type (requête et réponse)", before: []Message{{Id: 1, Type: TypePing}}, msg: Message{Id: 1, Type: TypeOk}, ok: true},
+		{name: "id réutilisé par un autre type", before: []Message{{Id: 7, Type: TypeDatumRequest}}, msg: Message{Id: 7, Type: TypeKeyExchange}, ok: true},
+		{name: "id revenu à zéro", before: []Message{{Id: math.MaxUint32, Type: TypePing}}, msg: Message{Id: 0, Type: TypePing}, ok: true},
+		{name: "dernier id, autre type", before: []Message{{Id: math.MaxUint32, Type: TypePing}}, msg: Message{Id: math.MaxUint32, Type: TypeDatum}, ok: true},
+		{name: "date récente", msg: Message{Id: 2, Type: TypePing, Timestamp: test__timestamp(-time.Minute)}, dated: true, ok: true},
+		{name: "vieille date", msg: Message{Id: 2, Type: TypePing, Timestamp: test__timestamp(-MaxClockSkew - time.Minute)}, dated: true},
+		{name: "date dans le futur", msg: Message{Id: 2, Type: TypePing, Timestamp: test__timestamp(MaxClockSkew + time.Minute)}, dated: true},
+		{name: "vieille date d'un pair qui n'annonce pas l'extension", msg: Message{Id: 2, Type: TypePing, Timestamp: test__timestamp(-time.Hour)}},
+		{name: "sans date alors que le pair date", msg: Message{Id: 2, Type: TypePing}, dated: true},
+		{name: "sans date, pair qui ne date pas", msg: Message{Id: 2, Type: TypePing}, ok: true},
+		{name: "date récente mais id rejoué", before: []Message{{Id: 3, Type: TypePing, Timestamp: test__timestamp(0)}}, msg: Message{Id: 3, Type: TypePing, Timestamp: test__timestamp(0)}, dated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			me := &Me{replays: make(map[string]*replay__window)}
+
+			for _, before := range test.before {
+				if err := me.check__replay(pub, &before, test.dated); err != nil {
+					t.Fatalf("message précédent refusé : %v", err)
+				}
+			}
+
+			err := me.check__replay(pub, &test.msg, test.dated)
+			if test.ok && err != nil {
+				t.Fatalf("refusé : %v", err)
+			}
+			if !test.ok && !errors.Is(err, ErrReplay) {
+				t.Fatalf("accepté (%v), attendu ErrReplay", err)
+			}
+		})
+	}
+}
+
+func TestReplayWindowPerPeer(t *testing.T) {
+	_, alice := test__key(t)
+	_, bob := test__key(t)
+	me := &Me{replays: make(map[string]*replay__window)}
+
+	if err := me.check__replay(alice, &Message{Id: 1, Type: TypePing}, false); err != nil {
+		t.Fatal(err)
+	}
+	// la fenêtre est par pair (par clef) : le même id d'un autre pair passe
+	if err := me.check__replay(bob, &Message{Id: 1, Type: TypePing}, false); err != nil {
+		t.Fatalf("id d'un autre pair refusé : %v", err)
+	}
+}
+
+func TestReplayWindowForget(t *testing.T) {
+	now := time.Now()
+	window := &replay__window{seen: make(map[replay__key]time.Time)}
+
+	old := replay__key{id: 1, msgType: TypePing}
+	recent := replay__key{id: 2, msgType: TypePing}
+	window.seen[old] = now.Add(-replayRetention - time.Second)
+	window.seen[recent] = now
+	window.order = []replay__key{old, recent}
+
+	// un id plus vieux que la plus vieille date acceptée est oublié, pas les autres
+	window.forget__old(now)
+	if _, exists := window.seen[old]; exists {
+		t.Error("id trop vieux gardé")
+	}
+	if _, exists := window.seen[recent]; !exists {
+		t.Error("id récent oublié")
+	}
+
+	// la fenêtre ne dépasse pas replayWindowSize ids
+	for i := 0; i < 2*replayWindowSize; i++ {
+		key := replay__key{id: uint32(100 + i), msgType: TypePing}
+		window.seen[key] = now
+		window.order = append(window.order, key)
+		window.forget__old(now)
+	}
+	if len(window.order) >= replayWindowSize || len(window.seen) != len(window.order) {
+		t.Errorf("fenêtre de %d ids (%d dans la map), maximum %d", len(window.order), len(window.seen), replayWindowSize)
+	}
+}
+
+func TestTimestampExtension(t *testing.T) {
+	priv, pub := test__key(t)
+
+	dated, _ := net.ResolveUDPAddr("udp", "10.0.0.1:8000")
+	undated, _ := net.ResolveUDPAddr("udp", "10.0.0.2:8000")
+	me := &Me{
+		PrivateKey: priv,
+		Sessions: map[string]*PeerSession{
+			dated.String():   {Extensions: ExtensionTimestamp},
+			undated.String(): {Extensions: ExtensionEncryption},
+		},
+	}
+
+	// on ne date que les messages vers un pair qui a annoncé l'extension
+	msg := Message{Id: 5, Type: TypePing}
+	if err := me.sign__message(&msg, undated); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Timestamp != 0 {
+		t.Fatalf("message daté vers un pair sans ExtensionTimestamp")
+	}
+
+	msg = Message{Id: 6, Type: TypePing, Body: []byte("corps")}
+	if err := me.sign__message(&msg, dated); err != nil {
+		t.Fatal(err)
+	}
+	if skew := time.Since(time.UnixMilli(int64(msg.Timestamp))); skew < 0 || skew > time.Second {
+		t.Fatalf("date %d, attendu maintenant", msg.Timestamp)
+	}
+
+	// la date voyage après la signature
+	data := msg.Serialize()
+	if len(data) != 7+len(msg.Body)+64+8 {
+		t.Fatalf("%d octets sérialisés, attendu %d", len(data), 7+len(msg.Body)+64+8)
+	}
+	parsed, err := Deserialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Timestamp != msg.Timestamp || !identity.Verify__signature(pub, parsed.signed__data(), parsed.Signature) {
+		t.Fatalf("date %d relue %d, ou signature invalide", msg.Timestamp, parsed.Timestamp)
+	}
+
+	// la date est couverte par la signature : la changer (pour rajeunir un vieux message) la casse
+	parsed.Timestamp++
+	if identity.Verify__signature(pub, parsed.signed__data(), parsed.Signature) {
+		t.Fatal("signature encore valide après changement de la date")
+	}
+}
@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+)
+
+// une réponse reçue à l'une de nos requêtes, transmise par les handlers à celui qui l'attend
+type Response struct {
+	// type du message reçu (TypeOk, Error, TypeDatum, TypeNoDatum, ...)
+	Type uint8
+	// body du message (déjà déchiffré si besoin)
+	Body []byte
+	// le pair qui a répondu
+	From *net.UDPAddr
+	// true si la signature a été vérifiée, ou pour un Datum si son contenu correspond à son hash
+	Verified bool
+}
+
+// clef d'une requête en attente : le pair interrogé et l'id du message
+type request__key struct {
+	peer string
+	id   uint32
+}
+
+// les requêtes qui attendent une réponse : des requetes lancées dans certaines fonctions attendent
+// des reponses qui seront lus par d'autres fonctions (les handlers), il nous faut alors des pipe
+// une réponse n'est transmise que si elle vient du pair interrogé et porte l'id de la requête
+type RequestTracker struct {
+	lock    sync.Mutex
+	pending map[request__key]chan *Response
+}
+
+func New__request__tracker() *RequestTracker {
+	return &RequestTracker{pending: make(map[request__key]chan *Response)}
+}
+
+// on attend une réponse de peer pour le message id : elle arrivera dans respChan
+// plusieurs ids peuvent partager le même pipe (les différents essais d'une même requête)
+func (t *RequestTracker) Register(peer *net.UDPAddr, id uint32, respChan chan *Response) {
+	t.lock.Lock()
+	t.pending[request__key{peer: peer.String(), id: id}] = respChan
+	t.lock.Unlock()
+}
+
+// on n'attend plus de réponse pour ce message
+func (t *RequestTracker) Cancel(peer *net.UDPAddr, id uint32) {
+	t.lock.Lock()
+	delete(t.pending, request__key{peer: peer.String(), id: id})
+	t.lock.Unlock()
+}
+
+// attend-on une réponse de peer pour le message id ?
+func (t *RequestTracker) Is__pending(peer *net.UDPAddr, id uint32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, exists := t.pending[request__key{peer: peer.String(), id: id}]
+	return exists
+}
+
+// transmet une réponse à celui qui l'attend. Renvoie false si personne n'attendait ce message de ce pair
+func (t *RequestTracker) Deliver(from *net.UDPAddr, id uint32, resp *Response) bool {
+
+	key := request__key{peer: from.String(), id: id}
+
+	t.lock.Lock()
+	respChan, exists := t.pending[key]
+	if exists {
+		// l'id est unique : une seule réponse par message
+		delete(t.pending, key)
+	}
+	t.lock.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	select {
+	// on essaye d'écrire la réponse dans le pipe
+	case respChan <- resp:
+		return true
+
+	// le pipe est plein : une réponse à un autre essai de la même requête est déjà arrivée
+	default:
+		return false
+	}
+}
+
+// nombre de requêtes en attente (pour le debug)
+func (t *RequestTracker) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
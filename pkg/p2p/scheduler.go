@@ -0,0 +1,204 @@
+package p2p
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+)
+
+// classes de priorité des tâches : la structure (dossiers) passe avant le contenu (chunks)
+const (
+	// noeud qui peut être un dossier (entrée d'un Directory, enfant d'un BigDirectory) ou le haut d'un fichier
+	ClassStructure = 0
+	// noeud situé sous un BigNode : chunk ou BigNode intermédiaire
+	ClassContent = 1
+)
+
+// une tâche de téléchargement : un noeud à demander au pair
+type DownloadTask struct {
+	// le hash du noeud
+	Hash [32]byte
+	// le chemin (relatif à la racine du pair) du fichier ou dossier auquel appartient le noeud
+	Path string
+	// ClassStructure ou ClassContent
+	Class int
+
+	// position du noeud dans l'arbre (indice de chaque enfant depuis la racine)
+	// comparer ces positions donne l'ordre d'un parcours en profondeur, donc l'ordre des chunks dans un fichier
+	order []int
+	// true si le chemin a été choisi en priorité par l'utilisateur
+	boosted bool
+	// numéro d'arrivée dans la file, pour départager deux tâches identiques
+	seq uint64
+}
+
+// renvoie la tâche d'un enfant de ce noeud (index = position de l'enfant dans le noeud)
+func (task *DownloadTask) child(hash [32]byte, path string, class int, index int) *DownloadTask {
+
+	// on copie la position du parent (on ne doit pas partager le tableau entre frères)
+	order := make([]int, len(task.order)+1)
+	copy(order, task.order)
+	order[len(task.order)] = index
+
+	return &DownloadTask{Hash: hash, Path: path, Class: class, order: order}
+}
+
+// file de priorité des tâches (implémente heap.Interface)
+type task__queue []*DownloadTask
+
+func (q task__queue) Len() int { return len(q) }
+
+func (q task__queue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+
+	// 1) les chemins choisis par l'utilisateur
+	if a.boosted != b.boosted {
+		return a.boosted
+	}
+
+	// 2) les dossiers avant les chunks
+	if a.Class != b.Class {
+		return a.Class < b.Class
+	}
+
+	// 3) l'ordre de l'arbre (donc l'ordre des chunks dans un fichier)
+	for k := 0; k < len(a.order) && k < len(b.order); k++ {
+		if a.order[k] != b.order[k] {
+			return a.order[k] < b.order[k]
+		}
+	}
+	if len(a.order) != len(b.order) {
+		return len(a.order) < len(b.order)
+	}
+
+	// 4) premier arrivé, premier servi
+	return a.seq < b.seq
+}
+
+func (q task__queue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *task__queue) Push(x any) { *q = append(*q, x.(*DownloadTask)) }
+
+func (q *task__queue) Pop() any {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return task
+}
+
+// ordonnanceur d'un téléchargement : les workers piochent toujours la tâche la plus prioritaire
+type download__scheduler struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	queue task__queue
+	// nombre de tâches en cours de traitement par un worker
+	running int
+	// compteur pour DownloadTask.seq
+	nextSeq uint64
+
+	// chemins (ou motifs) à traiter en premier
+	priority []string
+	// écriture au fil de l'eau (nil sinon) : quand trop de chunks y attendent, on ne lance que ceux qu'elle attend
+	stream *stream__writer
+}
+
+func new__download__scheduler(priority []string) *download__scheduler {
+	s := &download__scheduler{priority: priority}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// ajoute une tâche dans la file
+func (s *download__scheduler) push(task *DownloadTask) {
+	s.lock.Lock()
+	task.boosted = s.is__priority(task.Path)
+	task.seq = s.nextSeq
+	s.nextSeq++
+	heap.Push(&s.queue, task)
+	s.cond.Signal()
+	s.lock.Unlock()
+}
+
+// renvoie la prochaine tâche, ou nil quand il n'y a plus rien à faire (file vide et plus personne au travail)
+func (s *download__scheduler) next() *DownloadTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if i := s.pick(); i >= 0 {
+			s.running++
+			return heap.Remove(&s.queue, i).(*DownloadTask)
+		}
+
+		// plus aucun worker qui pourrait ajouter des tâches ou faire avancer l'écriture
+		if s.running == 0 {
+			// plus rien dans la file : c'est fini
+			if s.queue.Len() == 0 {
+				return nil
+			}
+			// les fichiers attendent des chunks qui ont échoué : on lance quand même la tâche la plus prioritaire
+			s.running++
+			return heap.Pop(&s.queue).(*DownloadTask)
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// indice de la tâche à lancer maintenant, ou -1 s'il faut attendre
+// d'habitude c'est la plus prioritaire ; si trop de chunks attendent d'être écrits, c'est la plus prioritaire
+// parmi la structure et les noeuds qu'un fichier attend (ils débloquent l'écriture et libèrent la mémoire)
+func (s *download__scheduler) pick() int {
+
+	if s.queue.Len() == 0 {
+		return -1
+	}
+	if s.stream == nil || s.queue[0].Class == ClassStructure || !s.stream.over__limit() {
+		return 0
+	}
+
+	best := -1
+	for i, task := range s.queue {
+		if task.Class != ClassStructure && !s.stream.awaits(task.Path, task.Hash) {
+			continue
+		}
+		if best < 0 || s.queue.Less(i, best) {
+			best = i
+		}
+	}
+	return best
+}
+
+// un worker a fini sa tâche (les enfants ont déjà été ajoutés dans la file)
+func (s *download__scheduler) done() {
+	s.lock.Lock()
+	s.running--
+	if s.running == 0 && s.queue.Len() == 0 {
+		// on réveille tout le monde pour que les workers s'arrêtent
+		s.cond.Broadcast()
+	} else if s.stream != nil {
+		// la tâche a peut-être fait avancer l'écriture : les tâches mises de côté peuvent repartir
+		s.cond.Broadcast()
+	}
+	s.lock.Unlock()
+}
+
+// renvoie true si le chemin est (ou est dans, ou contient) un des chemins prioritaires
+func (s *download__scheduler) is__priority(path string) bool {
+	for _, prio := range s.priority {
+		prio = strings.Trim(prio, "/")
+
+		if Match__glob(prio, path) || strings.HasPrefix(path, prio+"/") {
+			return true
+		}
+
+		// les dossiers qui mènent à un chemin prioritaire sont prioritaires aussi
+		if path == "" || could__match__below(prio, path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package p2p
+
+import "testing"
+
+// vide la file dans l'ordre où les workers recevraient les tâches
+func drain(s *download__scheduler) []*DownloadTask {
+	var tasks []*DownloadTask
+	for task := s.next(); task != nil; task = s.next() {
+		tasks = append(tasks, task)
+		s.done()
+	}
+	return tasks
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := new__download__scheduler([]string{"docs/important"})
+
+	// dans l'ordre attendu
+	boosted := &DownloadTask{Path: "docs/important/x", Class: ClassContent, order: []int{2, 0, 0}}
+	structure := &DownloadTask{Path: "b", Class: ClassStructure, order: []int{1}}
+	parent := &DownloadTask{Path: "a", Class: ClassContent, order: []int{0}}
+	first := &DownloadTask{Path: "a", Class: ClassContent, order: []int{0, 0}}
+	same := &DownloadTask{Path: "a", Class: ClassContent, order: []int{0, 0}}
+	second := &DownloadTask{Path: "a", Class: ClassContent, order: []int{0, 1}}
+	expected := []*DownloadTask{boosted, structure, parent, first, same, second}
+
+	// ajoutées dans le désordre (first avant same : à position égale, le premier arrivé passe d'abord)
+	for _, task := range []*DownloadTask{second, first, structure, same, boosted, parent} {
+		s.push(task)
+	}
+
+	got := drain(s)
+	if len(got) != len(expected) {
+		t.Fatalf("%d tâches, attendu %d", len(got), len(expected))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("tâche %d : %s %v (classe %d), attendu %s %v (classe %d)", i, got[i].Path, got[i].order, got[i].Class, expected[i].Path, expected[i].order, expected[i].Class)
+		}
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := new__download__scheduler([]string{"photos/**/*.jpg", "docs/a.txt"})
+
+	tests := []struct {
+		path     string
+		priority bool
+	}{
+		{"", true}, // la racine mène à tout
+		{"photos", true},
+		{"photos/2024", true},
+		{"photos/2024/a.jpg", true},
+		// peut être un dossier qui contient des .jpg (on ne connait pas encore son type)
+		{"photos/2024/a.png", true},
+		{"docs", true},
+		{"docs/a.txt", true},
+		{"docs/b.txt", false},
+		{"music", false},
+	}
+
+	for _, test := range tests {
+		if priority := s.is__priority(test.path); priority != test.priority {
+			t.Errorf("is__priority(%q) = %v, attendu %v", test.path, priority, test.priority)
+		}
+	}
+}
+
+func TestSchedulerStreamLimit(t *testing.T) {
+	var awaited, later [32]byte
+	awaited[0], later[0] = 1, 2
+
+	sw := new__stream__writer(t.TempDir())
+	// le fichier attend le noeud awaited (le haut de son parcours)
+	sw.open("big.bin", awaited)
+
+	s := new__download__scheduler(nil)
+	s.stream = sw
+
+	// plus loin dans le fichier, donc moins prioritaire
+	waiting := &DownloadTask{Hash: later, Path: "big.bin", Class: ClassContent, order: []int{0, 0}}
+	needed := &DownloadTask{Hash: awaited, Path: "big.bin", Class: ClassContent, order: []int{0, 5}}
+	s.push(waiting)
+	s.push(needed)
+
+	// sous la limite : l'ordre habituel
+	if i := s.pick(); i < 0 || s.queue[i] != waiting {
+		t.Fatalf("sous la limite : tâche %d choisie, attendu la plus prioritaire", i)
+	}
+
+	// au-dessus : seulement ce que le fichier attend
+	sw.limit = 10
+	sw.pendingBytes.Store(10)
+	if i := s.pick(); i < 0 || s.queue[i] != needed {
+		t.Fatalf("au-dessus de la limite : tâche %d choisie, attendu celle que le fichier attend", i)
+	}
+
+	// la structure passe toujours
+	structure := &DownloadTask{Path: "other", Class: ClassStructure, order: []int{1}}
+	s.push(structure)
+	if i := s.pick(); i < 0 || s.queue[i] != structure {
+		t.Fatalf("au-dessus de la limite : tâche %d choisie, attendu la structure", i)
+	}
+
+	if task := s.next(); task != structure {
+		t.Fatalf("next : %s, attendu la structure", task.Path)
+	}
+	s.done()
+	if task := s.next(); task != needed {
+		t.Fatalf("next : %s %v, attendu la tâche attendue", task.Path, task.order)
+	}
+
+	// un worker est au travail : rien d'autre n'est lancé tant que l'écriture ne se libère pas
+	if i := s.pick(); i != -1 {
+		t.Fatalf("tâche %d choisie, attendu -1 (on attend l'écriture)", i)
+	}
+
+	// plus personne au travail : on lance quand même la tâche restante (sinon tout se bloque)
+	s.done()
+	if task := s.next(); task != waiting {
+		t.Fatalf("next sans worker : %v, attendu la tâche restante", task)
+	}
+	s.done()
+	if task := s.next(); task != nil {
+		t.Fatalf("next sur une file vide : %s, attendu nil", task.Path)
+	}
+}
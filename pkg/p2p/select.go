@@ -0,0 +1,267 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"project/pkg/filesystem"
+	"strings"
+)
+
+// un fichier ou dossier de l'arbre d'un pair, trouvé lors d'une sélection (download avec motifs)
+type RemoteEntry struct {
+	// chemin relatif à la racine, avec des "/"
+	Path string
+	// hash du noeud
+	Hash [32]byte
+	// true si c'est un dossier (Directory ou BigDirectory)
+	IsDir bool
+}
+
+// renvoie true si le motif contient des caractères spéciaux de glob (*, ? ou [)
+func Is__glob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// fonction qui renvoie la liste (nom, hash) de toutes les entrées d'un dossier distant
+// les BigDirectory sont dépliés, on renvoie donc les entrées dans l'ordre
+func (me *Me) List__directory(ctx context.Context, destAddr string, dirHash [32]byte) ([]filesystem.DirEntry, error) {
+
+	data, err := me.ensureDatum(ctx, dirHash, destAddr)
+	if err != nil {
+		return nil, err
+	}
+	// NoDatum : le pair n'a pas (ou plus) ce dossier
+	if len(data) == 0 {
+		return nil, fmt.Errorf("dossier %x : %w", dirHash[:4], ErrNoDatum)
+	}
+	me.cache__node(dirHash, data)
+
+	var entries []filesystem.DirEntry
+
+	switch data[0] {
+
+	case filesystem.TypeDirectory:
+		entriesData := data[1:]
+		count := len(entriesData) / 64
+
+		for i := 0; i < count; i++ {
+			name := string(bytes.Trim(entriesData[i*64:i*64+32], "\x00"))
+
+			var childHash [32]byte
+			copy(childHash[:], entriesData[i*64+32:(i+1)*64])
+
+			entries = append(entries, filesystem.DirEntry{Name: name, Hash: childHash})
+		}
+
+	case filesystem.TypeBigDirectory:
+		hashesData := data[1:]
+		count := len(hashesData) / 32
+
+		for i := 0; i < count; i++ {
+			var childHash [32]byte
+			copy(childHash[:], hashesData[i*32:(i+1)*32])
+
+			// on déplie le sous-bloc, le chemin ne change pas
+			subEntries, err := me.List__directory(ctx, destAddr, childHash)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, subEntries...)
+		}
+
+	default:
+		return nil, fmt.Errorf("le noeud %x n'est pas un dossier (Type %d)", dirHash[:4], data[0])
+	}
+
+	return entries, nil
+}
+
+// fonction qui parcourt les dossiers d'un pair et renvoie tout ce qui correspond à l'un des motifs
+// avec destAddr vide, on ne cherche que localement (par exemple dans un squelette déjà téléchargé)
+// les motifs acceptent *, ?, [...] pour un segment et ** pour un nombre quelconque de dossiers (ex: photos/**/*.jpg)
+// on ne descend que dans les dossiers qui peuvent encore contenir une correspondance
+// un dossier qui correspond est sélectionné en entier (on ne descend pas dedans)
+func (me *Me) Resolve__patterns(ctx context.Context, destAddr string, rootHash [32]byte, patterns []string) ([]RemoteEntry, error) {
+
+	// on nettoie les motifs
+	var cleaned []string
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		// on vérifie que le motif est valide tout de suite (path.Match ne le dit qu'au moment de comparer)
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("motif invalide '%s' : %v", pattern, err)
+			}
+		}
+		cleaned = append(cleaned, pattern)
+	}
+
+	var matches []RemoteEntry
+	err := me.walk__for__patterns(ctx, destAddr, rootHash, "", cleaned, &matches)
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// fonction "fille" de Resolve__patterns : on traite le dossier dirHash situé à dirPath
+func (me *Me) walk__for__patterns(ctx context.Context, destAddr string, dirHash [32]byte, dirPath string, patterns []string, matches *[]RemoteEntry) error {
+
+	entries, err := me.List__directory(ctx, destAddr, dirHash)
+	if err != nil {
+		return fmt.Errorf("lecture du dossier '%s' impossible : %v", dirPath, err)
+	}
+
+	for _, entry := range entries {
+
+		// on ignore les noms qui nous feraient sortir du dossier de téléchargement
+		if !Is__safe__name(entry.Name) {
+			fmt.Printf("nom d'entrée suspect ignoré dans '%s' : %q\n", dirPath, entry.Name)
+			continue
+		}
+
+		childPath := join__remote__path(dirPath, entry.Name)
+
+		matched := false
+		explore := false
+		for _, pattern := range patterns {
+			if Match__glob(pattern, childPath) {
+				matched = true
+			}
+			if could__match__below(pattern, childPath) {
+				explore = true
+			}
+		}
+
+		// rien à voir par ici, inutile de demander quoi que ce soit au pair
+		if !matched && !explore {
+			continue
+		}
+
+		// il nous faut le type de l'enfant (dossier ou fichier), localement si possible (squelette)
+		childType, known := me.Known__node__type(entry.Hash)
+		if !known {
+			childData, err := me.ensureDatum(ctx, entry.Hash, destAddr)
+			if err != nil {
+				return fmt.Errorf("lecture de '%s' impossible : %v", childPath, err)
+			}
+			if len(childData) == 0 {
+				return fmt.Errorf("lecture de '%s' impossible : %w", childPath, ErrNoDatum)
+			}
+			me.cache__node(entry.Hash, childData)
+			childType = childData[0]
+		}
+
+		isDir := childType == filesystem.TypeDirectory || childType == filesystem.TypeBigDirectory
+
+		if matched {
+			*matches = append(*matches, RemoteEntry{Path: childPath, Hash: entry.Hash, IsDir: isDir})
+			continue
+		}
+
+		if isDir {
+			if err := me.walk__for__patterns(ctx, destAddr, entry.Hash, childPath, patterns, matches); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renvoie true si le chemin (relatif, avec des "/") correspond au motif
+func Match__glob(pattern string, pathStr string) bool {
+	return match__segments(strings.Split(pattern, "/"), strings.Split(pathStr, "/"))
+}
+
+// comparaison segment par segment, ** correspond à 0 ou plusieurs segments
+func match__segments(pattern []string, parts []string) bool {
+
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+
+	if pattern[0] == "**" {
+		// on essaie de faire "manger" 0, 1, 2... segments au **
+		for i := 0; i <= len(parts); i++ {
+			if match__segments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+
+	return match__segments(pattern[1:], parts[1:])
+}
+
+// renvoie true si quelque chose situé sous le dossier dirPath peut correspondre au motif
+func could__match__below(pattern string, dirPath string) bool {
+	return prefix__matches(strings.Split(pattern, "/"), strings.Split(dirPath, "/"))
+}
+
+// meme logique que match__segments, mais on s'arrête dès que le chemin est épuisé et que le motif ne l'est pas
+func prefix__matches(pattern []string, parts []string) bool {
+
+	if len(parts) == 0 {
+		// il reste au moins un segment dans le motif : un enfant peut correspondre
+		return len(pattern) > 0
+	}
+
+	if len(pattern) == 0 {
+		return false
+	}
+
+	if pattern[0] == "**" {
+		// ** peut absorber tout ce qui reste du chemin
+		return true
+	}
+
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+
+	return prefix__matches(pattern[1:], parts[1:])
+}
+
+// renvoie false pour les noms d'entrées qui permettraient de sortir du dossier de destination
+func Is__safe__name(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\")
+}
+
+// garde en mémoire un noeud reçu lors d'un parcours (seulement la structure : pas les chunks)
+func (me *Me) cache__node(hash [32]byte, data []byte) {
+
+	// on ne garde que ce qui correspond bien au hash
+	if len(data) == 0 || sha256.Sum256(data) != hash {
+		return
+	}
+
+	me.DbLock.Lock()
+	if data[0] == filesystem.TypeChunk {
+		// pour un chunk, on retient seulement qu'il s'agit d'un fichier
+		me.NodeTypes[hash] = data[0]
+	} else {
+		me.Database[hash] = data
+	}
+	me.DbLock.Unlock()
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+
+		// ** correspond à 0, 1 ou plusieurs segments
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/c", false},
+		{"a/**/b", "a/b/c", false},
+		{"**/*.jpg", "a.jpg", true},
+		{"**/*.jpg", "photos/2024/a.jpg", true},
+		{"**/*.jpg", "photos/a.png", false},
+
+		// ** à la fin : le dossier lui même et tout ce qu'il contient
+		{"docs/**", "docs", true},
+		{"docs/**", "docs/a", true},
+		{"docs/**", "docs/a/b/c", true},
+		{"docs/**", "other/a", false},
+		{"**", "a/b/c", true},
+
+		// * et ? ne traversent pas les "/"
+		{"*.txt", "a.txt", true},
+		{"*.txt", "d/a.txt", false},
+		{"*/*.txt", "d/a.txt", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+
+		// classes de caractères
+		{"[abc].txt", "b.txt", true},
+		{"[abc].txt", "d.txt", false},
+		{"[a-c]*.go", "cat.go", true},
+		{"[a-c]*.go", "dog.go", false},
+		{"[^a]*", "bcd", true},
+		{"[^a]*", "abc", false},
+		{"photos/[0-9][0-9][0-9][0-9]/*", "photos/2024/a.jpg", true},
+		{"photos/[0-9][0-9][0-9][0-9]/*", "photos/best/a.jpg", false},
+
+		// motif mal formé : ne correspond à rien
+		{"[a", "[a", false},
+	}
+
+	for _, test := range tests {
+		if match := Match__glob(test.pattern, test.path); match != test.match {
+			t.Errorf("Match__glob(%q, %q) = %v, attendu %v", test.pattern, test.path, match, test.match)
+		}
+	}
+}
+
+func TestCouldMatchBelow(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dir     string
+		below   bool
+	}{
+		{"a/b/c.txt", "a", true},
+		{"a/b/c.txt", "a/b", true},
+		{"a/b/c.txt", "a/x", false},
+		// le chemin complet est celui d'un fichier : rien en dessous
+		{"a/b/c.txt", "a/b/c.txt", false},
+
+		{"docs/*", "docs", true},
+		{"docs/*", "docs/a", false},
+		{"docs/*", "other", false},
+
+		// ** peut aller n'importe où en dessous
+		{"photos/**/*.jpg", "photos", true},
+		{"photos/**/*.jpg", "photos/2024/trip", true},
+		{"photos/**/*.jpg", "docs", false},
+		{"**", "anything/deep", true},
+		{"**/*.go", "src", true},
+
+		{"*/src/*.go", "proj", true},
+		{"*/src/*.go", "proj/src", true},
+		{"*/src/*.go", "proj/doc", false},
+
+		{"[ab]/x", "b", true},
+		{"[ab]/x", "c", false},
+		{"[a/x", "a", false},
+	}
+
+	for _, test := range tests {
+		if below := could__match__below(test.pattern, test.dir); below != test.below {
+			t.Errorf("could__match__below(%q, %q) = %v, attendu %v", test.pattern, test.dir, below, test.below)
+		}
+	}
+}
+
+func TestIsGlob(t *testing.T) {
+	for pattern, glob := range map[string]bool{
+		"docs/a.txt": false,
+		"*.txt":      true,
+		"file?.txt":  true,
+		"[ab].txt":   true,
+		"docs/**":    true,
+	} {
+		if Is__glob(pattern) != glob {
+			t.Errorf("Is__glob(%q) = %v, attendu %v", pattern, !glob, glob)
+		}
+	}
+}
+
+func TestIsSafeName(t *testing.T) {
+	for name, safe := range map[string]bool{
+		"a.txt":     true,
+		"..hidden":  true,
+		"":          false,
+		".":         false,
+		"..":        false,
+		"a/b":       false,
+		"a\\b":      false,
+		"../etc":    false,
+		"dossier 1": true,
+	} {
+		if Is__safe__name(name) != safe {
+			t.Errorf("Is__safe__name(%q) = %v, attendu %v", name, !safe, safe)
+		}
+	}
+}
@@ -1,23 +1,48 @@
 package p2p
 
 import (
-	"crypto/ecdh"
-	"crypto/rand"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-	"project/pkg/identity"
 	"time"
 )
 
 // fonction de base pour envoyer un message en UDP: on "redéfinit" une fonction pour centraliser les envois
 // + pratique pour les Verbose_log de DEBUG
+// si la session avec dest utilise les enveloppes (ExtensionEnvelope), le message est chiffré en entier
 func (me *Me) Send__UDP(msg Message, dest *net.UDPAddr) error {
 
+	if sealable(msg.Type) {
+		send, counter, err := me.next__send__nonce(dest, len(msg.Body))
+		if err != nil {
+			return err
+		}
+		if send != nil {
+			sealed := seal__message(send, counter, msg)
+			if msg.Type != TypeDatum && msg.Type != TypeDatumRequest {
+				Verbose_log("[DEBUG] Sent  : type: %s (chiffré), id: %d, dest: %s\n", msg__type__to__string(msg.Type), msg.Id, dest)
+			}
+			return me.write__message(sealed, dest)
+		}
+	}
+
+	return me.send__plain(msg, dest)
+}
+
+// envoie le message tel quel, sans enveloppe
+func (me *Me) send__plain(msg Message, dest *net.UDPAddr) error {
+
 	if msg.Type != TypeDatum && msg.Type != TypeDatumRequest {
 		Verbose_log("[DEBUG] Sent  : type: %s, id: %d, dest: %s\n", msg__type__to__string(msg.Type), msg.Id, dest)
-
 	}
+	return me.write__message(msg, dest)
+}
+
+// écrit le message sur le transport
+func (me *Me) write__message(msg Message, dest *net.UDPAddr) error {
+
 	data := msg.Serialize()
 	_, err := me.Conn.WriteToUDP(data, dest)
 
@@ -25,47 +50,75 @@ func (me *Me) Send__UDP(msg Message, dest *net.UDPAddr) error {
 }
 
 // fonction qui sert à envoyer un message et vérifie si le timeout est atteint, auquel cas réessaye jusqu'à 3 fois.
-// les paramètres sont: la destiantion, une "clef" pour le pipe (hash pour les Datum, Id sinon), la fonction Sender (Send__hello, ...)
-func (me *Me) Send__with__timeout(destAddr string, key [32]byte, sendFunc func() error, failureMsg string) ([]byte, error) {
+// les paramètres sont: la destiantion, la fonction Sender qui envoie le message avec l'id qu'on lui donne, et un message en cas d'échec
+func (me *Me) Send__with__timeout(destAddr string, sendFunc func(id uint32) error, failureMsg string) (*Response, error) {
+	return me.Send__with__timeout__ctx(context.Background(), destAddr, sendFunc, failureMsg)
+}
+
+// meme fonction que Send__with__timeout mais qui peut être annulée via le context ctx
+// chaque essai a son propre id, mais une réponse (même tardive) à n'importe lequel des essais est acceptée
+// si ctx est annulé, on retire tout de suite nos requêtes du RequestTracker et on renvoie ctx.Err()
+func (me *Me) Send__with__timeout__ctx(ctx context.Context, destAddr string, sendFunc func(id uint32) error, failureMsg string) (*Response, error) {
+
+	// on prépare l'adresse de destination : c'est d'elle (et seulement d'elle) qu'on attend la réponse
+	udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
+	if err != nil {
+		return nil, fmt.Errorf("échec critique de l'envoi (adresse invalide ?) : %v", err)
+	}
 
 	// on commence avec un timeout de 2 secondes. A chaque timeoeut on double. Si le 3eme essai (16secondes) échoue, on stop
 	currentTimeout := 2 * time.Second
 	maxTimeout := 8 * time.Second
 
+	// le pipe pour la réponse, partagé par tous les essais
+	respChan := make(chan *Response, 1)
+
+	// les ids de tous nos essais, pour les retirer du tracker à la fin
+	var ids []uint32
+	defer func() {
+		for _, id := range ids {
+			me.Requests.Cancel(udpAddr, id)
+		}
+	}()
+
 	for {
-		// on prépare le pipe pour la réponse
-		respChan := make(chan []byte, 1)
+		// si la requête a déjà été abandonnée, inutile d'envoyer quoi que ce soit
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		// on prends le verrou sur notre map de pipe et on y place celui qu'on vient de créer
-		me.PendingLock.Lock()
-		me.PendingRequests[key] = respChan
-		me.PendingLock.Unlock()
+		// on genere l'ID de ce message et on l'enregistre avant d'envoyer (la réponse peut arriver très vite)
+		id := me.Generate__random__id()
+		ids = append(ids, id)
+		me.Requests.Register(udpAddr, id, respChan)
 
 		// execution de notre fonction d'envoi (notre action)
-		err := sendFunc()
+		err := sendFunc(id)
+		if errors.Is(err, ErrEncryptionRequired) {
+			// refus de notre politique de chiffrement, pas un problème réseau
+			return nil, err
+		}
 		if err != nil {
 			fmt.Printf("erreur envoi UDP %v\n", err)
-
-			// on a eu une erreur "système", on delete notre pipe
-			me.PendingLock.Lock()
-			delete(me.PendingRequests, key)
-			me.PendingLock.Unlock()
-			return nil, fmt.Errorf("échec critique de l'envoi (adresse invalide ?) : %v", err)
+			return nil, fmt.Errorf("échec critique de l'envoi (adresse invalide ?) : %w", err)
 		}
 
+		timer := time.NewTimer(currentTimeout)
+
 		// attente
 		select {
-		case data := <-respChan:
-			// si notre pipe contient des data c'est un succès
-			return data, nil
+		case resp := <-respChan:
+			// si notre pipe contient une réponse c'est un succès
+			timer.Stop()
+			return resp, nil
 
-		case <-time.After(currentTimeout):
-			// timeout
+		case <-ctx.Done():
+			// la requête a été abandonnée par l'appelant (le defer nettoie le tracker)
+			timer.Stop()
+			return nil, ctx.Err()
 
-			// on prend le verrou sur notre map et on delete le pipe
-			me.PendingLock.Lock()
-			delete(me.PendingRequests, key)
-			me.PendingLock.Unlock()
+		case <-timer.C:
+			// timeout
 
 			// si on a atteint le max de timeout définit, on renvoi une erreur
 			if currentTimeout >= maxTimeout {
@@ -74,7 +127,7 @@ func (me *Me) Send__with__timeout(destAddr string, key [32]byte, sendFunc func()
 					fmt.Println(failureMsg)
 				}
 
-				return nil, fmt.Errorf("timeout définitif")
+				return nil, fmt.Errorf("%w : %s", ErrTimeout, destAddr)
 			}
 
 			// on double le timeout et on reesaye
@@ -84,8 +137,111 @@ func (me *Me) Send__with__timeout(destAddr string, key [32]byte, sendFunc func()
 	}
 }
 
+// vérifie que la réponse est bien du type attendu, et transforme un message Error (ou NoDatum) en erreur Go
+func expect__response(resp *Response, expected uint8) error {
+
+	switch {
+	case resp.Type == expected:
+		return nil
+
+	case resp.Type == Error:
+		message := string(resp.Body)
+		return &ProtocolError{Peer: resp.From.String(), Message: message, Kind: classify__error(message)}
+
+	case resp.Type == TypeNoDatum && expected == TypeDatum:
+		return ErrNoDatum
+	}
+
+	return fmt.Errorf("réponse inattendue de %s : %s au lieu de %s", resp.From, msg__type__to__string(resp.Type), msg__type__to__string(expected))
+}
+
+// envoie une requête et attend une réponse du type expected
+// si le pair a oublié notre session (ErrHelloFirst, ErrUnknownKey), on refait un Hello et on réessaye une seule fois
+func (me *Me) Send__request__ctx(ctx context.Context, destAddr string, sendFunc func(id uint32) error, failureMsg string, expected uint8) (*Response, error) {
+
+	resp, err := me.Send__with__timeout__ctx(ctx, destAddr, sendFunc, failureMsg)
+	if err == nil {
+		err = expect__response(resp, expected)
+	}
+
+	if err == nil || !needs__rehello(err) {
+		return resp, err
+	}
+
+	Verbose_log("%s ne nous connaît plus (%v), nouveau Hello puis nouvel essai\n", destAddr, err)
+	if helloErr := me.rehello(ctx, destAddr); helloErr != nil {
+		return nil, fmt.Errorf("%w (nouveau Hello impossible : %v)", err, helloErr)
+	}
+
+	resp, err = me.Send__with__timeout__ctx(ctx, destAddr, sendFunc, failureMsg)
+	if err != nil {
+		return nil, err
+	}
+	return resp, expect__response(resp, expected)
+}
+
+// refait un Hello vers destAddr. Si plusieurs requêtes vers ce pair échouent en même temps, un seul Hello est envoyé
+func (me *Me) rehello(ctx context.Context, destAddr string) error {
+
+	me.inflightLock.Lock()
+	call, exists := me.rehellos[destAddr]
+	if !exists {
+		call = &inflight__call{done: make(chan struct{})}
+		me.rehellos[destAddr] = call
+
+		go func() {
+			// le Hello ne dépend pas de ctx : il sert à toutes les requêtes qui attendent
+			call.err = me.Send__hello(destAddr)
+
+			me.inflightLock.Lock()
+			delete(me.rehellos, destAddr)
+			me.inflightLock.Unlock()
+			close(call.done)
+		}()
+	}
+	me.inflightLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// construit le body d'un Hello ou HelloReply : Extensions + Name (d'où 4octets + taille de Name en octets)
+// (on n'annonce pas le chiffrement à un pair avec qui il est désactivé)
+func (me *Me) hello__body(policy EncryptionPolicy) []byte {
+
+	var extensions uint32 = 0
+	extensions |= ExtensionNAT
+	extensions |= ExtensionTimestamp
+	if policy != EncryptionOff {
+		extensions |= ExtensionEncryption
+		extensions |= ExtensionEnvelope
+	}
+
+	body := make([]byte, 4+len(me.PeerName))
+	binary.BigEndian.PutUint32(body[0:4], extensions)
+
+	// on écrit le nom du Peer à la fin
+	copy(body[4:], []byte(me.PeerName))
+
+	return body
+}
+
 // fonction qui envoie Hello à une destination (paramètre destAddr)
 func (me *Me) Send__hello(destAddr string) error {
+	return me.Send__hello__ctx(context.Background(), destAddr)
+}
+
+// variante de Send__hello qui peut être annulée via ctx
+func (me *Me) Send__hello__ctx(ctx context.Context, destAddr string) error {
+	return me.send__hello(ctx, destAddr, true)
+}
+
+// envoie un Hello ; redate : refaire un Hello daté si celui-ci ne l'était pas (une seule fois)
+func (me *Me) send__hello(ctx context.Context, destAddr string, redate bool) error {
 
 	// on prépare l'adresse de destination pour UDP
 	udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
@@ -93,39 +249,23 @@ func (me *Me) Send__hello(destAddr string) error {
 		return err
 	}
 
-	// on genere l'ID de ce message
-	msgId := me.Generate__random__id()
-
-	// on derive l'ID en une key
-	waitKey := Key__from__Id(msgId)
+	// notre dernier Hello était-il daté ?
+	dated := false
 
 	// on crée une "action", c'est ce qui est transmis à Send__with__timeout
-	sendFunc := func() error {
-
-		var extensions uint32 = 0
-		extensions |= ExtensionNAT
-		extensions |= ExtensionEncryption
-
-		// le corps du message est Extensions + Name (d'où 4octets + taille de Name en octets)
-		body := make([]byte, 4+len(me.PeerName))
-		binary.BigEndian.PutUint32(body[0:4], extensions)
-
-		// on écrit le nom du Peer à la fin (les 4 premiers octets sont vides pour le moment)
-		copy(body[4:], []byte(me.PeerName))
+	sendFunc := func(id uint32) error {
 
 		msg := Message{
-			Id:   msgId,
+			Id:   id,
 			Type: TypeHello,
-			Body: body,
+			Body: me.hello__body(me.policy__for__addr(udpAddr)),
 		}
 
 		// on signe le message
-		unsignedData := msg.Serialize()
-		sig, err := identity.Sign(me.PrivateKey, unsignedData)
-		if err != nil {
+		if err := me.sign__message(&msg, udpAddr); err != nil {
 			return err
 		}
-		msg.Signature = sig
+		dated = msg.Timestamp != 0
 
 		// Envoie les octets finaux sur le réseau
 		return me.Send__UDP(msg, udpAddr)
@@ -134,21 +274,28 @@ func (me *Me) Send__hello(destAddr string) error {
 	customMsg := fmt.Sprintln("Echec d'un Hello, veuillez réessayer avec l'option de NAT Traversal")
 
 	// on appelle notre fonction qui gère le timeout avec reply
-	_, err = me.Send__with__timeout(destAddr, waitKey, sendFunc, customMsg)
-	return err
+	// (pas de nouvel essai automatique ici : c'est justement le Hello qui a échoué)
+	resp, err := me.Send__with__timeout__ctx(ctx, destAddr, sendFunc, customMsg)
+	if err != nil {
+		return err
+	}
+	if err := expect__response(resp, TypeHelloReply); err != nil {
+		return err
+	}
+
+	// premier contact : notre Hello n'était pas daté, le pair n'a donc pas créé de session (voir Handle__hellos).
+	// Maintenant qu'on sait qu'il date ses messages, on refait un Hello, daté cette fois
+	if redate && !dated && len(resp.Body) >= 4 && binary.BigEndian.Uint32(resp.Body[0:4])&ExtensionTimestamp != 0 {
+		return me.send__hello(ctx, destAddr, false)
+	}
+	return nil
 }
 
 // fonction qui envoie un ping à une destination
 func (me *Me) Send__ping(destAddr string) error {
 
-	// on genere l'ID de ce message
-	msgId := me.Generate__random__id()
-
-	// on derive l'ID en une key
-	waitKey := Key__from__Id(msgId)
-
 	// on crée une "action", c'est ce qui est transmis à Send__with__timeout
-	sendFunc := func() error {
+	sendFunc := func(id uint32) error {
 		// on prépare l'adresse de destination pour UDP
 		udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
 		if err != nil {
@@ -157,7 +304,7 @@ func (me *Me) Send__ping(destAddr string) error {
 
 		// on cree la struct Message du ping
 		msg := Message{
-			Id:   msgId,
+			Id:   id,
 			Type: TypePing,
 			Body: []byte{},
 		}
@@ -167,21 +314,20 @@ func (me *Me) Send__ping(destAddr string) error {
 	}
 
 	// on appelle notre fonction qui gère le timeout avec reply
-	_, err := me.Send__with__timeout(destAddr, waitKey, sendFunc, "")
+	_, err := me.Send__request__ctx(context.Background(), destAddr, sendFunc, "", TypeOk)
 	return err
 }
 
 // fonction qui envoie un rootRequest à une destination
 func (me *Me) Send__RootRequest(destAddr string) ([]byte, error) {
+	return me.Send__RootRequest__ctx(context.Background(), destAddr)
+}
 
-	// on genere l'ID de ce message
-	msgId := me.Generate__random__id()
-
-	// on derive l'ID en une key
-	waitKey := Key__from__Id(msgId)
+// variante de Send__RootRequest qui peut être annulée via ctx
+func (me *Me) Send__RootRequest__ctx(ctx context.Context, destAddr string) ([]byte, error) {
 
 	// on crée une "action", c'est ce qui est transmis à Send__with__timeout
-	sendFunc := func() error {
+	sendFunc := func(id uint32) error {
 		udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
 		if err != nil {
 			return err
@@ -189,7 +335,7 @@ func (me *Me) Send__RootRequest(destAddr string) ([]byte, error) {
 
 		// Ici le body envoyé est vide, il sera rempli par un handler
 		msg := Message{
-			Id:   msgId,
+			Id:   id,
 			Type: TypeRootRequest,
 			Body: []byte{},
 		}
@@ -199,26 +345,97 @@ func (me *Me) Send__RootRequest(destAddr string) ([]byte, error) {
 	}
 
 	// on appelle notre fonction qui gère le timeout avec reply
-	return me.Send__with__timeout(destAddr, waitKey, sendFunc, "")
+	resp, err := me.Send__request__ctx(ctx, destAddr, sendFunc, "", TypeRootReply)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body[:32], nil
 }
 
 // fonction qui envoie une datumRequest à une destination
 func (me *Me) Send__DatumRequest(destAddr string, hash [32]byte) ([]byte, error) {
+	return me.Send__DatumRequest__ctx(context.Background(), destAddr, hash)
+}
+
+// variante de Send__DatumRequest qui peut être annulée via ctx (utilisée par les téléchargements)
+// si une requête pour le même hash auprès du même pair est déjà en cours, on attend sa réponse au lieu d'en envoyer une autre
+func (me *Me) Send__DatumRequest__ctx(ctx context.Context, destAddr string, hash [32]byte) ([]byte, error) {
+
+	key := inflight__key{peer: destAddr, hash: hash}
+
+	me.inflightLock.Lock()
+	call, exists := me.inflight[key]
+
+	// personne ne l'a encore demandé : on lance la requête
+	if !exists {
+		// la requête a son propre context : elle ne doit pas s'arrêter tant qu'il reste quelqu'un pour attendre la réponse
+		flightCtx, cancel := context.WithCancel(context.Background())
+		call = &inflight__call{done: make(chan struct{}), cancel: cancel}
+		me.inflight[key] = call
+
+		go func() {
+			data, err := me.send__datum__request(flightCtx, destAddr, hash)
+
+			// on retire la requête de la map (si elle n'a pas déjà été abandonnée et remplacée)
+			me.inflightLock.Lock()
+			if me.inflight[key] == call {
+				delete(me.inflight, key)
+			}
+			me.inflightLock.Unlock()
+
+			call.data = data
+			call.err = err
+			close(call.done)
+			cancel()
+		}()
+	}
+
+	call.waiters++
+	me.inflightLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.data, call.err
+
+	case <-ctx.Done():
+		// on n'attend plus : si on était le dernier, la requête est abandonnée
+		me.inflightLock.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			if me.inflight[key] == call {
+				delete(me.inflight, key)
+			}
+			call.cancel()
+		}
+		me.inflightLock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// la vraie DatumRequest, sans regroupement (appelée par Send__DatumRequest__ctx)
+func (me *Me) send__datum__request(ctx context.Context, destAddr string, hash [32]byte) ([]byte, error) {
 
 	// on crée une "action", c'est ce qui est transmis à Send__with__timeout
-	sendFunc := func() error {
+	sendFunc := func(id uint32) error {
 
 		udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
 		if err != nil {
 			return err
 		}
 
+		// on ne demande rien en clair à un pair pour qui on exige le chiffrement
+		// (vérifié à chaque envoi : après un nouveau Hello, la session est nouvelle)
+		if err := me.require__encryption(ctx, udpAddr); err != nil {
+			return err
+		}
+
 		// Le body doit contenir les 32 octets du hash demandé
 		body := make([]byte, 32)
 		copy(body, hash[:])
 
 		msg := Message{
-			Id:   me.Generate__random__id(),
+			Id:   id,
 			Type: TypeDatumRequest, // 3
 			Body: body,
 		}
@@ -226,17 +443,26 @@ func (me *Me) Send__DatumRequest(destAddr string, hash [32]byte) ([]byte, error)
 		return me.Send__UDP(msg, udpAddr)
 	}
 
-	return me.Send__with__timeout(destAddr, hash, sendFunc, "")
+	// (un NoDatum donne ErrNoDatum)
+	resp, err := me.Send__request__ctx(ctx, destAddr, sendFunc, "", TypeDatum)
+	if err != nil {
+		return nil, err
+	}
+
+	// Format du body : Hash (32 octets) + Data
+	// on vérifie que c'est bien le hash demandé, et que les data y correspondent
+	if !resp.Verified || len(resp.Body) < 33 || [32]byte(resp.Body[:32]) != hash {
+		return nil, fmt.Errorf("Datum invalide reçu de %s pour le hash %x", resp.From, hash[:4])
+	}
+
+	return resp.Body[32:], nil
 }
 
 // fonction pour envoyer un NatTraversalRequest(1) au serveur
 func (me *Me) Send__NatTraversalRequest(targetAddr string, destAddr string) error {
 
-	msgId := me.Generate__random__id()
-	waitKey := Key__from__Id(msgId)
-
 	// on prépare l'"action" pour Send__with__timeout
-	sendFunc := func() error {
+	sendFunc := func(id uint32) error {
 
 		// on prépapre l'adresse pour l'envoi
 		udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
@@ -281,130 +507,110 @@ func (me *Me) Send__NatTraversalRequest(targetAddr string, destAddr string) erro
 
 		// création d'un message avec notre struct mssage
 		msg := Message{
-			Id:   msgId,
+			Id:   id,
 			Type: TypeNatTraversalRequest,
 			Body: body,
 		}
 
 		// on signe le message
-		unsignedData := msg.Serialize()
-		sig, err := identity.Sign(me.PrivateKey, unsignedData)
-		if err != nil {
+		if err := me.sign__message(&msg, udpAddr); err != nil {
 			return err
 		}
-		msg.Signature = sig
 
 		// Envoie les octets finaux sur le réseau
 		return me.Send__UDP(msg, udpAddr)
 	}
 
 	/// on envoie avec notre fonction d'envoi
-	_, err := me.Send__with__timeout(destAddr, waitKey, sendFunc, "")
+	_, err := me.Send__request__ctx(context.Background(), destAddr, sendFunc, "", TypeOk)
 	return err
 }
 
 // fonction sender de natrequest2
 func (me *Me) Send__NatTraversalRequest2(destAddr *net.UDPAddr, body []byte) error {
 
-	// on récupère l'adreesse dest
-	destStr := destAddr.String()
-
-	// on prépare l'id du message et la key pour notre map de pipe
-	msgId := me.Generate__random__id()
-	waitKey := Key__from__Id(msgId)
-
 	// on prépare l'"action" pour Send__with__timeout
-	sendFunc := func() error {
+	sendFunc := func(id uint32) error {
 
 		msg := Message{
-			Id:   msgId,
+			Id:   id,
 			Type: TypeNatTraversalRequest2,
 			Body: body,
 		}
 
 		// on signe le message
-		unsignedData := msg.Serialize()
-		sig, err := identity.Sign(me.PrivateKey, unsignedData)
-		if err != nil {
+		if err := me.sign__message(&msg, destAddr); err != nil {
 			return err
 		}
-		msg.Signature = sig
 
 		// Envoie les octets finaux sur le réseau
 		return me.Send__UDP(msg, destAddr)
 	}
 
-	_, err := me.Send__with__timeout(destStr, waitKey, sendFunc, "")
+	_, err := me.Send__request__ctx(context.Background(), destAddr.String(), sendFunc, "", TypeOk)
 	return err
 }
 
-// Send__KeyExchange initie la première étape du protocole de confidentialité (Handshake).
-//
-// OBJECTIF : Envoyer notre "demi-clé" publique temporaire au pair distant.
-// SÉCURITÉ : Le message est signé avec notre clé d'identité (ECDSA) pour empêcher
+// Send__KeyExchange initie le protocole de confidentialité (Handshake) avec le pair.
 //
-//	les attaques Man-in-the-Middle (MITM).
+// Avec un pair qui connaît les enveloppes, on lance un nouvel échange (voir handshake.go).
+// Sinon (ancien fonctionnement), on envoie notre "demi-clé" publique temporaire, signée avec notre clé d'identité
+// (ECDSA) pour empêcher les attaques Man-in-the-Middle (MITM).
 func (me *Me) Send__KeyExchange(destAddr string) error {
-	// On verrouille pour lire la map des sessions de manière thread-safe
-	me.Mutex.Lock()
-	session, exists := me.Sessions[destAddr]
-	me.Mutex.Unlock()
 
-	// Cette variable permet de savoir si la clé a déjà été générée. Si c'est le cas,
-	// on a déjà calculer notre secret partagé, donc on n'en aura plus besoin après cette fonction.
-	// > La même variable existe dans "Handle_KeyExchange" dans handle.go
-	isAlreadyDefinedEphemeralPrivKey := false
+	udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
+	if err != nil {
+		return err
+	}
 
+	// On verrouille car on va lire/écrire dans l'objet 'session'
+	me.Mutex.Lock()
+	session, exists := me.Sessions[udpAddr.String()]
 	if !exists {
+		me.Mutex.Unlock()
 		return fmt.Errorf("session inconnue")
 	}
 
-	var pubKey []byte
-
-	// On verrouille car on va lire/écrire dans l'objet 'session'
-	me.Mutex.Lock()
-	if session.EphemeralPriv != nil {
-		// Cas A : On a déjà une clé, on la réutilise
-		pubKey = session.EphemeralPriv.PublicKey().Bytes()
-
-	} else {
-		// Cas B : On en génère une nouvelle
-		isAlreadyDefinedEphemeralPrivKey = true
-		curve := ecdh.X25519()
-		privKey, err := curve.GenerateKey(rand.Reader)
-		if err != nil {
-			me.Mutex.Unlock()
-			return err
-		}
-		session.EphemeralPriv = privKey
-		pubKey = privKey.PublicKey().Bytes()
+	if session.Extensions&ExtensionEnvelope != 0 {
+		me.Mutex.Unlock()
+		return me.start__handshake(udpAddr, true)
 	}
+
+	hs, err := session.legacy__handshake()
 	me.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return me.send__key__exchange(udpAddr, hs.ephemeral.PublicKey().Bytes(), nil)
+}
+
+// envoie notre clé publique éphémère, suivie de celle du pair si on répond à son échange
+func (me *Me) send__key__exchange(dest *net.UDPAddr, ephemeral []byte, answered []byte) error {
 
 	// On construit le message, on lui donne le type associé à l'échange de clé
-	// et on envoie la clé publique que l'on vient de calculer dans le body
+	// et on envoie la clé publique dans le body
 	msg := Message{
 		Id:   me.Generate__random__id(),
 		Type: TypeKeyExchange,
-		Body: pubKey,
+		Body: append(append([]byte(nil), ephemeral...), answered...),
 	}
 
 	// On signe le message pour contrer les attaque Man in the Middle
-	sig, errSig := identity.Sign(me.PrivateKey, msg.Serialize())
-	if errSig != nil {
+	if errSig := me.sign__message(&msg, dest); errSig != nil {
 		return fmt.Errorf("echec signature: %v", errSig)
 	}
-	msg.Signature = sig
 
-	// On envoie le message
-	udpAddr, err := net.ResolveUDPAddr("udp", destAddr)
-	if err != nil {
-		return err
-	}
+	return me.Send__UDP(msg, dest)
+}
 
-	if isAlreadyDefinedEphemeralPrivKey {
-		session.EphemeralPriv = nil
-	}
+// envoie notre confirmation de clé (le MAC prouve à lui seul qu'on a les clés : pas de signature)
+func (me *Me) send__key__confirm(dest *net.UDPAddr, mac []byte) error {
 
-	return me.Send__UDP(msg, udpAddr)
+	msg := Message{
+		Id:   me.Generate__random__id(),
+		Type: TypeKeyConfirm,
+		Body: mac,
+	}
+	return me.Send__UDP(msg, dest)
 }
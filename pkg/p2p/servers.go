@@ -0,0 +1,196 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"project/pkg/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL du serveur du sujet
+const DefaultServerURL = "https://jch.irif.fr:8443"
+
+// temps laissé à l'annuaire pour donner une clef ou une adresse quand on ne peut pas attendre
+// (Handle__hellos bloque un worker de réception pendant la recherche)
+const directoryLookupTimeout = 5 * time.Second
+
+// un serveur d'annuaire : son API HTTP et son adresse UDP (pour les Hello, keep-alives et la NAT traversal)
+type DirectoryServer struct {
+	// nom sous lequel le serveur publie ses propres adresses (par défaut : le nom d'hôte de l'URL, ex: jch.irif.fr)
+	Name string
+	// URL de l'API HTTP (/peers/...)
+	URL string
+	// le client de cette API (délais, nouvelles tentatives) ; nil si pas d'URL
+	Client *client.Client
+
+	lock sync.Mutex
+	// adresse UDP ; vide tant qu'elle n'a pas été découverte
+	udpAddr string
+}
+
+// décrit un serveur. Si udpAddr est vide, l'adresse UDP sera demandée au serveur lui-même (GET /peers/<name>/addresses)
+func New__directory__server(serverURL string, name string, udpAddr string) *DirectoryServer {
+
+	if name == "" {
+		if parsed, err := url.Parse(serverURL); err == nil {
+			name = parsed.Hostname()
+		}
+	}
+
+	s := &DirectoryServer{Name: name, URL: serverURL, udpAddr: udpAddr}
+	if serverURL != "" {
+		s.Client = client.New__client(serverURL)
+	}
+	return s
+}
+
+// renvoie l'adresse UDP du serveur, en la découvrant au premier appel
+func (s *DirectoryServer) UDP__addr() (string, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.udpAddr != "" {
+		return s.udpAddr, nil
+	}
+
+	if s.URL == "" {
+		return "", fmt.Errorf("serveur %s sans adresse UDP ni URL", s.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), directoryLookupTimeout)
+	defer cancel()
+
+	addrs, err := s.Client.Get__peer__adresses(ctx, s.Name)
+	if err != nil {
+		return "", fmt.Errorf("adresse UDP du serveur %s introuvable : %v", s.Name, err)
+	}
+
+	addr := Preferred__address(addrs)
+	if addr == "" {
+		return "", fmt.Errorf("le serveur %s ne publie aucune adresse UDP", s.Name)
+	}
+
+	s.udpAddr = addr
+	return addr, nil
+}
+
+// renvoie l'adresse à utiliser parmi celles d'un pair : la première IPv4, sinon la première adresse
+func Preferred__address(addrs []string) string {
+
+	var first string
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if first == "" {
+			first = addr
+		}
+		// les adresses ipv4 n'ont qu'un seul ':'
+		if strings.Count(addr, ":") == 1 {
+			return addr
+		}
+	}
+	return first
+}
+
+// ajoute un serveur d'annuaire (le premier ajouté est le serveur principal)
+func (me *Me) Add__server(s *DirectoryServer) {
+	me.serversLock.Lock()
+	me.servers = append(me.servers, s)
+	primary := len(me.servers) == 1
+	me.serversLock.Unlock()
+
+	// les anciens champs (Deprecated) désignent le serveur principal
+	if primary {
+		s.lock.Lock()
+		me.ServerURL, me.ServerUDPAddr = s.URL, s.udpAddr
+		s.lock.Unlock()
+	}
+}
+
+// renvoie les serveurs d'annuaire, le principal en premier
+func (me *Me) Servers() []*DirectoryServer {
+	me.serversLock.Lock()
+	defer me.serversLock.Unlock()
+	return append([]*DirectoryServer(nil), me.servers...)
+}
+
+// renvoie le serveur principal (nil si aucun)
+func (me *Me) Primary__server() *DirectoryServer {
+	me.serversLock.Lock()
+	defer me.serversLock.Unlock()
+	if len(me.servers) == 0 {
+		return nil
+	}
+	return me.servers[0]
+}
+
+// cherche la clef publique d'un pair sur chaque serveur, dans l'ordre (en directoryLookupTimeout au plus)
+func (me *Me) key__from__servers(name string) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), directoryLookupTimeout)
+	defer cancel()
+
+	lastErr := fmt.Errorf("aucun serveur d'annuaire configuré")
+	for _, s := range me.Servers() {
+		if s.Client == nil {
+			continue
+		}
+		key, err := me.Directory.Get__publicKey(ctx, s.Client, name)
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// cherche les clefs publiques de plusieurs pairs en parallèle, sur chaque serveur dans l'ordre
+// (un pair introuvable sur un serveur est cherché sur le suivant)
+func (me *Me) Lookup__keys(ctx context.Context, names []string) map[string]client.KeyResult {
+
+	results := make(map[string]client.KeyResult, len(names))
+	missing := names
+	for _, s := range me.Servers() {
+		if s.Client == nil || len(missing) == 0 {
+			continue
+		}
+
+		var next []string
+		for name, result := range me.Directory.Lookup__keys(ctx, s.Client, missing) {
+			if result.Err != nil {
+				next = append(next, name)
+			}
+			if _, found := results[name]; !found || result.Err == nil {
+				results[name] = result
+			}
+		}
+		missing = next
+	}
+
+	for _, name := range missing {
+		if _, found := results[name]; !found {
+			results[name] = client.KeyResult{Err: fmt.Errorf("aucun serveur d'annuaire configuré")}
+		}
+	}
+	return results
+}
+
+// la signature d'un pair ne se vérifie pas avec la clef gardée en cache : il en a peut-être changé.
+// On l'oublie et on la redemande ; renvoie la nouvelle clef, ou nil si l'annuaire donne toujours la même
+func (me *Me) refresh__key(name string, stale []byte) []byte {
+
+	me.Directory.Invalidate(name)
+
+	key, err := me.lookup__key(name)
+	if err != nil || bytes.Equal(key, stale) {
+		return nil
+	}
+	return key
+}
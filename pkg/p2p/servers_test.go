@@ -0,0 +1,31 @@
+package p2p
+
+import "testing"
+
+func TestDeprecatedServerFields(t *testing.T) {
+	priv, _ := test__key(t)
+
+	me := New__communication__on(nil, priv, "alice", "https://annuaire.example:8443", "10.0.0.1:8000")
+
+	// les anciens champs désignent le serveur principal
+	if me.ServerURL != "https://annuaire.example:8443" || me.ServerUDPAddr != "10.0.0.1:8000" {
+		t.Fatalf("ServerURL %q, ServerUDPAddr %q", me.ServerURL, me.ServerUDPAddr)
+	}
+	if me.PendingRequests == nil {
+		t.Fatal("PendingRequests nil")
+	}
+
+	// un second serveur ne les change pas
+	me.Add__server(New__directory__server("https://autre.example", "", "10.0.0.2:8000"))
+	if me.ServerURL != "https://annuaire.example:8443" || me.ServerUDPAddr != "10.0.0.1:8000" {
+		t.Fatalf("après un second serveur : ServerURL %q, ServerUDPAddr %q", me.ServerURL, me.ServerUDPAddr)
+	}
+	if primary := me.Primary__server(); primary.Name != "annuaire.example" {
+		t.Fatalf("serveur principal %q", primary.Name)
+	}
+
+	// sans serveur : vides
+	if me := New__communication__on(nil, priv, "bob", "", ""); me.ServerURL != "" || me.Primary__server() != nil {
+		t.Fatalf("pair sans serveur : ServerURL %q", me.ServerURL)
+	}
+}
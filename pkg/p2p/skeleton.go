@@ -0,0 +1,369 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"project/pkg/filesystem"
+	"strconv"
+	"strings"
+)
+
+// SQUELETTES (l'arbre d'un pair, sans le contenu de ses fichiers)
+//
+// Download_skeleton__ctx ne récupère que les dossiers (Directory, BigDirectory) d'un pair, et avec -big le BigNode du
+// haut de ses gros fichiers. Le protocole n'a pas de requête qui donne seulement le type d'un noeud : pour savoir
+// qu'une entrée est un fichier, on reçoit une fois son premier noeud (le chunk d'un petit fichier, le BigNode d'un
+// gros). On n'en garde que le type, on ne descend jamais en dessous, et on ne le redemande plus tant qu'il est
+// dans un squelette gardé.
+//
+// Un squelette est rangé sous le nom du pair (son adresse peut changer) dans me.Skeletons et, si me.SkeletonDir
+// n'est pas vide, dans le fichier SkeletonDir/<nom>. print -o, ls, diff et les motifs de download -o s'en servent
+// ensuite sans rien demander au réseau. Le fichier contient une ligne par noeud :
+//
+//	root <roothash>
+//	node <hash> <contenu>   (dossier, ou BigNode gardé avec -big)
+//	type <hash> <type>      (fichier dont on n'a gardé que le type)
+//
+// (hash et contenu en hexadécimal ; on vérifie le hash de chaque noeud à la lecture)
+
+// aucun squelette gardé pour ce pair (ni en mémoire, ni sur le disque)
+var ErrNoSkeleton = errors.New("aucun squelette pour ce pair (commande 'skeleton')")
+
+// une différence entre deux arbres (voir Diff__trees)
+type TreeChange struct {
+	// chemin relatif à la racine, avec des "/"
+	Path string
+	// '+' : seulement dans le second arbre, '-' : seulement dans le premier, '~' : contenu différent
+	Kind byte
+	// true si c'est un dossier
+	IsDir bool
+}
+
+// télécharge seulement le squelette (dossiers) de l'arbre d'un pair et le garde sous le nom peerName
+// (chaque fichier est quand même reçu une fois pour connaître son type : jusqu'à 1 Ko par fichier, voir plus haut)
+// pour pouvoir l'afficher ou y chercher des chemins sans être connecté (voir Print__Skeleton__ctx)
+// l'erreur renvoyée est celle de l'écriture du squelette sur le disque
+func (me *Me) Download_skeleton__ctx(ctx context.Context, destAddr string, peerName string, rootHash [32]byte, includeBigNodes bool) (*DownloadResult, error) {
+
+	// le squelette précédent nous évite de redemander les fichiers qui n'ont pas changé
+	if _, err := me.Skeleton__root(peerName); err != nil && !errors.Is(err, ErrNoSkeleton) {
+		Verbose_log("ancien squelette de %s illisible : %v", peerName, err)
+	}
+
+	result := me.Download_tree__ctx(ctx, destAddr, rootHash, DownloadOptions{
+		RetryFailed:     true,
+		MetadataOnly:    true,
+		IncludeBigNodes: includeBigNodes,
+	})
+
+	// on retient la racine du squelette de ce pair, même incomplet (on peut déjà en explorer une partie)
+	me.DbLock.Lock()
+	me.Skeletons[peerName] = rootHash
+	me.DbLock.Unlock()
+
+	return result, me.save__skeleton(peerName, rootHash)
+}
+
+// renvoie la racine du squelette gardé pour ce pair (lu sur le disque la première fois)
+func (me *Me) Skeleton__root(peerName string) ([32]byte, error) {
+
+	me.DbLock.Lock()
+	root, exists := me.Skeletons[peerName]
+	me.DbLock.Unlock()
+
+	if exists {
+		return root, nil
+	}
+	return me.load__skeleton(peerName)
+}
+
+// affiche hors ligne le squelette gardé pour un pair (voir Download_skeleton__ctx)
+func (me *Me) Print__Skeleton__ctx(ctx context.Context, peerName string) {
+
+	root, err := me.Skeleton__root(peerName)
+	if err != nil {
+		fmt.Printf("squelette de %s : %v\n", peerName, err)
+		return
+	}
+
+	// targetAddr vide : on ne demande rien au réseau
+	me.recursive__print__tree(ctx, root, "", "")
+}
+
+// chemin du fichier du squelette d'un pair ("" si on ne les garde pas sur le disque)
+// (le nom est échappé comme dans une URL : il ne doit pas nous faire sortir du dossier)
+func (me *Me) skeleton__file(peerName string) string {
+	if me.SkeletonDir == "" {
+		return ""
+	}
+	return filepath.Join(me.SkeletonDir, url.PathEscape(peerName))
+}
+
+// écrit le squelette dont la racine est rootHash (les noeuds qu'on en connait) dans son fichier
+func (me *Me) save__skeleton(peerName string, rootHash [32]byte) error {
+
+	path := me.skeleton__file(peerName)
+	if path == "" {
+		return nil
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "# squelette de %q\n", peerName)
+	fmt.Fprintf(&content, "root %x\n", rootHash)
+
+	me.DbLock.Lock()
+	me.write__skeleton__node(&content, rootHash, make(map[[32]byte]bool))
+	me.DbLock.Unlock()
+
+	if err := os.MkdirAll(me.SkeletonDir, 0755); err != nil {
+		return err
+	}
+
+	// dans un fichier temporaire d'abord : un arrêt brutal ne le laisse pas à moitié écrit
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// fonction "fille" de save__skeleton : écrit le noeud hash et ses descendants. Le verrou DbLock doit être pris.
+func (me *Me) write__skeleton__node(content *strings.Builder, hash [32]byte, seen map[[32]byte]bool) {
+
+	// un même sous-arbre peut apparaître plusieurs fois
+	if seen[hash] {
+		return
+	}
+	seen[hash] = true
+
+	data, exists := me.Database[hash]
+	if !exists {
+		// un fichier dont on n'a gardé que le type (ou un noeud pas encore reçu : on l'ignore)
+		if nodeType, known := me.NodeTypes[hash]; known {
+			fmt.Fprintf(content, "type %x %d\n", hash, nodeType)
+		}
+		return
+	}
+
+	switch data[0] {
+
+	case filesystem.TypeChunk:
+		// on ne garde jamais le contenu d'un fichier dans un squelette
+		fmt.Fprintf(content, "type %x %d\n", hash, data[0])
+
+	case filesystem.TypeBig:
+		// le haut d'un gros fichier : on s'arrête là
+		fmt.Fprintf(content, "node %x %x\n", hash, data)
+
+	case filesystem.TypeDirectory:
+		fmt.Fprintf(content, "node %x %x\n", hash, data)
+
+		entriesData := data[1:]
+		for i := 0; i < len(entriesData)/64; i++ {
+			var childHash [32]byte
+			copy(childHash[:], entriesData[i*64+32:(i+1)*64])
+			me.write__skeleton__node(content, childHash, seen)
+		}
+
+	case filesystem.TypeBigDirectory:
+		fmt.Fprintf(content, "node %x %x\n", hash, data)
+
+		hashesData := data[1:]
+		for i := 0; i < len(hashesData)/32; i++ {
+			var childHash [32]byte
+			copy(childHash[:], hashesData[i*32:(i+1)*32])
+			me.write__skeleton__node(content, childHash, seen)
+		}
+	}
+}
+
+// lit le squelette d'un pair sur le disque : ses noeuds vont dans la Database, les types des fichiers dans NodeTypes
+func (me *Me) load__skeleton(peerName string) ([32]byte, error) {
+
+	path := me.skeleton__file(peerName)
+	if path == "" {
+		return [32]byte{}, ErrNoSkeleton
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return [32]byte{}, ErrNoSkeleton
+	}
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer file.Close()
+
+	var root [32]byte
+	hasRoot := false
+	nodes := make(map[[32]byte][]byte)
+	types := make(map[[32]byte]byte)
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return [32]byte{}, fmt.Errorf("%s:%d : ligne invalide", path, lineNum)
+		}
+
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil || len(raw) != 32 {
+			return [32]byte{}, fmt.Errorf("%s:%d : hash invalide", path, lineNum)
+		}
+		var hash [32]byte
+		copy(hash[:], raw)
+
+		switch {
+		case fields[0] == "root" && len(fields) == 2:
+			root = hash
+			hasRoot = true
+
+		case fields[0] == "node" && len(fields) == 3:
+			data, err := hex.DecodeString(fields[2])
+			// on ne croit pas le fichier sur parole : le contenu doit correspondre au hash
+			if err != nil || len(data) == 0 || sha256.Sum256(data) != hash {
+				return [32]byte{}, fmt.Errorf("%s:%d : noeud invalide", path, lineNum)
+			}
+			nodes[hash] = data
+
+		case fields[0] == "type" && len(fields) == 3:
+			nodeType, err := strconv.Atoi(fields[2])
+			if err != nil || nodeType < 0 || nodeType > filesystem.TypeBigDirectory {
+				return [32]byte{}, fmt.Errorf("%s:%d : type invalide", path, lineNum)
+			}
+			types[hash] = byte(nodeType)
+
+		default:
+			return [32]byte{}, fmt.Errorf("%s:%d : ligne invalide", path, lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return [32]byte{}, err
+	}
+	if !hasRoot {
+		return [32]byte{}, fmt.Errorf("%s : racine manquante", path)
+	}
+
+	me.DbLock.Lock()
+	for hash, data := range nodes {
+		me.Database[hash] = data
+	}
+	for hash, nodeType := range types {
+		me.NodeTypes[hash] = nodeType
+	}
+	me.Skeletons[peerName] = root
+	me.DbLock.Unlock()
+
+	return root, nil
+}
+
+// compare hors ligne deux arbres connus localement (squelettes, ou notre propre arbre)
+// les sous-arbres de même hash sont identiques : on ne descend que là où ils diffèrent
+func (me *Me) Diff__trees(ctx context.Context, oldRoot [32]byte, newRoot [32]byte) ([]TreeChange, error) {
+
+	var changes []TreeChange
+	if err := me.diff__dirs(ctx, oldRoot, newRoot, "", &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// fonction "fille" de Diff__trees : compare les dossiers oldHash et newHash situés à dirPath
+func (me *Me) diff__dirs(ctx context.Context, oldHash [32]byte, newHash [32]byte, dirPath string, changes *[]TreeChange) error {
+
+	if oldHash == newHash {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// destAddr vide : seulement ce qu'on a localement
+	oldEntries, err := me.List__directory(ctx, "", oldHash)
+	if err != nil {
+		return fmt.Errorf("lecture du dossier '%s' impossible : %v", dirPath, err)
+	}
+	newEntries, err := me.List__directory(ctx, "", newHash)
+	if err != nil {
+		return fmt.Errorf("lecture du dossier '%s' impossible : %v", dirPath, err)
+	}
+
+	newByName := make(map[string][32]byte, len(newEntries))
+	for _, entry := range newEntries {
+		newByName[entry.Name] = entry.Hash
+	}
+	oldByName := make(map[string][32]byte, len(oldEntries))
+	for _, entry := range oldEntries {
+		oldByName[entry.Name] = entry.Hash
+	}
+
+	// ce qui a disparu ou changé (dans l'ordre du premier arbre)
+	for _, entry := range oldEntries {
+		childPath := join__remote__path(dirPath, entry.Name)
+		oldIsDir := me.is__known__dir(entry.Hash)
+
+		newChild, exists := newByName[entry.Name]
+		if !exists {
+			*changes = append(*changes, TreeChange{Path: childPath, Kind: '-', IsDir: oldIsDir})
+			continue
+		}
+		if newChild == entry.Hash {
+			continue
+		}
+
+		// deux dossiers : on descend pour trouver ce qui a changé dedans
+		if oldIsDir && me.is__known__dir(newChild) {
+			if err := me.diff__dirs(ctx, entry.Hash, newChild, childPath, changes); err != nil {
+				return err
+			}
+			continue
+		}
+		*changes = append(*changes, TreeChange{Path: childPath, Kind: '~', IsDir: me.is__known__dir(newChild)})
+	}
+
+	// ce qui est apparu (dans l'ordre du second arbre)
+	for _, entry := range newEntries {
+		if _, exists := oldByName[entry.Name]; !exists {
+			*changes = append(*changes, TreeChange{Path: join__remote__path(dirPath, entry.Name), Kind: '+', IsDir: me.is__known__dir(entry.Hash)})
+		}
+	}
+
+	return nil
+}
+
+// renvoie true si on sait localement que ce noeud est un dossier (Directory ou BigDirectory)
+func (me *Me) is__known__dir(hash [32]byte) bool {
+	nodeType, known := me.Known__node__type(hash)
+	return known && (nodeType == filesystem.TypeDirectory || nodeType == filesystem.TypeBigDirectory)
+}
+
+// affiche les différences entre deux arbres, une par ligne ("+ chemin", "- chemin/", "~ chemin")
+func Print__tree__changes(changes []TreeChange) {
+
+	if len(changes) == 0 {
+		fmt.Println("aucune différence")
+		return
+	}
+
+	for _, change := range changes {
+		suffix := ""
+		if change.IsDir {
+			suffix = "/"
+		}
+		fmt.Printf("%c %s%s\n", change.Kind, change.Path, suffix)
+	}
+}
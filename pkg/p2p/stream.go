@@ -0,0 +1,353 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"project/pkg/filesystem"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// écriture des fichiers pendant le téléchargement (option DownloadOptions.StreamTo)
+// les chunks sont écrits dès qu'ils peuvent être placés (dans l'ordre du fichier) puis oubliés :
+// seuls les noeuds de structure (dossiers, BigNode) restent dans la Database
+//
+// Un chunk arrivé avant ceux qui le précèdent attend en mémoire. Sa place dans le fichier dépend de la taille des
+// chunks précédents, qu'on ne connait pas encore : on ne peut pas l'écrire tout de suite avec WriteAt comme
+// rebuild.go. On limite donc la mémoire qu'ils occupent : au delà de maxStreamPending octets en attente, l'ordonnanceur
+// ne lance plus que les chunks attendus par un fichier (ceux qui débloquent l'écriture), voir download__scheduler.pick
+
+// octets de chunks en attente au delà desquels l'ordonnanceur attend l'écriture des fichiers
+const maxStreamPending = 4 << 20
+
+// un niveau du parcours d'un fichier : la liste des enfants d'un BigNode et l'enfant à écrire ensuite
+type stream__frame struct {
+	children [][32]byte
+	index    int
+}
+
+// un chunk arrivé trop tôt (avant ceux qui le précèdent dans le fichier)
+type pending__chunk struct {
+	data []byte
+	// nombre de fois où ce chunk a été livré (un même chunk peut apparaître plusieurs fois dans un fichier)
+	count int
+}
+
+// un fichier en cours d'écriture
+type stream__file struct {
+	lock sync.Mutex
+
+	// chemin local du fichier
+	path string
+	// ouvert au premier chunk écrit, fermé dès que le fichier est complet
+	file *os.File
+
+	// le parcours en profondeur du fichier, comme une pile
+	stack []stream__frame
+	// chunks reçus mais pas encore écrits
+	pending map[[32]byte]*pending__chunk
+
+	done bool
+	err  error
+}
+
+// état de l'écriture de tous les fichiers d'un téléchargement
+type stream__writer struct {
+	lock sync.Mutex
+
+	// dossier local où on écrit
+	outDir string
+	// fichiers en cours, par chemin distant
+	files map[string]*stream__file
+
+	// nombre de fichiers complètement écrits
+	completed int
+
+	// taille totale des chunks en attente (tous fichiers confondus), et la limite au delà de laquelle on freine
+	pendingBytes atomic.Int64
+	limit        int64
+}
+
+func new__stream__writer(outDir string) *stream__writer {
+	return &stream__writer{outDir: outDir, files: make(map[string]*stream__file), limit: maxStreamPending}
+}
+
+// trop de chunks attendent en mémoire ?
+func (sw *stream__writer) over__limit() bool {
+	return sw.pendingBytes.Load() >= sw.limit
+}
+
+// le fichier remotePath attend-il ce noeud pour continuer son écriture ?
+func (sw *stream__writer) awaits(remotePath string, hash [32]byte) bool {
+
+	f := sw.get(remotePath)
+	if f == nil {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.done || f.err != nil || len(f.stack) == 0 {
+		return false
+	}
+	top := f.stack[len(f.stack)-1]
+	return top.index < len(top.children) && top.children[top.index] == hash
+}
+
+// un chemin distant qui sortirait du dossier de téléchargement
+var errUnsafePath = errors.New("chemin hors du dossier de téléchargement")
+
+// chemin local correspondant à un chemin distant
+// (refusé s'il sort du dossier de téléchargement, avec ".." par exemple : le chemin vient du pair)
+func (sw *stream__writer) local__path(remotePath string) (string, error) {
+
+	localPath := filepath.Join(sw.outDir, filepath.FromSlash(remotePath))
+
+	rel, err := filepath.Rel(sw.outDir, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%w : %q", errUnsafePath, remotePath)
+	}
+	return localPath, nil
+}
+
+// un dossier a été reçu : on le crée tout de suite
+func (sw *stream__writer) mkdir(remotePath string) error {
+
+	localPath, err := sw.local__path(remotePath)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(localPath, 0755)
+}
+
+// fichier d'un seul chunk : on l'écrit en une fois
+func (sw *stream__writer) write__whole(remotePath string, content []byte) error {
+
+	localPath, err := sw.local__path(remotePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		return err
+	}
+
+	sw.lock.Lock()
+	sw.completed++
+	sw.lock.Unlock()
+	return nil
+}
+
+// le haut (BigNode) d'un fichier a été reçu : on prépare son parcours
+func (sw *stream__writer) open(remotePath string, rootHash [32]byte) *stream__file {
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	// déjà ouvert (second passage par exemple)
+	if f, exists := sw.files[remotePath]; exists {
+		return f
+	}
+
+	// un chemin refusé : le fichier est abandonné tout de suite (advance renvoie l'erreur)
+	localPath, err := sw.local__path(remotePath)
+
+	f := &stream__file{
+		path:    localPath,
+		stack:   []stream__frame{{children: [][32]byte{rootHash}}},
+		pending: make(map[[32]byte]*pending__chunk),
+		err:     err,
+	}
+	sw.files[remotePath] = f
+	return f
+}
+
+// renvoie le fichier en cours d'écriture à ce chemin distant
+func (sw *stream__writer) get(remotePath string) *stream__file {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return sw.files[remotePath]
+}
+
+// un chunk du fichier remotePath a été reçu : on le garde de côté puis on écrit tout ce qui peut l'être
+func (sw *stream__writer) deliver(me *Me, remotePath string, hash [32]byte, content []byte) error {
+
+	f := sw.get(remotePath)
+	if f == nil {
+		return fmt.Errorf("chunk reçu pour un fichier inconnu : %s", remotePath)
+	}
+
+	f.lock.Lock()
+	// (un fichier terminé ou abandonné n'a plus besoin de ce chunk)
+	if !f.done && f.err == nil {
+		if p, exists := f.pending[hash]; exists {
+			p.count++
+		} else {
+			f.pending[hash] = &pending__chunk{data: content, count: 1}
+			sw.pendingBytes.Add(int64(len(content)))
+		}
+	}
+	f.lock.Unlock()
+
+	return sw.advance(me, f)
+}
+
+// écrit, dans l'ordre, tous les chunks disponibles du fichier f
+func (sw *stream__writer) advance(me *Me, f *stream__file) error {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.done || f.err != nil {
+		return f.err
+	}
+
+	// en cas d'erreur le fichier est abandonné : ses chunks en attente ne serviront plus
+	defer func() {
+		if f.err != nil {
+			sw.release(f)
+		}
+	}()
+
+	for len(f.stack) > 0 {
+		top := &f.stack[len(f.stack)-1]
+
+		// tous les enfants de ce niveau ont été écrits, on remonte
+		if top.index >= len(top.children) {
+			f.stack = f.stack[:len(f.stack)-1]
+			continue
+		}
+
+		hash := top.children[top.index]
+
+		// le chunk attendu est arrivé : on l'écrit et on l'oublie
+		if p, exists := f.pending[hash]; exists {
+			if err := f.write(p.data); err != nil {
+				return err
+			}
+			p.count--
+			if p.count == 0 {
+				delete(f.pending, hash)
+				sw.pendingBytes.Add(-int64(len(p.data)))
+			}
+			top.index++
+			continue
+		}
+
+		// sinon on regarde dans la Database (BigNode intermédiaire ou chunk qu'on avait déjà)
+		me.DbLock.Lock()
+		data, exists := me.Database[hash]
+		me.DbLock.Unlock()
+
+		// pas encore reçu : on attendra le prochain appel
+		if !exists {
+			return nil
+		}
+
+		top.index++
+
+		switch data[0] {
+		case filesystem.TypeChunk:
+			if err := f.write(data[1:]); err != nil {
+				return err
+			}
+
+		case filesystem.TypeBig:
+			// on descend d'un niveau
+			hashesData := data[1:]
+			count := len(hashesData) / 32
+
+			children := make([][32]byte, count)
+			for i := 0; i < count; i++ {
+				copy(children[i][:], hashesData[i*32:(i+1)*32])
+			}
+			f.stack = append(f.stack, stream__frame{children: children})
+
+		default:
+			f.err = fmt.Errorf("noeud de type %d inattendu dans le fichier %s", data[0], f.path)
+			return f.err
+		}
+	}
+
+	// la pile est vide : le fichier est complet
+	if f.file == nil {
+		// cas d'un fichier vide
+		if err := f.write(nil); err != nil {
+			return err
+		}
+	}
+	f.err = f.file.Close()
+	f.file = nil
+	f.done = true
+
+	sw.lock.Lock()
+	sw.completed++
+	sw.lock.Unlock()
+
+	return f.err
+}
+
+// oublie les chunks en attente du fichier f. Le verrou de f doit être pris.
+func (sw *stream__writer) release(f *stream__file) {
+	for _, p := range f.pending {
+		sw.pendingBytes.Add(-int64(len(p.data)))
+	}
+	f.pending = nil
+}
+
+// écrit à la suite du fichier (on l'ouvre au premier appel). Le verrou de f doit être pris.
+func (f *stream__file) write(content []byte) error {
+
+	if f.file == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			f.err = err
+			return err
+		}
+
+		file, err := os.Create(f.path)
+		if err != nil {
+			f.err = fmt.Errorf("erreur création fichier %s: %v", f.path, err)
+			return f.err
+		}
+		f.file = file
+	}
+
+	if _, err := f.file.Write(content); err != nil {
+		f.err = err
+		return err
+	}
+	return nil
+}
+
+// à la fin du téléchargement : on ferme les fichiers incomplets et on renvoie leurs chemins locaux
+func (sw *stream__writer) close__all() []string {
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	var incomplete []string
+	for _, f := range sw.files {
+		f.lock.Lock()
+		if !f.done {
+			// (un chemin refusé n'a pas de fichier local : il est déjà dans les noeuds manquants)
+			if f.path != "" {
+				incomplete = append(incomplete, f.path)
+			}
+			if f.file != nil {
+				f.file.Close()
+				f.file = nil
+			}
+			// les chunks en attente ne serviront plus
+			sw.release(f)
+		}
+		f.lock.Unlock()
+	}
+	return incomplete
+}
@@ -0,0 +1,50 @@
+package p2p
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamLocalPath(t *testing.T) {
+	outDir := filepath.Join(t.TempDir(), "out")
+	sw := new__stream__writer(outDir)
+
+	tests := []struct {
+		remotePath string
+		expected   string
+	}{
+		{"a.txt", filepath.Join(outDir, "a.txt")},
+		{"docs/notes/b.txt", filepath.Join(outDir, "docs", "notes", "b.txt")},
+		{"a/../b", filepath.Join(outDir, "b")},
+		// ce qui sort du dossier est refusé
+		{"..", ""},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{"../out2/x", ""},
+	}
+
+	for _, test := range tests {
+		got, err := sw.local__path(test.remotePath)
+		if test.expected == "" {
+			if !errors.Is(err, errUnsafePath) {
+				t.Errorf("local__path(%q) = %q, %v : attendu un refus", test.remotePath, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("local__path(%q) = %q, %v : attendu %q", test.remotePath, got, err, test.expected)
+		}
+	}
+
+	// rien n'est créé hors du dossier
+	if err := sw.mkdir("../evil"); !errors.Is(err, errUnsafePath) {
+		t.Errorf("mkdir(\"../evil\") : %v, attendu un refus", err)
+	}
+	if err := sw.write__whole("../evil.txt", []byte("x")); !errors.Is(err, errUnsafePath) {
+		t.Errorf("write__whole(\"../evil.txt\") : %v, attendu un refus", err)
+	}
+	if f := sw.open("../evil.bin", [32]byte{}); !errors.Is(f.err, errUnsafePath) {
+		t.Errorf("open(\"../evil.bin\") : %v, attendu un refus", f.err)
+	}
+}
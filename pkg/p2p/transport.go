@@ -0,0 +1,21 @@
+package p2p
+
+import (
+	"net"
+)
+
+// ce dont Me a besoin pour envoyer et recevoir des datagrammes
+// *net.UDPConn l'implémente, tout comme les connexions du réseau en mémoire de pkg/memnet (pour les tests)
+type Transport interface {
+	// lit un datagramme (bloquant). Renvoie net.ErrClosed une fois le transport fermé
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	// envoie un datagramme à addr
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	// notre adresse locale
+	LocalAddr() net.Addr
+	// ferme le transport : débloque ReadFromUDP
+	Close() error
+}
+
+// on vérifie à la compilation que *net.UDPConn est bien un Transport
+var _ Transport = (*net.UDPConn)(nil)
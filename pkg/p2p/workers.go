@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"hash/fnv"
+	"net"
+)
+
+// nombre de workers qui traitent les messages reçus (voir Me.ReceiveWorkers)
+const DefaultReceiveWorkers = 8
+
+// nombre de workers pour les messages lents, comme les Hello qui interrogent le serveur (voir Me.SlowWorkers)
+const DefaultSlowWorkers = 4
+
+// nombre de messages en attente par worker avant qu'on commence à en jeter
+const receiveQueueSize = 256
+
+// un datagramme reçu, en attente de traitement
+type received__msg struct {
+	msg  *Message
+	addr *net.UDPAddr
+}
+
+// les workers qui traitent les messages reçus, pour que Listen__loop ne fasse que lire le port
+// les messages d'un même pair vont toujours au même worker : ils sont traités dans l'ordre d'arrivée
+// les messages lents (HandlerSpec.Slow) ont leurs propres workers pour ne pas bloquer les autres
+// (eux aussi répartis par pair : un KeyExchange est toujours traité après le Hello qui le précède)
+type receive__pool struct {
+	me     *Me
+	shards []chan received__msg
+	slow   []chan received__msg
+}
+
+// lance les workers
+func (me *Me) start__receive__pool() *receive__pool {
+
+	workers := me.ReceiveWorkers
+	if workers <= 0 {
+		workers = DefaultReceiveWorkers
+	}
+	slowWorkers := me.SlowWorkers
+	if slowWorkers <= 0 {
+		slowWorkers = DefaultSlowWorkers
+	}
+
+	pool := &receive__pool{
+		me:     me,
+		shards: make([]chan received__msg, workers),
+		slow:   make([]chan received__msg, slowWorkers),
+	}
+
+	for _, queues := range [][]chan received__msg{pool.shards, pool.slow} {
+		for i := range queues {
+			queues[i] = make(chan received__msg, receiveQueueSize)
+			go pool.work(queues[i])
+		}
+	}
+
+	return pool
+}
+
+// boucle d'un worker
+func (pool *receive__pool) work(queue chan received__msg) {
+	for received := range queue {
+		pool.me.dispatch(received.msg, received.addr)
+	}
+}
+
+// confie un message à un worker. Si sa file est pleine, le message est jeté (comme le ferait le réseau)
+func (pool *receive__pool) submit(msg *Message, addr *net.UDPAddr) {
+
+	queues := pool.shards
+	if spec := pool.me.handler__for(msg.Type); spec != nil && spec.Slow {
+		queues = pool.slow
+	}
+	queue := queues[shard__of(addr, len(queues))]
+
+	select {
+	case queue <- received__msg{msg: msg, addr: addr}:
+	default:
+		Verbose_log("file de traitement pleine, message %s de %s jeté", msg__type__to__string(msg.Type), addr)
+	}
+}
+
+// arrête les workers (à la fin de Listen__loop)
+func (pool *receive__pool) stop() {
+	for _, queues := range [][]chan received__msg{pool.shards, pool.slow} {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}
+}
+
+// numéro du worker d'un pair
+func shard__of(addr *net.UDPAddr, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(addr.String()))
+	return int(h.Sum32() % uint32(count))
+}
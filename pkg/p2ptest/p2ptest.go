@@ -0,0 +1,345 @@
+// Package p2ptest lance plusieurs pairs dans un même processus pour écrire des tests de bout en bout
+// (hello, échange de clés, NAT traversal, téléchargement) sans le vrai serveur jch.irif.fr.
+//
+// Les pairs communiquent sur un réseau en mémoire (pkg/memnet) ou en loopback, et trouvent les clefs
+// et adresses des autres sur un serveur d'annuaire local (pkg/directory) : l'API HTTP /peers/...
+// utilisée par pkg/client, et un pair UDP "server" (Hello, intermédiaire de la NAT traversal).
+//
+//	c := p2ptest.New(t, 2)
+//	alice, bob := c.Peers[0], c.Peers[1]
+//	bob.Load(map[string][]byte{"a.txt": []byte("salut")})
+//	c.Hello(alice, bob)
+//	dir := c.Download(alice, bob)
+package p2ptest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"project/pkg/client"
+	"project/pkg/directory"
+	"project/pkg/filesystem"
+	"project/pkg/identity"
+	"project/pkg/memnet"
+	"project/pkg/p2p"
+	"testing"
+	"time"
+)
+
+// nom du pair qui joue le rôle du serveur UDP
+const ServerName = "server"
+
+// options d'un groupe de pairs
+type Options struct {
+	// nombre de pairs (sans compter le serveur)
+	Peers int
+	// true : vrais sockets UDP sur 127.0.0.1 plutôt que le réseau en mémoire
+	Loopback bool
+	// conditions du réseau en mémoire (pertes, délais...)
+	Conditions memnet.Conditions
+	// graine des tirages aléatoires du réseau en mémoire
+	Seed int64
+	// true : on désactive le chiffrement des Datum (l'échange de clés a lieu, mais les sessions restent en clair)
+	Plaintext bool
+}
+
+// un groupe de pairs qui se connaissent par le serveur d'annuaire
+type Cluster struct {
+	tb testing.TB
+
+	// le serveur d'annuaire, et l'URL de son API HTTP
+	Directory *directory.Server
+	URL       string
+	// le réseau en mémoire (nil en loopback)
+	Net *memnet.Network
+
+	// le pair UDP du serveur d'annuaire
+	Server *Peer
+	// les autres pairs, nommés peer0, peer1...
+	Peers []*Peer
+
+	opts Options
+	// numéro de la prochaine adresse sur le réseau en mémoire
+	next int
+}
+
+// un pair du groupe
+type Peer struct {
+	Name string
+	Me   *p2p.Me
+	// adresse UDP du pair ("ip:port")
+	Addr string
+	Key  *ecdsa.PrivateKey
+
+	// roothash des fichiers chargés avec Load
+	Root [32]byte
+
+	cluster *Cluster
+}
+
+// lance n pairs sur le réseau en mémoire
+func New(tb testing.TB, n int) *Cluster {
+	return New__with__options(tb, Options{Peers: n})
+}
+
+// lance un groupe de pairs selon les options. Tout est arrêté à la fin du test
+func New__with__options(tb testing.TB, opts Options) *Cluster {
+	tb.Helper()
+
+	c := &Cluster{tb: tb, opts: opts}
+
+	if !opts.Loopback {
+		c.Net = memnet.New(opts.Seed)
+		c.Net.SetConditions(opts.Conditions)
+	}
+
+	// le serveur d'abord : les autres ont besoin de son adresse
+	c.start__directory()
+
+	for i := 0; i < opts.Peers; i++ {
+		c.Peers = append(c.Peers, c.Add__peer(fmt.Sprintf("peer%d", i)))
+	}
+
+	return c
+}
+
+// lance le serveur d'annuaire (HTTP sur 127.0.0.1, UDP sur le réseau du groupe)
+func (c *Cluster) start__directory() {
+	tb := c.tb
+	tb.Helper()
+
+	priv, err := identity.KeyGen()
+	if err != nil {
+		tb.Fatalf("p2ptest: génération de clef : %v", err)
+	}
+
+	tr := c.open__transport()
+	addr := tr.LocalAddr().String()
+
+	dir, err := directory.New(ServerName, priv, tr, []string{addr})
+	if err != nil {
+		tb.Fatalf("p2ptest: serveur d'annuaire : %v", err)
+	}
+	go dir.Serve__UDP()
+	tb.Cleanup(func() { dir.Close() })
+
+	httpServer := httptest.NewServer(dir.Handler())
+	tb.Cleanup(httpServer.Close)
+
+	c.Directory = dir
+	c.URL = httpServer.URL
+	c.Server = &Peer{Name: ServerName, Me: dir.Me, Addr: addr, Key: priv, cluster: c}
+}
+
+// ajoute un pair au groupe : clef, enregistrement sur l'annuaire, Listen__loop
+func (c *Cluster) Add__peer(name string) *Peer {
+	tb := c.tb
+	tb.Helper()
+
+	priv, err := identity.KeyGen()
+	if err != nil {
+		tb.Fatalf("p2ptest: génération de clef : %v", err)
+	}
+	pub, err := identity.Extract__PubKey(priv)
+	if err != nil {
+		tb.Fatalf("p2ptest: clef publique : %v", err)
+	}
+
+	tr := c.open__transport()
+	addr := tr.LocalAddr().String()
+
+	me := p2p.New__communication__on(tr, priv, name, c.URL, c.Server.Addr)
+	go me.Listen__loop()
+	tb.Cleanup(func() { me.Close() })
+
+	if err := client.Register(c.URL, name, identity.PublicKey__to__bytes(pub)); err != nil {
+		tb.Fatalf("p2ptest: enregistrement de %s : %v", name, err)
+	}
+	// on publie son adresse tout de suite (sans attendre un Hello au serveur)
+	c.Directory.Record__address(name, addr)
+
+	return &Peer{Name: name, Me: me, Addr: addr, Key: priv, cluster: c}
+}
+
+// ouvre un transport : socket sur 127.0.0.1 ou connexion sur le réseau en mémoire
+func (c *Cluster) open__transport() p2p.Transport {
+	tb := c.tb
+	tb.Helper()
+
+	if c.opts.Loopback {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			tb.Fatalf("p2ptest: socket UDP : %v", err)
+		}
+		return conn
+	}
+
+	c.next++
+	conn, err := c.Net.Listen(fmt.Sprintf("10.0.%d.%d:8000", c.next/250, c.next%250+1))
+	if err != nil {
+		tb.Fatalf("p2ptest: réseau en mémoire : %v", err)
+	}
+	return conn
+}
+
+// a envoie un Hello à b. Le test échoue si b ne répond pas
+func (c *Cluster) Hello(a, b *Peer) {
+	c.tb.Helper()
+
+	if err := a.Me.Send__hello(b.Addr); err != nil {
+		c.tb.Fatalf("p2ptest: hello de %s vers %s : %v", a.Name, b.Name, err)
+	}
+
+	// on attend que b ait aussi enregistré a (le HelloReply peut arriver avant)
+	c.Wait__for(fmt.Sprintf("session de %s chez %s", a.Name, b.Name), func() bool {
+		return b.has__session(a)
+	})
+
+	if c.opts.Plaintext {
+		a.set__plaintext(b)
+		b.set__plaintext(a)
+	}
+}
+
+// tous les pairs (et le serveur) se disent bonjour deux à deux
+func (c *Cluster) Hello__all() {
+	c.tb.Helper()
+
+	all := append([]*Peer{c.Server}, c.Peers...)
+	for i, a := range all {
+		for _, b := range all[i+1:] {
+			c.Hello(a, b)
+		}
+	}
+}
+
+// a demande au serveur de prévenir b qu'il veut le joindre (NatTraversalRequest)
+func (c *Cluster) Nat__traversal(a, b *Peer) error {
+	return a.Me.Send__NatTraversalRequest(b.Addr, c.Server.Addr)
+}
+
+// attend que l'échange de clés entre a et b soit fait (dans les deux sens)
+func (c *Cluster) Wait__encrypted(a, b *Peer) {
+	c.tb.Helper()
+
+	c.Wait__for(fmt.Sprintf("chiffrement entre %s et %s", a.Name, b.Name), func() bool {
+		return a.is__encrypted(b) && b.is__encrypted(a)
+	})
+}
+
+// a télécharge tout l'arbre de b, le reconstruit dans un dossier temporaire et renvoie ce dossier
+func (c *Cluster) Download(a, b *Peer) string {
+	tb := c.tb
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	root, err := a.Me.Send__RootRequest__ctx(ctx, b.Addr)
+	if err != nil {
+		tb.Fatalf("p2ptest: RootRequest de %s vers %s : %v", a.Name, b.Name, err)
+	}
+	var rootHash [32]byte
+	copy(rootHash[:], root)
+
+	result := a.Me.Download_tree__ctx(ctx, b.Addr, rootHash, p2p.DownloadOptions{RetryFailed: true})
+	if !result.Complete() {
+		tb.Fatalf("p2ptest: téléchargement incomplet de %s par %s : %d noeud(s) manquant(s), ex: %v", b.Name, a.Name, len(result.Missing), result.Missing[0].Reason)
+	}
+
+	dir := filepath.Join(tb.TempDir(), "download")
+	if err := a.Me.Rebuild__file__system(rootHash, dir); err != nil {
+		tb.Fatalf("p2ptest: reconstruction : %v", err)
+	}
+	return dir
+}
+
+// attend que cond soit vraie (5 secondes au plus). Le test échoue sinon
+func (c *Cluster) Wait__for(what string, cond func() bool) {
+	c.tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.tb.Fatalf("p2ptest: délai dépassé en attendant : %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// écrit les fichiers (chemin relatif -> contenu) dans un dossier temporaire et les partage
+// renvoie le roothash
+func (p *Peer) Load(files map[string][]byte) [32]byte {
+	tb := p.cluster.tb
+	tb.Helper()
+
+	dir := filepath.Join(tb.TempDir(), p.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatalf("p2ptest: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatalf("p2ptest: %v", err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			tb.Fatalf("p2ptest: %v", err)
+		}
+	}
+
+	return p.Load__dir(dir)
+}
+
+// partage un dossier existant. Renvoie le roothash
+func (p *Peer) Load__dir(dir string) [32]byte {
+	tb := p.cluster.tb
+	tb.Helper()
+
+	nodes, err := filesystem.Build__merkle__from__path(dir)
+	if err != nil {
+		tb.Fatalf("p2ptest: merkle de %s : %v", dir, err)
+	}
+	p.Me.Load__file__system(nodes)
+	p.Root = p.Me.RootHash
+	return p.Root
+}
+
+// renvoie la session de p avec other (nil si aucune)
+func (p *Peer) Session(other *Peer) *p2p.PeerSession {
+	p.Me.Mutex.Lock()
+	defer p.Me.Mutex.Unlock()
+	return p.Me.Sessions[other.Addr]
+}
+
+func (p *Peer) has__session(other *Peer) bool {
+	p.Me.Mutex.Lock()
+	defer p.Me.Mutex.Unlock()
+	session, exists := p.Me.Sessions[other.Addr]
+	return exists && session.PublicKey != nil
+}
+
+func (p *Peer) is__encrypted(other *Peer) bool {
+	p.Me.Mutex.Lock()
+	defer p.Me.Mutex.Unlock()
+	session, exists := p.Me.Sessions[other.Addr]
+	return exists && session.IsEncrypted
+}
+
+// on laisse à l'échange de clés le temps de finir (il peut aussi être perdu : pas d'erreur), puis on repasse la session en clair
+func (p *Peer) set__plaintext(other *Peer) {
+
+	deadline := time.Now().Add(time.Second)
+	for !p.is__encrypted(other) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.Me.Mutex.Lock()
+	if session, exists := p.Me.Sessions[other.Addr]; exists {
+		session.IsEncrypted = false
+	}
+	p.Me.Mutex.Unlock()
+}
@@ -0,0 +1,331 @@
+package p2ptest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"project/pkg/filesystem"
+	"project/pkg/memnet"
+	"project/pkg/p2p"
+	"project/pkg/p2ptest"
+	"testing"
+	"time"
+)
+
+// contenu pseudo-aléatoire (reproductible) : aucun chunk ne se répète
+func random__content(seed int64, size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+// vérifie que le fichier name du dossier dir a bien ce contenu
+func check__file(t *testing.T, dir string, name string, expected []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatalf("lecture de %s : %v", name, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("%s : %d octets reçus, contenu différent de l'original (%d octets)", name, len(got), len(expected))
+	}
+}
+
+func TestHello(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	c.Hello(alice, bob)
+
+	if alice.Session(bob) == nil || bob.Session(alice) == nil {
+		t.Fatal("session manquante après le Hello")
+	}
+	if name := bob.Session(alice).Name; name != alice.Name {
+		t.Fatalf("nom annoncé %q, attendu %q", name, alice.Name)
+	}
+
+	// l'échange de clés suit le Hello
+	c.Wait__encrypted(alice, bob)
+}
+
+func TestDownload(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	// plus de 32 chunks : le fichier a plusieurs niveaux de BigNode
+	big := random__content(1, 100*1024)
+	small := []byte("salut")
+	bob.Load(map[string][]byte{"docs/big.bin": big, "docs/notes/small.txt": small})
+
+	c.Hello(alice, bob)
+	dir := c.Download(alice, bob)
+
+	check__file(t, dir, "docs/big.bin", big)
+	check__file(t, dir, "docs/notes/small.txt", small)
+
+	// la racine de bob ne remplace pas celle d'alice (elle n'a rien chargé)
+	if alice.Me.RootHash != ([32]byte{}) {
+		t.Fatalf("RootHash d'alice changé par le RootReply de bob : %x", alice.Me.RootHash[:4])
+	}
+}
+
+func TestDownloadOnBadNetwork(t *testing.T) {
+	c := p2ptest.New__with__options(t, p2ptest.Options{
+		Peers: 2,
+		Seed:  7,
+		Conditions: memnet.Conditions{
+			Loss:      0.05,
+			Duplicate: 0.05,
+			Reorder:   0.2,
+			Jitter:    2 * time.Millisecond,
+		},
+	})
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	big := random__content(2, 60*1024)
+	bob.Load(map[string][]byte{"big.bin": big, "a/b/c.txt": []byte("c")})
+
+	c.Hello(alice, bob)
+	dir := c.Download(alice, bob)
+
+	check__file(t, dir, "big.bin", big)
+	check__file(t, dir, "a/b/c.txt", []byte("c"))
+
+	// le réseau a bien perdu, doublé et désordonné des paquets
+	stats := c.Net.Stats()
+	if stats.Lost == 0 || stats.Duplicated == 0 {
+		t.Fatalf("conditions non appliquées : %+v", stats)
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	c := p2ptest.New__with__options(t, p2ptest.Options{
+		Peers:      2,
+		Seed:       3,
+		Conditions: memnet.Conditions{Reorder: 0.3, Duplicate: 0.05},
+	})
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	big := random__content(3, 80*1024)
+	root := bob.Load(map[string][]byte{"x/big.bin": big, "y.txt": []byte("y")})
+	c.Hello(alice, bob)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// les chunks désordonnés attendent leur tour, puis le fichier est écrit dans l'ordre
+	dir := t.TempDir()
+	result := alice.Me.Download_tree__ctx(ctx, bob.Addr, root, p2p.DownloadOptions{RetryFailed: true, StreamTo: dir})
+	if !result.Complete() || len(result.IncompleteFiles) > 0 {
+		t.Fatalf("téléchargement incomplet : %d noeud(s) manquant(s), fichiers %v", len(result.Missing), result.IncompleteFiles)
+	}
+
+	check__file(t, dir, "x/big.bin", big)
+	check__file(t, dir, "y.txt", []byte("y"))
+}
+
+func TestNatTraversal(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	// les deux pairs sont connus du serveur, bob est derrière un NAT
+	c.Hello(alice, c.Server)
+	c.Hello(bob, c.Server)
+	if err := c.Net.SetNAT(bob.Addr, memnet.AddressRestricted, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice ne peut pas joindre bob directement
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := alice.Me.Send__hello__ctx(ctx, bob.Addr); err == nil {
+		t.Fatal("Hello accepté malgré le NAT de bob")
+	}
+	if c.Net.Stats().Filtered == 0 {
+		t.Fatal("aucun paquet filtré par le NAT")
+	}
+
+	// le serveur demande à bob d'ouvrir son NAT vers alice
+	if err := c.Nat__traversal(alice, bob); err != nil {
+		t.Fatalf("NatTraversalRequest : %v", err)
+	}
+	c.Wait__for("ouverture du NAT de bob", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		return alice.Me.Send__hello__ctx(ctx, bob.Addr) == nil
+	})
+
+	c.Hello(alice, bob)
+}
+
+func TestSkeletonOffline(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+	alice.Me.SkeletonDir = t.TempDir()
+
+	root := bob.Load(map[string][]byte{
+		"photos/2024/a.jpg": []byte("a"),
+		"photos/b.png":      []byte("b"),
+		"big.bin":           random__content(4, 10*1024),
+	})
+	c.Hello(alice, bob)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := alice.Me.Download_skeleton__ctx(ctx, bob.Addr, bob.Name, root, false)
+	if err != nil || !result.Complete() {
+		t.Fatalf("squelette : %v, %d noeud(s) manquant(s)", err, len(result.Missing))
+	}
+
+	// on coupe le réseau, et alice oublie tout ce qu'elle avait en mémoire (comme après un redémarrage)
+	c.Net.SetConditions(memnet.Conditions{Loss: 1})
+	alice.Load(map[string][]byte{"photos/b.png": []byte("b")})
+
+	skeletonRoot, err := alice.Me.Skeleton__root(bob.Name)
+	if err != nil || skeletonRoot != root {
+		t.Fatalf("squelette relu : %v (racine %x, attendu %x)", err, skeletonRoot[:4], root[:4])
+	}
+
+	matches, err := alice.Me.Resolve__patterns(ctx, "", skeletonRoot, []string{"photos/**/*.jpg"})
+	if err != nil {
+		t.Fatalf("motifs hors ligne : %v", err)
+	}
+	if len(matches) != 1 || matches[0].Path != "photos/2024/a.jpg" || matches[0].IsDir {
+		t.Fatalf("motifs hors ligne : %+v", matches)
+	}
+
+	// ce que bob a de plus (ou de différent) que nous
+	changes, err := alice.Me.Diff__trees(ctx, alice.Root, skeletonRoot)
+	if err != nil {
+		t.Fatalf("diff : %v", err)
+	}
+	expected := []p2p.TreeChange{
+		{Path: "photos/2024", Kind: '+', IsDir: true},
+		{Path: "big.bin", Kind: '+'},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("diff : %+v, attendu %+v", changes, expected)
+	}
+	for _, change := range expected {
+		found := false
+		for _, got := range changes {
+			found = found || got == change
+		}
+		if !found {
+			t.Fatalf("diff : %+v manquant dans %+v", change, changes)
+		}
+	}
+}
+
+// un dossier dont les entrées sont (nom, hash), encodé comme dans le protocole
+func directory__node(entries map[string][32]byte) []byte {
+	node := []byte{filesystem.TypeDirectory}
+	for name, hash := range entries {
+		var entry [64]byte
+		copy(entry[:32], name)
+		copy(entry[32:], hash[:])
+		node = append(node, entry[:]...)
+	}
+	return node
+}
+
+func TestUnsafeEntryName(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	// bob annonce une entrée ".." qui contient un fichier : il ne doit jamais être écrit hors du dossier
+	chunk := append([]byte{filesystem.TypeChunk}, "evil"...)
+	chunkHash := sha256.Sum256(chunk)
+	inner := directory__node(map[string][32]byte{"x": chunkHash})
+	innerHash := sha256.Sum256(inner)
+	root := directory__node(map[string][32]byte{"..": innerHash, "ok.txt": chunkHash})
+	rootHash := sha256.Sum256(root)
+
+	bob.Me.DbLock.Lock()
+	bob.Me.Database[chunkHash] = chunk
+	bob.Me.Database[innerHash] = inner
+	bob.Me.Database[rootHash] = root
+	bob.Me.DbLock.Unlock()
+
+	c.Hello(alice, bob)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dir := filepath.Join(t.TempDir(), "out")
+	result := alice.Me.Download_tree__ctx(ctx, bob.Addr, rootHash, p2p.DownloadOptions{RetryFailed: true, StreamTo: dir})
+
+	// l'entrée refusée reste manquante, même après le second passage
+	if len(result.Missing) != 1 || result.Missing[0].Path != ".." {
+		t.Fatalf("noeuds manquants %+v, attendu seulement \"..\"", result.Missing)
+	}
+	check__file(t, dir, "ok.txt", []byte("evil"))
+	if _, err := os.Stat(filepath.Join(dir, "..", "x")); !os.IsNotExist(err) {
+		t.Fatalf("fichier écrit hors du dossier de téléchargement (%v)", err)
+	}
+	alice.Me.DbLock.Lock()
+	_, fetched := alice.Me.Database[innerHash]
+	alice.Me.DbLock.Unlock()
+	if fetched {
+		t.Fatal("le dossier \"..\" a été téléchargé")
+	}
+}
+
+func TestRekeyFailureKeepsEncryption(t *testing.T) {
+	c := p2ptest.New(t, 2)
+	alice, bob := c.Peers[0], c.Peers[1]
+
+	// alice change de clé après quelques messages, et les échanges abandonnent vite
+	alice.Me.RekeyAfterMessages = 6
+	alice.Me.HandshakeRetry = 10 * time.Millisecond
+	bob.Me.HandshakeRetry = 10 * time.Millisecond
+
+	c.Hello(alice, bob)
+	c.Wait__encrypted(alice, bob)
+
+	// un attaquant sur le chemin perd tous les KeyConfirm : le changement de clé ne peut pas aboutir
+	c.Net.SetFilter(func(from, to string, data []byte) bool {
+		return len(data) > 4 && data[4] == p2p.TypeKeyConfirm
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rootRequest := func() {
+		t.Helper()
+		if _, err := alice.Me.Send__RootRequest__ctx(ctx, bob.Addr); err != nil {
+			t.Fatalf("RootRequest : %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		rootRequest()
+	}
+
+	c.Wait__for("échec du changement de clé", func() bool {
+		return alice.Me.Handshake__state(bob.Addr) == p2p.HandshakeFailed && bob.Me.Handshake__state(alice.Addr) == p2p.HandshakeFailed
+	})
+
+	// les deux pairs gardent leurs clés : rien ne repasse en clair
+	for _, pair := range [][2]*p2ptest.Peer{{alice, bob}, {bob, alice}} {
+		pair[0].Me.Mutex.Lock()
+		encrypted := pair[0].Me.Sessions[pair[1].Addr].IsEncrypted
+		pair[0].Me.Mutex.Unlock()
+		if !encrypted {
+			t.Fatalf("%s repasse en clair avec %s après l'échec du changement de clé", pair[0].Name, pair[1].Name)
+		}
+	}
+
+	// le réseau redevient normal : le changement de clé est relancé et aboutit
+	c.Net.SetFilter(nil)
+	rootRequest()
+	c.Wait__for("nouveau changement de clé", func() bool {
+		return alice.Me.Handshake__state(bob.Addr) == p2p.HandshakeDone
+	})
+	c.Wait__encrypted(alice, bob)
+	rootRequest()
+}